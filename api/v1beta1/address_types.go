@@ -0,0 +1,104 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// MachineAddressType is the type of an address of the host, like the MachineAddressType of cluster api
+// +kubebuilder:validation:Enum=SSH;InternalIP;ExternalIP;Hostname
+type MachineAddressType string
+
+const (
+	// MachineSSHAddress is an address the host is connected to by ssh, tried after the endpoint host,
+	// such as the IP of a management NIC
+	MachineSSHAddress MachineAddressType = "SSH"
+
+	// MachineInternalIP is the IP of the kubernetes traffic, used as the node ip of kubelet
+	// and the advertise address of kubeadm
+	MachineInternalIP MachineAddressType = "InternalIP"
+
+	// MachineExternalIP is an IP the host is reached on from outside the cluster
+	MachineExternalIP MachineAddressType = "ExternalIP"
+
+	// MachineHostName is a DNS name of the host
+	MachineHostName MachineAddressType = "Hostname"
+)
+
+// MachineAddress is an address of the host
+type MachineAddress struct {
+	// Type is the type of the address
+	Type MachineAddressType `json:"type"`
+
+	// Address is the address, an IP for InternalIP and ExternalIP, an IP or a DNS name for SSH and Hostname
+	Address string `json:"address"`
+}
+
+// Validate check the address matches its type
+func (a MachineAddress) Validate() error {
+	switch a.Type {
+	case MachineInternalIP, MachineExternalIP:
+		if net.ParseIP(a.Address) == nil {
+			return fmt.Errorf("%s address %s is not an IP address", a.Type, a.Address)
+		}
+	case MachineSSHAddress:
+		if !remote.ValidAddress(a.Address) {
+			return fmt.Errorf("%s address %s is neither an IP address nor a DNS name", a.Type, a.Address)
+		}
+	case MachineHostName:
+		if errs := validation.IsDNS1123Subdomain(a.Address); len(errs) != 0 {
+			return fmt.Errorf("%s address %s is not a DNS name: %v", a.Type, a.Address, errs)
+		}
+	default:
+		return fmt.Errorf("unknown address type %q", a.Type)
+	}
+	return nil
+}
+
+// AddressesOfType returns the addresses of the metal node of the type, in the order of spec
+func (mn *MetalNode) AddressesOfType(addressType MachineAddressType) []string {
+	var addresses []string
+	for _, address := range mn.Spec.Addresses {
+		if address.Type == addressType {
+			addresses = append(addresses, address.Address)
+		}
+	}
+	return addresses
+}
+
+// InternalIP returns the first InternalIP of the metal node, empty if it has none
+func (mn *MetalNode) InternalIP() string {
+	if ips := mn.AddressesOfType(MachineInternalIP); len(ips) != 0 {
+		return ips[0]
+	}
+	return ""
+}
+
+// ValidateAddresses check the addresses of the metal node match their types
+func (mn *MetalNode) ValidateAddresses() error {
+	for _, address := range mn.Spec.Addresses {
+		if err := address.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+// Conditions and condition Reasons for the MetalNode object
+
+const (
+	// TornDownCondition reports the kubernetes state left by a cluster was removed from the host,
+	// it is set once the metal node is released from its cluster or deleted
+	TornDownCondition = "TornDown"
+
+	// TeardownInProgressReason documents the teardown is running on the host
+	TeardownInProgressReason = "TeardownInProgress"
+
+	// TeardownFailedReason documents the teardown failed, it will be retried
+	TeardownFailedReason = "TeardownFailed"
+
+	// TeardownSucceededReason documents the host was cleaned up
+	TeardownSucceededReason = "TeardownSucceeded"
+)
+
+const (
+	// HealthyCondition summarizes the health checks of an initialized metal node,
+	// the node is not ready while it is False
+	HealthyCondition = "Healthy"
+
+	// ReachableCondition reports the host can be connected over ssh
+	ReachableCondition = "Reachable"
+
+	// ContainerRuntimeReadyCondition reports the container runtime is running
+	ContainerRuntimeReadyCondition = "ContainerRuntimeReady"
+
+	// KubeletReadyCondition reports kubelet is running, it is only checked on bootstrapped nodes
+	KubeletReadyCondition = "KubeletReady"
+
+	// DiskPressureCondition reports the disk of / or /var/lib is nearly full
+	DiskPressureCondition = "DiskPressure"
+
+	// MemoryPressureCondition reports the host is running out of memory
+	MemoryPressureCondition = "MemoryPressure"
+
+	// PackagesInstalledCondition reports the packages installed by the initialization are still there
+	// with the same versions
+	PackagesInstalledCondition = "PackagesInstalled"
+
+	// HealthyReason documents all the health checks passed
+	HealthyReason = "Healthy"
+
+	// UnhealthyReason documents at least one of the health checks failed
+	UnhealthyReason = "Unhealthy"
+
+	// ProbeSucceededReason documents a health check passed
+	ProbeSucceededReason = "ProbeSucceeded"
+
+	// ProbeFailedReason documents a health check failed
+	ProbeFailedReason = "ProbeFailed"
+
+	// HostUnreachableReason documents a health check could not run because the host is unreachable
+	HostUnreachableReason = "HostUnreachable"
+)
+
+const (
+	// OSSupportedCondition reports the os of the host is supported by the initialization,
+	// it is set before each initialization from the inventory of the host
+	OSSupportedCondition = "OSSupported"
+
+	// ProvisionerSelectedReason documents the initialization of the distribution of the host was selected
+	ProvisionerSelectedReason = "ProvisionerSelected"
+
+	// UnsupportedOSReason documents no initialization supports the os of the host
+	UnsupportedOSReason = "UnsupportedOS"
+
+	// OSUnknownReason documents the os of the host could not be detected
+	OSUnknownReason = "OSUnknown"
+)
+
+const (
+	// VersionsMatchedCondition reports the versions installed on the host are the versions in spec,
+	// a mismatch is reinstalled unless the host is bootstrapped
+	VersionsMatchedCondition = "VersionsMatched"
+
+	// VersionsMatchedReason documents the versions installed are the versions in spec
+	VersionsMatchedReason = "VersionsMatched"
+
+	// UpgradeBlockedReason documents the versions changed but the bootstrapped host can't be reinstalled,
+	// it is reinstalled once released from its cluster
+	UpgradeBlockedReason = "UpgradeBlocked"
+)
+
+const (
+	// PreflightPassedCondition reports the preflight checks passed before the latest initialization,
+	// the checks are listed in status.preflight
+	PreflightPassedCondition = "PreflightPassed"
+
+	// PreflightPassedReason documents none of the preflight checks failed
+	PreflightPassedReason = "PreflightPassed"
+
+	// PreflightFailedReason documents at least one of the preflight checks failed
+	PreflightFailedReason = "PreflightFailed"
+)
+
+const (
+	// ClaimBoundCondition reports a MetalNodeClaim is bound to a metal node
+	ClaimBoundCondition = "Bound"
+
+	// ClaimBoundReason documents the claim is bound to the metal node in its status
+	ClaimBoundReason = "Bound"
+
+	// NoMatchingMetalNodeReason documents no available metal node matches the claim, it is bound once one does
+	NoMatchingMetalNodeReason = "NoMatchingMetalNode"
+
+	// MetalNodeLostReason documents the metal node bound to the claim was deleted
+	MetalNodeLostReason = "MetalNodeLost"
+)
+
+const (
+	// MaintenanceCondition reports the metal node is in maintenance, set while spec.maintenance is true
+	MaintenanceCondition = "Maintenance"
+
+	// InMaintenanceReason documents no remote action nor health check runs on the host
+	InMaintenanceReason = "InMaintenance"
+)
+
+const (
+	// BootstrapProbedCondition reports the host of a metal node which lost its status was probed for a bootstrap,
+	// the host is not initialized while it is False
+	BootstrapProbedCondition = "BootstrapProbed"
+
+	// BootstrapProbedReason documents the host was probed, it was adopted if bootstrapped
+	BootstrapProbedReason = "BootstrapProbed"
+
+	// BootstrapProbeFailedReason documents the host could not be probed, the probe is retried with backoff
+	BootstrapProbeFailedReason = "BootstrapProbeFailed"
+)
+
+const (
+	// ProvisioningSpecMatchedCondition reports the provisioning spec is the one the host was provisioned with,
+	// the host is provisioned again with the reprovision annotation
+	ProvisioningSpecMatchedCondition = "ProvisioningSpecMatched"
+
+	// ProvisioningSpecMatchedReason documents the provisioning spec did not change since the host was provisioned
+	ProvisioningSpecMatchedReason = "ProvisioningSpecMatched"
+
+	// ProvisioningSpecDriftedReason documents the provisioning spec changed since the host was provisioned
+	ProvisioningSpecDriftedReason = "ProvisioningSpecDrifted"
+)
+
+// Conditions and condition Reasons for the MetalCluster and the MetalMachine objects
+
+const (
+	// LoadBalancerReadyCondition reports the load balancer of the control plane endpoint is ready
+	LoadBalancerReadyCondition = "LoadBalancerReady"
+
+	// EndpointMissingReason documents the control plane endpoint is not set, nor defaulted by the load balancer
+	EndpointMissingReason = "EndpointMissing"
+
+	// WaitingForLoadBalancerNodeReason documents the claim of the load balancer node is not bound yet
+	WaitingForLoadBalancerNodeReason = "WaitingForLoadBalancerNode"
+
+	// LoadBalancerConfigFailedReason documents haproxy could not be configured on the load balancer node
+	LoadBalancerConfigFailedReason = "LoadBalancerConfigFailed"
+
+	// LoadBalancerReadyReason documents the load balancer is ready
+	LoadBalancerReadyReason = "LoadBalancerReady"
+)
+
+const (
+	// MetalNodeReadyCondition reports the metal node claimed by the machine is bootstrapped
+	MetalNodeReadyCondition = "MetalNodeReady"
+
+	// WaitingForClusterInfrastructureReason documents the infrastructure of the cluster is not ready yet
+	WaitingForClusterInfrastructureReason = "WaitingForClusterInfrastructure"
+
+	// WaitingForBootstrapDataReason documents the bootstrap data secret of the Machine is not set yet
+	WaitingForBootstrapDataReason = "WaitingForBootstrapData"
+
+	// WaitingForMetalNodeReason documents no metal node is claimed by the machine yet
+	WaitingForMetalNodeReason = "WaitingForMetalNode"
+
+	// BootstrappingReason documents the metal node is claimed and waits for its bootstrap
+	BootstrappingReason = "Bootstrapping"
+
+	// MetalNodeBootstrappedReason documents the metal node is bootstrapped
+	MetalNodeBootstrappedReason = "MetalNodeBootstrapped"
+)
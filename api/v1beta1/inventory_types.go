@@ -0,0 +1,131 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Labels set by the controller from the inventory of the host, so metal nodes can be selected by capacity
+const (
+	OSLabel             = "inventory.bocloud.io/os"
+	OSVersionLabel      = "inventory.bocloud.io/os-version"
+	ArchitectureLabel   = "inventory.bocloud.io/arch"
+	CPUCountLabel       = "inventory.bocloud.io/cpu-count"
+	MemoryGiBLabel      = "inventory.bocloud.io/memory-gib"
+	VirtualizationLabel = "inventory.bocloud.io/virtualization"
+)
+
+// Inventory denotes the hardware and os facts gathered on the host
+type Inventory struct {
+	// OS is the operating system of the host
+	// +optional
+	OS OSInfo `json:"os,omitempty"`
+
+	// Hostname is the hostname of the host
+	// +optional
+	Hostname string `json:"hostname,omitempty"`
+
+	// ProductUUID is the SMBIOS product uuid of the host, /sys/class/dmi/id/product_uuid
+	// +optional
+	ProductUUID string `json:"productUUID,omitempty"`
+
+	// Kernel is the kernel release, such as 5.4.0-109-generic
+	// +optional
+	Kernel string `json:"kernel,omitempty"`
+
+	// Architecture is the machine hardware name, such as x86_64 or aarch64
+	// +optional
+	Architecture string `json:"architecture,omitempty"`
+
+	// CPU denotes the processors of the host
+	// +optional
+	CPU CPUInfo `json:"cpu,omitempty"`
+
+	// Memory is the total memory of the host
+	// +optional
+	Memory *resource.Quantity `json:"memory,omitempty"`
+
+	// Disks are the block devices of the host, partitions excluded
+	// +optional
+	Disks []Disk `json:"disks,omitempty"`
+
+	// NICs are the network interfaces of the host, loopback excluded
+	// +optional
+	NICs []NIC `json:"nics,omitempty"`
+
+	// Virtualization is the virtualization technology the host runs on, none for a bare metal host
+	// +optional
+	Virtualization string `json:"virtualization,omitempty"`
+
+	// CollectionTime is when the facts were gathered
+	CollectionTime metav1.Time `json:"collectionTime"`
+}
+
+// OSInfo denotes the operating system, as found in /etc/os-release
+type OSInfo struct {
+	// Distro is the ID of the distribution, such as ubuntu or centos
+	// +optional
+	Distro string `json:"distro,omitempty"`
+
+	// Version is the VERSION_ID of the distribution, such as 20.04 or 7
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// PrettyName is the human readable name of the distribution
+	// +optional
+	PrettyName string `json:"prettyName,omitempty"`
+}
+
+// CPUInfo denotes the processors of the host
+type CPUInfo struct {
+	// Model is the model name of the processors
+	// +optional
+	Model string `json:"model,omitempty"`
+
+	// Count is the number of processing units
+	// +optional
+	Count int `json:"count,omitempty"`
+}
+
+// Disk denotes a block device of the host
+type Disk struct {
+	// Name is the kernel name of the device, such as sda
+	Name string `json:"name"`
+
+	// Size is the size of the device
+	Size resource.Quantity `json:"size"`
+
+	// Rotational denotes the device is a hard disk drive
+	// +optional
+	Rotational bool `json:"rotational,omitempty"`
+}
+
+// NIC denotes a network interface of the host
+type NIC struct {
+	// Name is the name of the interface, such as eth0
+	Name string `json:"name"`
+
+	// MAC is the hardware address of the interface
+	// +optional
+	MAC string `json:"mac,omitempty"`
+
+	// IPs are the addresses assigned to the interface, in CIDR notation
+	// +optional
+	IPs []string `json:"ips,omitempty"`
+}
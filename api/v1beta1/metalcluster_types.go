@@ -0,0 +1,176 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// MetalClusterFinalizer allows the controller to release the load balancer of the cluster before it is deleted
+	MetalClusterFinalizer = "bocloud.io/metalcluster"
+
+	// FailureDomainLabel is the label of the MetalNodes giving their failure domain, such as a rack or a room,
+	// the MetalMachines of a failure domain only claim the metal nodes with the label of the failure domain
+	FailureDomainLabel = "bocloud.io/failure-domain"
+)
+
+// LoadBalancerType is the load balancer of the control plane endpoint
+// +kubebuilder:validation:Enum=none;kube-vip;haproxy
+type LoadBalancerType string
+
+const (
+	// LoadBalancerNone lets the endpoint be served outside of the cluster, such as by a hardware load balancer
+	LoadBalancerNone LoadBalancerType = "none"
+
+	// LoadBalancerKubeVIP runs kube-vip as a static pod on the control plane nodes to announce the endpoint host
+	LoadBalancerKubeVIP LoadBalancerType = "kube-vip"
+
+	// LoadBalancerHAProxy runs haproxy on a metal node claimed by the cluster in front of the control plane nodes
+	LoadBalancerHAProxy LoadBalancerType = "haproxy"
+)
+
+// DefaultKubeVIPImage is the image of kube-vip when the load balancer sets none
+const DefaultKubeVIPImage = "ghcr.io/kube-vip/kube-vip:v0.5.0"
+
+// APIEndpoint is the endpoint of the api server of a cluster
+type APIEndpoint struct {
+	// Host is the IP address or the DNS name of the endpoint
+	Host string `json:"host"`
+
+	// Port is the port of the endpoint
+	Port int32 `json:"port"`
+}
+
+// IsZero check if the endpoint is not set
+func (e APIEndpoint) IsZero() bool {
+	return e.Host == "" || e.Port == 0
+}
+
+// LoadBalancerSpec defines the load balancer of the control plane endpoint
+type LoadBalancerSpec struct {
+	// Type is the load balancer, none if it is not set
+	// +kubebuilder:default=none
+	// +optional
+	Type LoadBalancerType `json:"type,omitempty"`
+
+	// Interface is the network interface kube-vip announces the endpoint host on, the interface of the default route
+	// if it is not set
+	// +optional
+	Interface string `json:"interface,omitempty"`
+
+	// Image is the image of kube-vip, DefaultKubeVIPImage if it is not set
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Selector matches the labels of the metal node claimed to run haproxy, any available metal node if it is not set
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// FailureDomainSpec is a failure domain of the cluster, its metal nodes have the FailureDomainLabel with its name
+type FailureDomainSpec struct {
+	// ControlPlane tells the control plane machines may be placed in the failure domain
+	// +optional
+	ControlPlane bool `json:"controlPlane,omitempty"`
+
+	// Attributes are free-form attributes of the failure domain
+	// +optional
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// FailureDomains are the failure domains of a cluster, by name
+type FailureDomains map[string]FailureDomainSpec
+
+// MetalClusterSpec defines the desired state of MetalCluster
+type MetalClusterSpec struct {
+	// ControlPlaneEndpoint is the endpoint of the api server of the cluster. It is required unless the load balancer
+	// is haproxy, which defaults it to the InternalIP of its metal node and the port 6443
+	// +optional
+	ControlPlaneEndpoint APIEndpoint `json:"controlPlaneEndpoint,omitempty"`
+
+	// LoadBalancer is the load balancer of the control plane endpoint
+	// +optional
+	LoadBalancer LoadBalancerSpec `json:"loadBalancer,omitempty"`
+
+	// FailureDomains are the failure domains the machines of the cluster are spread over
+	// +optional
+	FailureDomains FailureDomains `json:"failureDomains,omitempty"`
+}
+
+// MetalClusterStatus defines the observed state of MetalCluster
+type MetalClusterStatus struct {
+	// Ready denotes the control plane endpoint and its load balancer are ready
+	// +optional
+	Ready bool `json:"ready"`
+
+	// FailureDomains are the failure domains of spec, reported to Cluster API
+	// +optional
+	FailureDomains FailureDomains `json:"failureDomains,omitempty"`
+
+	// LoadBalancerNode is the metal node running haproxy
+	// +optional
+	LoadBalancerNode string `json:"loadBalancerNode,omitempty"`
+
+	// LoadBalancerConfigHash is the sha256 of the haproxy config applied on the load balancer node
+	// +optional
+	LoadBalancerConfigHash string `json:"loadBalancerConfigHash,omitempty"`
+
+	// Operation denotes the remote operation running on the load balancer node, if any
+	// +optional
+	Operation *OperationStatus `json:"operation,omitempty"`
+
+	// Conditions are the observations of the state of the cluster infrastructure
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=mc
+// +kubebuilder:printcolumn:name="CLUSTER",type="string",JSONPath=".metadata.labels.cluster\\.x-k8s\\.io/cluster-name"
+// +kubebuilder:printcolumn:name="READY",type="boolean",JSONPath=".status.ready"
+// +kubebuilder:printcolumn:name="ENDPOINT",type="string",JSONPath=".spec.controlPlaneEndpoint.host"
+// +kubebuilder:printcolumn:name="LOADBALANCER",type="string",JSONPath=".spec.loadBalancer.type"
+// +kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MetalCluster is the Schema for the metalclusters API, the Cluster API infrastructure cluster of the metal nodes
+type MetalCluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MetalClusterSpec   `json:"spec,omitempty"`
+	Status MetalClusterStatus `json:"status,omitempty"`
+}
+
+// IsPaused check if the metal cluster is paused by PausedAnnotation or ClusterPausedAnnotation
+func (c *MetalCluster) IsPaused() bool {
+	return hasPausedAnnotation(c.ObjectMeta)
+}
+
+//+kubebuilder:object:root=true
+
+// MetalClusterList contains a list of MetalCluster
+type MetalClusterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetalCluster `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetalCluster{}, &MetalClusterList{})
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// MetalMachineFinalizer allows the controller to release the metal node of the machine before it is deleted
+	MetalMachineFinalizer = "bocloud.io/metalmachine"
+
+	// ProviderIDPrefix is the prefix of the provider ids of the metal nodes, followed by their namespace and name
+	ProviderIDPrefix = "metalnode://"
+)
+
+// MetalMachineSpec defines the desired state of MetalMachine
+type MetalMachineSpec struct {
+	// ProviderID is the id of the metal node of the machine, set by the controller once the metal node is claimed,
+	// kubelet registers the node with it
+	// +optional
+	ProviderID *string `json:"providerID,omitempty"`
+
+	// FailureDomain is the failure domain the machine is placed in, the one of its Machine if it is not set
+	// +optional
+	FailureDomain *string `json:"failureDomain,omitempty"`
+
+	// Selector matches the labels of the metal nodes which can be claimed, including the inventory labels,
+	// all the metal nodes of the namespace match if it is not set
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Resources are the minimum capacity of the host
+	// +optional
+	Resources ClaimResources `json:"resources,omitempty"`
+}
+
+// MetalMachineStatus defines the observed state of MetalMachine
+type MetalMachineStatus struct {
+	// Ready denotes the metal node of the machine is bootstrapped
+	// +optional
+	Ready bool `json:"ready"`
+
+	// NodeName is the metal node claimed by the machine
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+
+	// Addresses are the addresses of the metal node
+	// +optional
+	Addresses []MachineAddress `json:"addresses,omitempty"`
+
+	// FailureReason is a terminal problem of the machine, such as its metal node was lost
+	// +optional
+	FailureReason *string `json:"failureReason,omitempty"`
+
+	// FailureMessage is the message of the terminal problem of the machine
+	// +optional
+	FailureMessage *string `json:"failureMessage,omitempty"`
+
+	// Conditions are the observations of the state of the machine infrastructure
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=mm
+// +kubebuilder:printcolumn:name="CLUSTER",type="string",JSONPath=".metadata.labels.cluster\\.x-k8s\\.io/cluster-name"
+// +kubebuilder:printcolumn:name="READY",type="boolean",JSONPath=".status.ready"
+// +kubebuilder:printcolumn:name="NODE",type="string",JSONPath=".status.nodeName"
+// +kubebuilder:printcolumn:name="PROVIDERID",type="string",JSONPath=".spec.providerID"
+// +kubebuilder:printcolumn:name="MACHINE",type="string",JSONPath=".metadata.ownerReferences[?(@.kind=='Machine')].name"
+// +kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MetalMachine is the Schema for the metalmachines API, the Cluster API infrastructure machine of a metal node.
+// It claims a metal node with a MetalNodeClaim of the same name, which is bootstrapped with the data of its Machine
+type MetalMachine struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MetalMachineSpec   `json:"spec,omitempty"`
+	Status MetalMachineStatus `json:"status,omitempty"`
+}
+
+// IsPaused check if the metal machine is paused by PausedAnnotation or ClusterPausedAnnotation
+func (m *MetalMachine) IsPaused() bool {
+	return hasPausedAnnotation(m.ObjectMeta)
+}
+
+//+kubebuilder:object:root=true
+
+// MetalMachineList contains a list of MetalMachine
+type MetalMachineList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetalMachine `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetalMachine{}, &MetalMachineList{})
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MetalMachineTemplateSpec defines the desired state of MetalMachineTemplate
+type MetalMachineTemplateSpec struct {
+	// Template is the MetalMachine created from the template, such as by a MachineDeployment
+	Template MetalMachineTemplateResource `json:"template"`
+}
+
+// MetalMachineTemplateResource is the MetalMachine created from a template
+type MetalMachineTemplateResource struct {
+	// ObjectMeta is the metadata of the MetalMachines, only the labels and the annotations are used
+	// +optional
+	ObjectMeta ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec is the spec of the MetalMachines
+	Spec MetalMachineSpec `json:"spec"`
+}
+
+// ObjectMeta is the labels and the annotations of the objects created from a template
+type ObjectMeta struct {
+	// Labels are the labels of the objects
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations are the annotations of the objects
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=mmt
+
+// MetalMachineTemplate is the Schema for the metalmachinetemplates API, the template of the MetalMachines
+// of the MachineDeployments and the KubeadmControlPlanes
+type MetalMachineTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MetalMachineTemplateSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MetalMachineTemplateList contains a list of MetalMachineTemplate
+type MetalMachineTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetalMachineTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetalMachineTemplate{}, &MetalMachineTemplateList{})
+}
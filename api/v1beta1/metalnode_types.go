@@ -20,13 +20,59 @@ import (
 	"fmt"
 	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
 	"github.com/git-czy/cluster-api-metalnode/utils"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"net"
 	"strings"
 )
 
 type InitializationState string
 
+// AdoptionPolicy tells how the host of a MetalNode already provisioned by hand is adopted
+// +kubebuilder:validation:Enum=Never;IfCompliant;MissingSteps
+type AdoptionPolicy string
+
+const (
+	// AdoptNever initializes the host whatever is installed on it
+	AdoptNever AdoptionPolicy = "Never"
+
+	// AdoptIfCompliant skips the initialization of a host which has the container runtime, kubelet, kubeadm
+	// and kubectl of the expected versions, the host is initialized otherwise
+	AdoptIfCompliant AdoptionPolicy = "IfCompliant"
+
+	// AdoptMissingSteps skips the initialization of a compliant host like AdoptIfCompliant, otherwise the
+	// built-in modules installing the container runtime or kubeadm are skipped if they are already compliant
+	AdoptMissingSteps AdoptionPolicy = "MissingSteps"
+)
+
+const (
+	// MetalNodeFinalizer allows the controller to clean up the host before the MetalNode is deleted
+	MetalNodeFinalizer = "bocloud.io/metalnode"
+
+	// RetryAnnotation can be set on a failed MetalNode to retry the initialization immediately,
+	// it is removed by the controller once the retry is started
+	RetryAnnotation = "bocloud.io/retry"
+
+	// ForceDeleteAnnotation can be set on a MetalNode to delete it without tearing down the host,
+	// e.g. when the host is unreachable forever
+	ForceDeleteAnnotation = "bocloud.io/force-delete"
+
+	// PausedAnnotation can be set on a MetalNode or a MetalNodeClaim to stop reconciling it, including its deletion,
+	// e.g. while it is moved to another management cluster by clusterctl move
+	PausedAnnotation = "bocloud.io/paused"
+
+	// ClusterPausedAnnotation is the pause annotation of Cluster API, it pauses a MetalNode or a MetalNodeClaim
+	// like PausedAnnotation
+	ClusterPausedAnnotation = "cluster.x-k8s.io/paused"
+
+	// ReprovisionAnnotation can be set on an initialized MetalNode to initialize it again, such as after its
+	// provisioning spec changed. It is refused while the host is bootstrapped unless its value is ReprovisionForce,
+	// it is removed by the controller once handled, after the teardown of the host when forced
+	ReprovisionAnnotation = "bocloud.io/reprovision"
+
+	// ReprovisionForce is the value of ReprovisionAnnotation tearing down a bootstrapped host and initializing it again
+	ReprovisionForce = "force"
+)
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -35,20 +81,104 @@ type MetalNodeSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// NodeName is the name of metal node
+	// NodeName is the hostname set on the host by the initialization, and so the name of its kubernetes node,
+	// it defaults to the name of the MetalNode
 	// +optional
 	NodeName string `json:"nodeName,omitempty"`
 
 	// NodeEndPoint is the endpoint of MetalNode
 	NodeEndPoint Endpoint `json:"nodeEndPoint"`
 
-	// InitializedCmd
+	// Addresses are the other addresses of the host, such as the IP of a data NIC for the kubernetes traffic.
+	// The first InternalIP is the node ip of kubelet and the advertise address of kubeadm,
+	// the SSH addresses are tried in order when the endpoint host can't be connected
+	// +optional
+	Addresses []MachineAddress `json:"addresses,omitempty"`
+
+	// ProfileRef is the MetalNodeProfile of the namespace defining the steps of the initialization,
+	// the default steps run all the built-in modules
+	// +optional
+	ProfileRef *corev1.LocalObjectReference `json:"profileRef,omitempty"`
+
+	// ClaimRef is the MetalNodeClaim bound to the metal node, set by the controller when it binds the claim,
+	// the metal node is released when the claim is deleted. The claim is not an owner reference of the metal node:
+	// the metal node is inventory outliving its claims, which the garbage collector would delete with the claim
+	// +optional
+	ClaimRef *corev1.ObjectReference `json:"claimRef,omitempty"`
+
+	// ConsumerRef is the object the metal node is allocated to, such as a CAPI Machine or an infrastructure machine
+	// +optional
+	ConsumerRef *corev1.ObjectReference `json:"consumerRef,omitempty"`
+
+	// ClusterName is the name of the cluster the metal node is allocated to
+	// +optional
+	ClusterName string `json:"clusterName,omitempty"`
+
+	// Roles are the roles of the node in its cluster, such as master,worker,etcd,load-balance...
+	// +optional
+	Roles []string `json:"roles,omitempty"`
+
+	// BootstrapDataSecretRef is the secret of the bootstrap data in the namespace of the metal node,
+	// the host is bootstrapped once it is set, and torn down once it is removed
+	// +optional
+	BootstrapDataSecretRef *corev1.LocalObjectReference `json:"bootstrapDataSecretRef,omitempty"`
+
+	// InitializationCmd replaces all the steps of the initialization with commands run one by one.
+	// Deprecated: use a MetalNodeProfile, it is ignored when ProfileRef is set
 	// +optional
 	InitializationCmd remote.Commands `json:"initializationCmd,omitempty"`
+
+	// KubernetesVersion is the version of kubelet, kubeadm and kubectl installed on the host, such as v1.23.5.
+	// It defaults to the version of the CAPI Machine consuming the MetalNode, directly or through its MetalMachine,
+	// the latest version is installed when neither is set
+	// +optional
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+
+	// ContainerRuntime denotes the container runtime installed on the host
+	// +optional
+	ContainerRuntime *ContainerRuntime `json:"containerRuntime,omitempty"`
+
+	// TeardownCmd replaces the default teardown (kubeadm reset, remove cni iptables and kubernetes files)
+	// run when the node is released from its cluster or deleted
+	// +optional
+	TeardownCmd remote.Commands `json:"teardownCmd,omitempty"`
+
+	// Adoption tells how a host with the container runtime and kubeadm already installed is adopted,
+	// it is checked before each initialization, Never if it is not set
+	// +optional
+	Adoption AdoptionPolicy `json:"adoption,omitempty"`
+
+	// Maintenance stops all the remote actions on the host and its health checks, such as while a disk is swapped,
+	// the metal node is not ready nor available to new claims but keeps its allocation
+	// +optional
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// ContainerRuntime denotes the container runtime installed on the host
+type ContainerRuntime struct {
+	// Type is the container runtime, docker is served to kubelet by cri-dockerd, containerd if it is not set
+	// +kubebuilder:validation:Enum=containerd;cri-o;docker
+	// +optional
+	Type string `json:"type,omitempty"`
+
+	// Version is the version of the container runtime, such as 1.6.4,
+	// the latest version is installed if it is not set
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// SandboxImage is the pause image of the pods, the one of the provisioning ConfigMap
+	// or registry.k8s.io/pause:3.6 if it is not set
+	// +optional
+	SandboxImage string `json:"sandboxImage,omitempty"`
+
+	// RegistryMirrors are the mirrors of docker.io, such as https://docker.mirrors.ustc.edu.cn,
+	// the ones of the provisioning ConfigMap if it is not set
+	// +optional
+	RegistryMirrors []string `json:"registryMirrors,omitempty"`
 }
 
 type Endpoint struct {
-	// ssh Host
+	// Host is the IP address or the DNS name of the host to ssh, IPv6 addresses are not enclosed in brackets
 	Host string `json:"host"`
 
 	// SSHAuth denotes ssh auth
@@ -63,12 +193,17 @@ type Auth struct {
 	// +optional
 	Password string `json:"password,omitempty"`
 
-	// SSHKey denotes ssh connect sshKey
+	// SSHKey denotes ssh connect sshKey, the unencrypted private key of the user in PEM or OpenSSH format,
+	// used when the password is not set
 	// +optional
 	SSHKey string `json:"sshKey,omitempty"`
 
-	// ssh Port.
-	Port int `json:"port"`
+	// ssh Port, 22 if it is not set
+	// +kubebuilder:default=22
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port int `json:"port,omitempty"`
 }
 
 // MetalNodeStatus defines the observed state of MetalNode
@@ -91,33 +226,194 @@ type MetalNodeStatus struct {
 	CheckFailureReason []string `json:"CheckFailureReason,omitempty"`
 
 	// Role denotes the role of this node ,such as master,worker,etcd,load-balance...
+	// Deprecated: use spec.roles, the controller moves it to spec and clears it
 	// +optional
 	Role []string `json:"role,omitempty"`
 
 	// RefCluster denotes the name of the cluster which this node belongs to
+	// Deprecated: use spec.clusterName, the controller moves it to spec and clears it
 	// +optional
 	RefCluster string `json:"refCluster,omitempty"`
 
 	// DataSecretName denotes the name of the secret which stores the data of this bootstrap data
+	// Deprecated: use spec.bootstrapDataSecretRef, the controller moves it to spec and clears it
 	// +optional
 	DataSecretName string `json:"dataSecretName,omitempty"`
 
 	// Bootstrapped denotes if this node is bootstrapped
 	Bootstrapped bool `json:"bootstrapped"`
 
+	// BootstrappedWith denotes the bootstrap data secret the host was bootstrapped with while allocated, empty if
+	// the host was adopted bootstrapped without allocation. The controller only tears down the hosts it knows
+	// were bootstrapped with an allocation
+	// +optional
+	BootstrappedWith string `json:"bootstrappedWith,omitempty"`
+
 	// BootstrappedFailureReason denotes run bootstrap shell command standard stderr
 	BootstrapFailureReason []string `json:"bootstrapFailureReason,omitempty"`
 
 	// Ready denotes this metal node is ready to init | join a k8s cluster
 	Ready bool `json:"ready"`
+
+	// Paused denotes the metal node is paused by an annotation, it is not reconciled
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+
+	// Addresses are the addresses of the host published to the infrastructure provider,
+	// the SSH addresses excluded
+	// +optional
+	Addresses []MachineAddress `json:"addresses,omitempty"`
+
+	// LastTransitionTime denotes the last time the InitializationState changed
+	// +optional
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Transitions records the latest InitializationState transitions, the oldest first
+	// +optional
+	Transitions []StateTransition `json:"transitions,omitempty"`
+
+	// FailureCount denotes how many times the initialization failed in a row
+	// +optional
+	FailureCount int `json:"failureCount,omitempty"`
+
+	// NextRetryTime denotes when the failed initialization will be retried
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+
+	// Operation denotes the remote operation running on this node in background
+	// +optional
+	Operation *OperationStatus `json:"operation,omitempty"`
+
+	// DeletingClaim denotes the name of the claim bound to the metal node which was seen being deleted,
+	// the metal node is only released by the controller once such a claim is gone
+	// +optional
+	DeletingClaim string `json:"deletingClaim,omitempty"`
+
+	// InstalledVersions denotes the versions installed by the initialization, recorded by the check,
+	// the health check reports a drift when they change
+	// +optional
+	InstalledVersions *InstalledVersions `json:"installedVersions,omitempty"`
+
+	// BundleVersion denotes the version of the offline bundle installed by the initialization,
+	// empty if the host was provisioned online
+	// +optional
+	BundleVersion string `json:"bundleVersion,omitempty"`
+
+	// ScriptHashes denotes the sha256 of the init scripts uploaded by the latest initialization, by file name
+	// +optional
+	ScriptHashes map[string]string `json:"scriptHashes,omitempty"`
+
+	// Profile denotes the MetalNodeProfile the latest initialization ran, with the generations of its chain
+	// +optional
+	Profile *AppliedProfile `json:"profile,omitempty"`
+
+	// ProvisioningHash denotes the sha256 of the spec the host was provisioned with: the host, port and user
+	// of the endpoint, an HMAC of the credentials keyed with the uid, the node name, the profile with the generations
+	// of its chain and the initialization commands
+	// +optional
+	ProvisioningHash string `json:"provisioningHash,omitempty"`
+
+	// Preflight denotes the results of the preflight checks run before the latest initialization,
+	// the initialization does not start if one of them failed
+	// +optional
+	Preflight []PreflightCheck `json:"preflight,omitempty"`
+
+	// LastHealthCheckTime denotes the last time the health of the host was checked
+	// +optional
+	LastHealthCheckTime *metav1.Time `json:"lastHealthCheckTime,omitempty"`
+
+	// Inventory denotes the hardware and os facts gathered on the host,
+	// they are gathered on the first connection and refreshed periodically
+	// +optional
+	Inventory *Inventory `json:"inventory,omitempty"`
+
+	// Conditions defines current service state of the MetalNode
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// InstalledVersions denotes the versions of the packages installed on the host
+type InstalledVersions struct {
+	// Kubelet is the version of kubelet
+	// +optional
+	Kubelet string `json:"kubelet,omitempty"`
+
+	// Kubeadm is the version of kubeadm
+	// +optional
+	Kubeadm string `json:"kubeadm,omitempty"`
+
+	// ContainerRuntime is the version of the container runtime
+	// +optional
+	ContainerRuntime string `json:"containerRuntime,omitempty"`
+
+	// ContainerRuntimeName is the name of the container runtime, such as containerd, cri-o or docker
+	// +optional
+	ContainerRuntimeName string `json:"containerRuntimeName,omitempty"`
+}
+
+// OperationStatus denotes a remote operation started by the controller
+type OperationStatus struct {
+	// ID identifies the operation
+	ID string `json:"id"`
+
+	// Name is the name of the operation, such as initialize,check,bootstrap
+	Name string `json:"name"`
+
+	// StartTime is when the operation was started
+	StartTime metav1.Time `json:"startTime"`
+}
+
+// AppliedProfile denotes the MetalNodeProfile an initialization ran
+type AppliedProfile struct {
+	// Name is the name of the profile referenced by the metal node
+	Name string `json:"name"`
+
+	// Generations are the generations of the profile and the ones it extends, like worker@2 base@5
+	Generations []string `json:"generations,omitempty"`
+}
+
+// StateTransition denotes the metal node entered State at Time
+type StateTransition struct {
+	// State is the InitializationState entered
+	State InitializationState `json:"state"`
+
+	// Time is when the state was entered
+	Time metav1.Time `json:"time"`
+
+	// Reason is a brief explanation of the transition
+	// +optional
+	Reason string `json:"reason,omitempty"`
 }
 
+// Validate check the host and the ssh credentials of the endpoint
 func (e Endpoint) Validate() error {
-	if e.Host != "" {
-		if host := net.ParseIP(e.Host); host == nil {
-			return fmt.Errorf("Endpoint's host %s not a validate IP,neither IPV4 nor IPV6 ", e.Host)
+	if e.Host == "" {
+		return fmt.Errorf("Endpoint's host is required ")
+	}
+	if !remote.ValidAddress(e.Host) {
+		return fmt.Errorf("Endpoint's host %s is neither an IP address nor a DNS name ", e.Host)
+	}
+	return e.SSHAuth.Validate()
+}
+
+// Validate check the credentials and the port of the ssh connection, port 0 is the default port
+func (a Auth) Validate() error {
+	if a.User == "" {
+		return fmt.Errorf("Endpoint's ssh user is required ")
+	}
+	if a.Password == "" && a.SSHKey == "" {
+		return fmt.Errorf("At least one of the endpoint's ssh password and ssh key is required ")
+	}
+	if a.SSHKey != "" {
+		if err := remote.ValidSSHKey(a.SSHKey); err != nil {
+			return fmt.Errorf("Endpoint's ssh key is not an unencrypted private key: %v ", err)
 		}
 	}
+	if a.Port < 0 || a.Port > 65535 {
+		return fmt.Errorf("Endpoint's ssh port %d is out of range ", a.Port)
+	}
 	return nil
 }
 
@@ -126,8 +422,18 @@ func (e Endpoint) Validate() error {
 // +kubebuilder:resource:shortName=mn
 // +kubebuilder:printcolumn:name="READY",type="boolean",JSONPath=".status.ready"
 // +kubebuilder:printcolumn:name="STATE",type="string",JSONPath=".status.InitializationState"
-// +kubebuilder:printcolumn:name="ROLE",type="string",JSONPath=".status.Role"
-// +kubebuilder:printcolumn:name="CLUSTER",type="string",JSONPath=".status.RefCluster"
+// +kubebuilder:printcolumn:name="ROLE",type="string",JSONPath=".spec.roles"
+// +kubebuilder:printcolumn:name="CLUSTER",type="string",JSONPath=".spec.clusterName"
+// +kubebuilder:printcolumn:name="MAINTENANCE",type="boolean",JSONPath=".spec.maintenance"
+// +kubebuilder:printcolumn:name="PAUSED",type="boolean",JSONPath=".status.paused",priority=1
+// +kubebuilder:printcolumn:name="INTERNAL-IP",type="string",JSONPath=".status.addresses[?(@.type=='InternalIP')].address",priority=1
+// +kubebuilder:printcolumn:name="CLAIM",type="string",JSONPath=".spec.claimRef.name",priority=1
+// +kubebuilder:printcolumn:name="RETRIES",type="integer",JSONPath=".status.failureCount",priority=1
+// +kubebuilder:printcolumn:name="OPERATION",type="string",JSONPath=".status.operation.name",priority=1
+// +kubebuilder:printcolumn:name="HEALTHY",type="string",JSONPath=".status.conditions[?(@.type=='Healthy')].status",priority=1
+// +kubebuilder:printcolumn:name="OS",type="string",JSONPath=".status.inventory.os.prettyName",priority=1
+// +kubebuilder:printcolumn:name="BUNDLE",type="string",JSONPath=".status.bundleVersion",priority=1
+// +kubebuilder:printcolumn:name="PROFILE",type="string",JSONPath=".status.profile.name",priority=1
 
 // MetalNode is the Schema for the metalnodes API
 type MetalNode struct {
@@ -138,23 +444,61 @@ type MetalNode struct {
 	Status MetalNodeStatus `json:"status,omitempty"`
 }
 
-// SetRole set MetalNode status role
+// SetRole set MetalNode spec roles
 func (mn *MetalNode) SetRole(role string) {
-	mn.Status.Role = append(mn.Status.Role, role)
+	mn.Spec.Roles = append(mn.Spec.Roles, role)
 }
 
 func (mn *MetalNode) HasRole(role string) bool {
-	return utils.SliceContainsString(mn.Status.Role, role)
+	return utils.SliceContainsString(mn.Spec.Roles, role)
 }
 
-// GetRefCluster get MetalNode status refCluster
+// GetRefCluster get MetalNode spec clusterName
 func (mn *MetalNode) GetRefCluster() string {
-	return mn.Status.RefCluster
+	return mn.Spec.ClusterName
 }
 
 // ContainRole check if the role is in the role list
 func (mn *MetalNode) ContainRole(role string) bool {
-	return mn.Status.Role != nil && len(mn.Status.Role) > 0 && strings.Contains(strings.Join(mn.Status.Role, ","), role)
+	return len(mn.Spec.Roles) > 0 && strings.Contains(strings.Join(mn.Spec.Roles, ","), role)
+}
+
+// DataSecretName returns the name of the secret of the bootstrap data, empty if it is not set
+func (mn *MetalNode) DataSecretName() string {
+	if mn.Spec.BootstrapDataSecretRef == nil {
+		return ""
+	}
+	return mn.Spec.BootstrapDataSecretRef.Name
+}
+
+// HostKeys returns the addresses identifying the host of the metal node, lower cased as the DNS names are case
+// insensitive: the host of the endpoint, the SSH addresses and the InternalIPs. The ExternalIPs may be shared by NAT
+func (mn *MetalNode) HostKeys() []string {
+	keys := []string{strings.ToLower(mn.Spec.NodeEndPoint.Host)}
+	for _, address := range mn.Spec.Addresses {
+		if address.Type != MachineSSHAddress && address.Type != MachineInternalIP {
+			continue
+		}
+		if key := strings.ToLower(address.Address); !utils.SliceContainsString(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// IsAllocated check if the metal node is allocated to a cluster or a consumer
+func (mn *MetalNode) IsAllocated() bool {
+	return mn.Spec.ConsumerRef != nil || mn.Spec.ClusterName != "" || mn.Spec.BootstrapDataSecretRef != nil
+}
+
+// ProviderID returns the provider id of the kubernetes node of the metal node
+func (mn *MetalNode) ProviderID() string {
+	return ProviderIDPrefix + mn.Namespace + "/" + mn.Name
+}
+
+// IsPaused check if the metal node is paused by PausedAnnotation or ClusterPausedAnnotation
+func (mn *MetalNode) IsPaused() bool {
+	return hasPausedAnnotation(mn.ObjectMeta)
 }
 
 // IsReady check if the metal node is ready
@@ -162,13 +506,15 @@ func (mn *MetalNode) IsReady() bool {
 	return mn.Status.Ready
 }
 
-// ResetMetalNode reset MetalNode status after ref cluster delete node
+// ResetMetalNode reset MetalNode allocation in spec after ref cluster delete node, the caller updates the metal node.
+// The node is not ready until the controller tore down the host,
+// then Bootstrapped is reset and the node is ready again
 func (mn *MetalNode) ResetMetalNode() {
-	mn.Status.Role = nil
-	mn.Status.RefCluster = ""
-	mn.Status.DataSecretName = ""
-	mn.Status.Bootstrapped = false
-	mn.Status.DataSecretName = ""
+	mn.Spec.ConsumerRef = nil
+	mn.Spec.ClusterName = ""
+	mn.Spec.Roles = nil
+	mn.Spec.BootstrapDataSecretRef = nil
+	mn.Status.Ready = false
 }
 
 //+kubebuilder:object:root=true
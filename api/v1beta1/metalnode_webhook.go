@@ -0,0 +1,284 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// DefaultSSHPort is the ssh port of the hosts which don't set one
+	DefaultSSHPort = remote.DefaultPort
+
+	// metalNodeValidatePath is the path of the validating webhook, it matches the kubebuilder marker below
+	metalNodeValidatePath = "/validate-bocloud-io-v1beta1-metalnode"
+
+	// metalNodeStatusValidatePath is the path of the validating webhook of the status, it matches the kubebuilder marker below
+	metalNodeStatusValidatePath = "/validate-bocloud-io-v1beta1-metalnode-status"
+
+	// metalNodeHostIndex indexes the metal nodes by the addresses identifying their host, see HostKeys
+	metalNodeHostIndex = "metalnode.host"
+
+	// inventoryLabelPrefix is the prefix of the labels set by the controller from the inventory of the host
+	inventoryLabelPrefix = "inventory.bocloud.io/"
+)
+
+//+kubebuilder:webhook:path=/mutate-bocloud-io-v1beta1-metalnode,mutating=true,failurePolicy=fail,sideEffects=None,groups=bocloud.io,resources=metalnodes,verbs=create;update,versions=v1beta1,name=mmetalnode.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-bocloud-io-v1beta1-metalnode,mutating=false,failurePolicy=fail,sideEffects=None,groups=bocloud.io,resources=metalnodes,verbs=create;update,versions=v1beta1,name=vmetalnode.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-bocloud-io-v1beta1-metalnode-status,mutating=false,failurePolicy=fail,sideEffects=None,groups=bocloud.io,resources=metalnodes/status,verbs=update,versions=v1beta1,name=vmetalnodestatus.kb.io,admissionReviewVersions=v1
+
+// SetupMetalNodeWebhookWithManager registers the defaulting and the validating webhooks of the MetalNodes,
+// controllerUsername is the user of the controller, the only one allowed to change the inventory labels and the status
+func SetupMetalNodeWebhookWithManager(mgr ctrl.Manager, controllerUsername string) error {
+	if err := ctrl.NewWebhookManagedBy(mgr).
+		For(&MetalNode{}).
+		WithDefaulter(&metalNodeDefaulter{}).
+		Complete(); err != nil {
+		return err
+	}
+	// the unique host is checked against the cache of the manager
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &MetalNode{}, metalNodeHostIndex,
+		func(obj client.Object) []string {
+			return obj.(*MetalNode).HostKeys()
+		}); err != nil {
+		return errors.Wrap(err, "failed to index the metal nodes by host")
+	}
+	mgr.GetWebhookServer().Register(metalNodeValidatePath, &webhook.Admission{
+		Handler: &metalNodeValidator{Client: mgr.GetClient(), controllerUsername: controllerUsername},
+	})
+	mgr.GetWebhookServer().Register(metalNodeStatusValidatePath, &webhook.Admission{
+		Handler: &metalNodeStatusValidator{controllerUsername: controllerUsername},
+	})
+	return nil
+}
+
+// metalNodeDefaulter sets the defaults of the MetalNodes
+type metalNodeDefaulter struct{}
+
+var _ admission.CustomDefaulter = &metalNodeDefaulter{}
+
+// Default sets the ssh port and the node name of the metal node
+func (d *metalNodeDefaulter) Default(_ context.Context, obj runtime.Object) error {
+	mn, ok := obj.(*MetalNode)
+	if !ok {
+		return fmt.Errorf("expected a MetalNode but got a %T", obj)
+	}
+	if mn.Spec.NodeEndPoint.SSHAuth.Port == 0 {
+		mn.Spec.NodeEndPoint.SSHAuth.Port = DefaultSSHPort
+	}
+	// the name is not generated yet when the metal node is created with generateName
+	if mn.Spec.NodeName == "" && mn.Name != "" {
+		mn.Spec.NodeName = mn.Name
+	}
+	return nil
+}
+
+// metalNodeValidator validates the MetalNodes, it needs the user of the request, so it is not a CustomValidator
+type metalNodeValidator struct {
+	client.Client
+	decoder *admission.Decoder
+
+	// controllerUsername is the user of the controller, empty when it is unknown
+	controllerUsername string
+}
+
+var _ admission.DecoderInjector = &metalNodeValidator{}
+
+// InjectDecoder injects the decoder of the admission requests
+func (v *metalNodeValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle validates the metal node created or updated
+func (v *metalNodeValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	mn := &MetalNode{}
+	if err := v.decoder.DecodeRaw(req.Object, mn); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	var old *MetalNode
+	if req.Operation == admissionv1.Update {
+		old = &MetalNode{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		// the metal node being deleted only loses its finalizer
+		if !mn.DeletionTimestamp.IsZero() {
+			return admission.Allowed("")
+		}
+	}
+
+	if err := mn.Spec.NodeEndPoint.Validate(); err != nil {
+		return admission.Denied(err.Error())
+	}
+	if err := mn.ValidateAddresses(); err != nil {
+		return admission.Denied(err.Error())
+	}
+	if errs := validation.IsDNS1123Subdomain(mn.Spec.NodeName); mn.Spec.NodeName != "" && len(errs) != 0 {
+		return admission.Denied(fmt.Sprintf("invalid nodeName %s: %s", mn.Spec.NodeName, strings.Join(errs, ", ")))
+	}
+	if err := v.validateUniqueHost(ctx, old, mn); err != nil {
+		return admission.Denied(err.Error())
+	}
+	if old != nil {
+		if err := validateEndpointUpdate(old, mn); err != nil {
+			return admission.Denied(err.Error())
+		}
+	}
+	// the metal nodes created by clusterctl move or a restore keep their inventory labels,
+	// they are set again from the inventory gathered by the controller
+	if old != nil && req.UserInfo.Username != v.controllerUsername {
+		if err := validateInventoryLabels(old, mn); err != nil {
+			return admission.Denied(err.Error())
+		}
+	}
+	return admission.Allowed("")
+}
+
+// validateUniqueHost check that no other metal node has an address identifying the host of the metal node,
+// only the addresses added by an update are checked. It is best-effort: the metal nodes are listed from the
+// cache of the manager, which misses the metal nodes created concurrently, the controller fails the duplicates
+func (v *metalNodeValidator) validateUniqueHost(ctx context.Context, old, mn *MetalNode) error {
+	var oldKeys []string
+	if old != nil {
+		oldKeys = old.HostKeys()
+	}
+	for _, key := range mn.HostKeys() {
+		if containsString(oldKeys, key) {
+			continue
+		}
+		list := &MetalNodeList{}
+		if err := v.List(ctx, list, client.MatchingFields{metalNodeHostIndex: key}); err != nil {
+			return errors.Wrap(err, "failed to list metal nodes")
+		}
+		for _, other := range list.Items {
+			if other.Namespace == mn.Namespace && other.Name == mn.Name {
+				continue
+			}
+			return fmt.Errorf("host %s is already used by metal node %s/%s", key, other.Namespace, other.Name)
+		}
+	}
+	return nil
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEndpointUpdate forbids moving a bootstrapped metal node to another host or node ip,
+// the credentials and the other addresses may still be changed
+func validateEndpointUpdate(old, mn *MetalNode) error {
+	if !old.Status.Bootstrapped && old.DataSecretName() == "" {
+		return nil
+	}
+	oldEndpoint, endpoint := old.Spec.NodeEndPoint, mn.Spec.NodeEndPoint
+	if oldEndpoint.Host != endpoint.Host || oldEndpoint.SSHAuth.Port != endpoint.SSHAuth.Port ||
+		oldEndpoint.SSHAuth.User != endpoint.SSHAuth.User {
+		return errors.New("the host, port and user of the endpoint can't be changed while the metal node is bootstrapped")
+	}
+	if old.InternalIP() != mn.InternalIP() {
+		return errors.New("the InternalIP can't be changed while the metal node is bootstrapped")
+	}
+	return nil
+}
+
+// validateInventoryLabels forbids changing the inventory labels, they are owned by the controller
+// and mirror the inventory in the status
+func validateInventoryLabels(old, mn *MetalNode) error {
+	oldLabels := old.Labels
+	for key, value := range mn.Labels {
+		if !strings.HasPrefix(key, inventoryLabelPrefix) {
+			continue
+		}
+		if current, ok := oldLabels[key]; !ok || current != value {
+			return fmt.Errorf("label %s is set by the controller from the inventory of the host", key)
+		}
+	}
+	for key := range oldLabels {
+		if _, ok := mn.Labels[key]; strings.HasPrefix(key, inventoryLabelPrefix) && !ok {
+			return fmt.Errorf("label %s is set by the controller from the inventory of the host", key)
+		}
+	}
+	return nil
+}
+
+// metalNodeStatusValidator forbids the users other than the controller to change the status of the metal nodes,
+// the state machine of the controller trusts its status, such as status.bootstrapped which enables the teardown.
+// The deprecated allocation fields are still written by the former providers, the controller moves them to spec
+type metalNodeStatusValidator struct {
+	decoder *admission.Decoder
+
+	// controllerUsername is the user of the controller, empty when it is unknown
+	controllerUsername string
+}
+
+var _ admission.DecoderInjector = &metalNodeStatusValidator{}
+
+// InjectDecoder injects the decoder of the admission requests
+func (v *metalNodeStatusValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle validates the update of the status of a metal node
+func (v *metalNodeStatusValidator) Handle(_ context.Context, req admission.Request) admission.Response {
+	// the controller run out of the cluster is not known, the status is not protected
+	if v.controllerUsername == "" || req.UserInfo.Username == v.controllerUsername {
+		return admission.Allowed("")
+	}
+	mn, old := &MetalNode{}, &MetalNode{}
+	if err := v.decoder.DecodeRaw(req.Object, mn); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if equality.Semantic.DeepEqual(withoutAllocation(&old.Status), withoutAllocation(&mn.Status)) {
+		return admission.Allowed("")
+	}
+	return admission.Denied("the status of the metal node is set by the controller, " +
+		"only the deprecated role, refCluster and dataSecretName may be changed")
+}
+
+// withoutAllocation returns a copy of the status without the deprecated allocation fields
+func withoutAllocation(status *MetalNodeStatus) *MetalNodeStatus {
+	status = status.DeepCopy()
+	status.Role = nil
+	status.RefCluster = ""
+	status.DataSecretName = ""
+	return status
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func testMetalNode(mutate func(mn *MetalNode)) *MetalNode {
+	mn := &MetalNode{}
+	mn.Spec.NodeEndPoint = Endpoint{Host: "10.0.0.1", SSHAuth: Auth{User: "root", Password: "secret", Port: 22}}
+	mn.Spec.Addresses = []MachineAddress{{Type: MachineInternalIP, Address: "192.168.0.1"}}
+	if mutate != nil {
+		mutate(mn)
+	}
+	return mn
+}
+
+func TestValidateEndpointUpdate(t *testing.T) {
+	bootstrapped := func(mn *MetalNode) { mn.Status.Bootstrapped = true }
+	allocated := func(mn *MetalNode) { mn.Spec.BootstrapDataSecretRef = &corev1.LocalObjectReference{Name: "worker-0"} }
+	tests := []struct {
+		name    string
+		old     func(mn *MetalNode)
+		mn      func(mn *MetalNode)
+		wantErr bool
+	}{
+		{
+			name: "not bootstrapped",
+			mn:   func(mn *MetalNode) { mn.Spec.NodeEndPoint.Host = "10.0.0.2" },
+		},
+		{
+			name:    "host of a bootstrapped metal node",
+			old:     bootstrapped,
+			mn:      func(mn *MetalNode) { mn.Spec.NodeEndPoint.Host = "10.0.0.2" },
+			wantErr: true,
+		},
+		{
+			name:    "port of an allocated metal node",
+			old:     allocated,
+			mn:      func(mn *MetalNode) { mn.Spec.NodeEndPoint.SSHAuth.Port = 2222 },
+			wantErr: true,
+		},
+		{
+			name:    "user of a bootstrapped metal node",
+			old:     bootstrapped,
+			mn:      func(mn *MetalNode) { mn.Spec.NodeEndPoint.SSHAuth.User = "admin" },
+			wantErr: true,
+		},
+		{
+			name:    "node ip of a bootstrapped metal node",
+			old:     bootstrapped,
+			mn:      func(mn *MetalNode) { mn.Spec.Addresses[0].Address = "192.168.0.2" },
+			wantErr: true,
+		},
+		{
+			name: "credentials of a bootstrapped metal node",
+			old:  bootstrapped,
+			mn:   func(mn *MetalNode) { mn.Spec.NodeEndPoint.SSHAuth.Password = "rotated" },
+		},
+		{
+			name: "other addresses of a bootstrapped metal node",
+			old:  bootstrapped,
+			mn: func(mn *MetalNode) {
+				mn.Spec.Addresses = append(mn.Spec.Addresses, MachineAddress{Type: MachineSSHAddress, Address: "10.1.0.1"})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEndpointUpdate(testMetalNode(tt.old), testMetalNode(tt.mn))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateEndpointUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		host      string
+		addresses []MachineAddress
+		want      []string
+	}{
+		{name: "host", host: "10.0.0.1", want: []string{"10.0.0.1"}},
+		{name: "DNS name", host: "Node-0.Example.com", want: []string{"node-0.example.com"}},
+		{
+			name: "addresses",
+			host: "10.0.0.1",
+			addresses: []MachineAddress{
+				{Type: MachineInternalIP, Address: "192.168.0.1"},
+				{Type: MachineSSHAddress, Address: "10.1.0.1"},
+				{Type: MachineExternalIP, Address: "1.2.3.4"},
+				{Type: MachineHostName, Address: "node-0"},
+				{Type: MachineSSHAddress, Address: "10.0.0.1"},
+			},
+			want: []string{"10.0.0.1", "192.168.0.1", "10.1.0.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mn := &MetalNode{}
+			mn.Spec.NodeEndPoint.Host = tt.host
+			mn.Spec.Addresses = tt.addresses
+			if got := mn.HostKeys(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HostKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthValidate(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	tests := []struct {
+		name    string
+		auth    Auth
+		wantErr string
+	}{
+		{name: "password", auth: Auth{User: "root", Password: "secret"}},
+		{name: "ssh key", auth: Auth{User: "root", SSHKey: sshKey}},
+		{name: "no user", auth: Auth{Password: "secret"}, wantErr: "user is required"},
+		{name: "no credentials", auth: Auth{User: "root"}, wantErr: "password and ssh key"},
+		{name: "invalid ssh key", auth: Auth{User: "root", SSHKey: "ssh-ed25519 AAAA root@host"}, wantErr: "ssh key"},
+		{name: "port out of range", auth: Auth{User: "root", Password: "secret", Port: 65536}, wantErr: "out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.auth.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetalNodeStatusValidator(t *testing.T) {
+	const controller = "system:serviceaccount:metalnode-system:metalnode-controller-manager"
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		controllerUsername string
+		username           string
+		mutate             func(status *MetalNodeStatus)
+		want               bool
+	}{
+		{
+			name:               "controller",
+			controllerUsername: controller,
+			username:           controller,
+			mutate:             func(status *MetalNodeStatus) { status.Bootstrapped = true },
+			want:               true,
+		},
+		{
+			name:               "user",
+			controllerUsername: controller,
+			username:           "kubernetes-admin",
+			mutate:             func(status *MetalNodeStatus) { status.Bootstrapped = true },
+		},
+		{
+			name:               "user deprecated allocation",
+			controllerUsername: controller,
+			username:           "kubernetes-admin",
+			mutate: func(status *MetalNodeStatus) {
+				status.Role = []string{"worker"}
+				status.RefCluster = "cluster"
+				status.DataSecretName = "cluster-worker-0"
+			},
+			want: true,
+		},
+		{
+			name:               "user deprecated allocation and state",
+			controllerUsername: controller,
+			username:           "kubernetes-admin",
+			mutate: func(status *MetalNodeStatus) {
+				status.RefCluster = "cluster"
+				status.InitializationState = "SUCCESS"
+			},
+		},
+		{
+			name:     "unknown controller",
+			username: "kubernetes-admin",
+			mutate:   func(status *MetalNodeStatus) { status.Bootstrapped = true },
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := testMetalNode(nil)
+			old.SetGroupVersionKind(GroupVersion.WithKind("MetalNode"))
+			mn := old.DeepCopy()
+			tt.mutate(&mn.Status)
+			oldRaw, err := json.Marshal(old)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := json.Marshal(mn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v := &metalNodeStatusValidator{controllerUsername: tt.controllerUsername}
+			if err := v.InjectDecoder(decoder); err != nil {
+				t.Fatal(err)
+			}
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation:   admissionv1.Update,
+				SubResource: "status",
+				UserInfo:    authenticationv1.UserInfo{Username: tt.username},
+				Object:      runtime.RawExtension{Raw: raw},
+				OldObject:   runtime.RawExtension{Raw: oldRaw},
+			}}
+			if got := v.Handle(context.Background(), req).Allowed; got != tt.want {
+				t.Errorf("Handle() allowed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// MetalNodeClaimFinalizer allows the controller to release the metal node bound to the claim before it is deleted
+	MetalNodeClaimFinalizer = "bocloud.io/metalnodeclaim"
+)
+
+// ClaimPhase is the phase of a MetalNodeClaim
+// +kubebuilder:validation:Enum=Pending;Bound;Lost
+type ClaimPhase string
+
+const (
+	// ClaimPending denotes the claim waits for an available metal node matching it
+	ClaimPending ClaimPhase = "Pending"
+
+	// ClaimBound denotes the claim is bound to a metal node
+	ClaimBound ClaimPhase = "Bound"
+
+	// ClaimLost denotes the metal node bound to the claim was deleted
+	ClaimLost ClaimPhase = "Lost"
+)
+
+// MetalNodeClaimSpec defines the metal node requested by a MetalNodeClaim
+type MetalNodeClaimSpec struct {
+	// Selector matches the labels of the metal nodes which can be bound, including the inventory labels,
+	// all the metal nodes of the namespace match if it is not set
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Resources are the minimum capacity of the host
+	// +optional
+	Resources ClaimResources `json:"resources,omitempty"`
+
+	// Role is the role of the node in its cluster, such as master or worker
+	// +optional
+	Role string `json:"role,omitempty"`
+
+	// Cluster is the name of the cluster the node joins
+	// +optional
+	Cluster string `json:"cluster,omitempty"`
+
+	// DataSecretName is the name of the secret of the bootstrap data of the node, set once the data is generated,
+	// the node is bootstrapped with it
+	// +optional
+	DataSecretName string `json:"dataSecretName,omitempty"`
+}
+
+// ClaimResources are the minimum capacity of a host, as found in its inventory
+type ClaimResources struct {
+	// CPU is the minimum number of processing units
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	CPU int `json:"cpu,omitempty"`
+
+	// Memory is the minimum total memory
+	// +optional
+	Memory *resource.Quantity `json:"memory,omitempty"`
+}
+
+// MetalNodeClaimStatus defines the observed state of MetalNodeClaim
+type MetalNodeClaimStatus struct {
+	// Phase is the phase of the claim
+	// +optional
+	Phase ClaimPhase `json:"phase,omitempty"`
+
+	// NodeName is the name of the metal node bound to the claim
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+
+	// Conditions defines current state of the MetalNodeClaim
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=mnc
+// +kubebuilder:printcolumn:name="PHASE",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="NODE",type="string",JSONPath=".status.nodeName"
+// +kubebuilder:printcolumn:name="CLUSTER",type="string",JSONPath=".spec.cluster"
+// +kubebuilder:printcolumn:name="ROLE",type="string",JSONPath=".spec.role"
+// +kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MetalNodeClaim is the Schema for the metalnodeclaims API, it binds a metal node of its namespace exclusively
+// like a PersistentVolumeClaim binds a PersistentVolume, the metal node is released when the claim is deleted
+type MetalNodeClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MetalNodeClaimSpec   `json:"spec,omitempty"`
+	Status MetalNodeClaimStatus `json:"status,omitempty"`
+}
+
+// IsPaused check if the claim is paused by PausedAnnotation or ClusterPausedAnnotation
+func (c *MetalNodeClaim) IsPaused() bool {
+	return hasPausedAnnotation(c.ObjectMeta)
+}
+
+// hasPausedAnnotation check if the object has one of the pause annotations
+func hasPausedAnnotation(meta metav1.ObjectMeta) bool {
+	return metav1.HasAnnotation(meta, PausedAnnotation) || metav1.HasAnnotation(meta, ClusterPausedAnnotation)
+}
+
+//+kubebuilder:object:root=true
+
+// MetalNodeClaimList contains a list of MetalNodeClaim
+type MetalNodeClaimList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetalNodeClaim `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetalNodeClaim{}, &MetalNodeClaimList{})
+}
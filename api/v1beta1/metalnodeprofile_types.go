@@ -0,0 +1,144 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Built-in modules of the initialization, the default steps run them in this order
+const (
+	// ModulePrepareHost configures the package repositories, or installs the packages of the offline bundle
+	ModulePrepareHost = "prepare-host"
+
+	// ModuleInstallRuntime installs and configures the container runtime
+	ModuleInstallRuntime = "install-runtime"
+
+	// ModuleConfigureKernel loads the kernel modules and sets the sysctls of kubernetes, and disables swap
+	ModuleConfigureKernel = "configure-kernel"
+
+	// ModuleConfigureSystem sets the timezone and disables the firewall and SELinux
+	ModuleConfigureSystem = "configure-system"
+
+	// ModuleInstallKubeadm installs kubelet, kubeadm and kubectl, and points them to the container runtime
+	ModuleInstallKubeadm = "install-kubeadm"
+
+	// ModuleSetHostname sets the hostname of the host to spec.nodeName of the metal node, which defaults to its name
+	ModuleSetHostname = "set-hostname"
+)
+
+// MetalNodeProfileSpec defines the steps of the initialization of the metal nodes referencing the profile
+type MetalNodeProfileSpec struct {
+	// Extends is the name of the profile of the same namespace this profile is based on,
+	// its steps are used when Steps is empty and its hooks run around the hooks of this profile
+	// +optional
+	Extends string `json:"extends,omitempty"`
+
+	// PreSteps are the hooks run before Steps, after the ones of the extended profile
+	// +optional
+	PreSteps []ProfileStep `json:"preSteps,omitempty"`
+
+	// Steps replaces the steps of the extended profile, or the default steps which run all the built-in modules
+	// +optional
+	Steps []ProfileStep `json:"steps,omitempty"`
+
+	// PostSteps are the hooks run after Steps, after the ones of the extended profile
+	// +optional
+	PostSteps []ProfileStep `json:"postSteps,omitempty"`
+}
+
+// ProfileStep is a step of the initialization, one of Module, Script or Commands runs after Files are uploaded
+type ProfileStep struct {
+	// Name identifies the step in the profile
+	Name string `json:"name"`
+
+	// Module is a built-in module of the initialization
+	// +kubebuilder:validation:Enum=prepare-host;install-runtime;configure-kernel;configure-system;install-kubeadm;set-hostname
+	// +optional
+	Module string `json:"module,omitempty"`
+
+	// Script is a key of a ConfigMap of the namespace of the metal node, run with bash as root,
+	// the provisioning settings are passed as environment variables like KUBERNETES_VERSION
+	// +optional
+	Script *corev1.ConfigMapKeySelector `json:"script,omitempty"`
+
+	// Commands are run one by one as the ssh user
+	// +optional
+	Commands []string `json:"commands,omitempty"`
+
+	// Files are uploaded to the host before the step runs
+	// +optional
+	Files []ProfileFile `json:"files,omitempty"`
+
+	// When restricts the step to some metal nodes, the step always runs if it is not set
+	// +optional
+	When *StepCondition `json:"when,omitempty"`
+}
+
+// ProfileFile is a file uploaded to the host from a key of a Secret of the namespace of the metal node
+type ProfileFile struct {
+	// Secret is the key of the Secret holding the content of the file
+	Secret corev1.SecretKeySelector `json:"secret"`
+
+	// Path is the absolute path of the file on the host, its directory is created if needed
+	// +kubebuilder:validation:Pattern=`^/`
+	Path string `json:"path"`
+
+	// Mode is the permission of the file, an octal like 0644 in YAML or its decimal value in JSON, 0600 if it is not set
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=511
+	// +optional
+	Mode *int32 `json:"mode,omitempty"`
+}
+
+// StepCondition restricts a step to the metal nodes matching all the conditions set
+type StepCondition struct {
+	// Provisioners are the distribution families the step runs on: el7, el, debian or openeuler
+	// +optional
+	Provisioners []string `json:"provisioners,omitempty"`
+
+	// Selector matches the labels of the metal node, including the inventory labels such as inventory.bocloud.io/arch
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=mnp
+// +kubebuilder:printcolumn:name="EXTENDS",type="string",JSONPath=".spec.extends"
+// +kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MetalNodeProfile is the Schema for the metalnodeprofiles API
+type MetalNodeProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MetalNodeProfileSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MetalNodeProfileList contains a list of MetalNodeProfile
+type MetalNodeProfileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetalNodeProfile `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetalNodeProfile{}, &MetalNodeProfileList{})
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+// Names of the preflight checks run on the host before the initialization
+const (
+	PreflightCPU         = "CPU"
+	PreflightMemory      = "Memory"
+	PreflightSwap        = "Swap"
+	PreflightPorts       = "Ports"
+	PreflightHostname    = "UniqueHostname"
+	PreflightMAC         = "UniqueMAC"
+	PreflightProductUUID = "UniqueProductUUID"
+	PreflightTimeSync    = "TimeSync"
+	PreflightBrNetfilter = "BrNetfilter"
+	PreflightDisk        = "Disk"
+	PreflightNodeIP      = "NodeIP"
+)
+
+// PreflightResult is the result of a preflight check
+// +kubebuilder:validation:Enum=Passed;Warning;Failed
+type PreflightResult string
+
+const (
+	// PreflightPassed denotes the host meets the check
+	PreflightPassed PreflightResult = "Passed"
+
+	// PreflightWarning denotes the host does not meet the check, or it could not be run,
+	// but the initialization can proceed
+	PreflightWarning PreflightResult = "Warning"
+
+	// PreflightFailed denotes the host does not meet the check and can't be initialized
+	PreflightFailed PreflightResult = "Failed"
+)
+
+// PreflightCheck denotes the result of a preflight check
+type PreflightCheck struct {
+	// Name is the name of the check, such as Memory or Ports
+	Name string `json:"name"`
+
+	// Result is the result of the check
+	Result PreflightResult `json:"result"`
+
+	// Message explains the result, and how to fix the host when the check did not pass
+	// +optional
+	Message string `json:"message,omitempty"`
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// the Cluster API objects are read as unstructured objects, the project does not depend on Cluster API
+var (
+	// ClusterGVK is the Cluster of Cluster API
+	ClusterGVK = schema.GroupVersionKind{Group: machineGroup, Version: "v1beta1", Kind: "Cluster"}
+
+	// MachineGVK is the Machine of Cluster API
+	MachineGVK = schema.GroupVersionKind{Group: machineGroup, Version: "v1beta1", Kind: "Machine"}
+)
+
+const (
+	// clusterNameLabel is the label of the objects of a Cluster API cluster, with the name of the cluster
+	clusterNameLabel = "cluster.x-k8s.io/cluster-name"
+
+	// controlPlaneLabel is the label of the machines of the control plane
+	controlPlaneLabel = "cluster.x-k8s.io/control-plane"
+
+	// controlPlaneRole and workerRole are the roles of the metal nodes claimed by the machines
+	controlPlaneRole = "master"
+	workerRole       = "worker"
+)
+
+// capiOwner returns the owner reference of the kind of Cluster API of the object, nil if it has none
+func capiOwner(obj metav1.Object, kind string) *metav1.OwnerReference {
+	for _, ref := range obj.GetOwnerReferences() {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err == nil && gv.Group == machineGroup && ref.Kind == kind {
+			ref := ref
+			return &ref
+		}
+	}
+	return nil
+}
+
+// getCAPIObject gets the Cluster API object of the kind
+func getCAPIObject(ctx context.Context, c client.Client, gvk schema.GroupVersionKind, namespace, name string) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj); err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s %s", gvk.Kind, name)
+	}
+	return obj, nil
+}
+
+// clusterPaused check if the Cluster is paused by spec.paused
+func clusterPaused(cluster *unstructured.Unstructured) bool {
+	paused, _, _ := unstructured.NestedBool(cluster.Object, "spec", "paused")
+	return paused
+}
+
+// infrastructureRefName returns the name of the infrastructure object of the Cluster or the Machine if it is of the kind
+func infrastructureRefName(obj *unstructured.Unstructured, kind string) string {
+	refKind, _, _ := unstructured.NestedString(obj.Object, "spec", "infrastructureRef", "kind")
+	if refKind != kind {
+		return ""
+	}
+	name, _, _ := unstructured.NestedString(obj.Object, "spec", "infrastructureRef", "name")
+	return name
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// MetalClusterReconciler reconciles the MetalClusters, the infrastructure clusters of Cluster API. A metal cluster
+// provides the control plane endpoint, served by haproxy on a metal node it claims if its load balancer is haproxy
+type MetalClusterReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Operations runs the configuration of haproxy in background, shared with the metal nodes
+	Operations *operation.Tracker
+
+	// Recorder emits the events of the metal clusters
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalclusters,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalclusters/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalclusters/finalizers,verbs=update
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalmachines,verbs=get;list;watch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalnodeclaims,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+
+// Reconcile sets the control plane endpoint of the metal cluster up and reports it to its Cluster
+func (r *MetalClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	metalCluster := &v1beta1.MetalCluster{}
+	if err := r.Get(ctx, req.NamespacedName, metalCluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.WithError(err).Error("unable to fetch MetalCluster")
+		return ctrl.Result{}, err
+	}
+	l := log.With("metalcluster", req.NamespacedName.String())
+	// the Cluster may be gone before the metal cluster, which is not paused then
+	deleting := !metalCluster.DeletionTimestamp.IsZero()
+	if metalCluster.IsPaused() {
+		l.Infoln("metal cluster is paused, skip reconciling")
+		return ctrl.Result{}, nil
+	}
+
+	// the Cluster sets itself as the owner once it references the metal cluster
+	clusterRef := capiOwner(metalCluster, ClusterGVK.Kind)
+	if clusterRef == nil {
+		if deleting {
+			return r.reconcileDelete(ctx, metalCluster, l)
+		}
+		l.Infoln("waiting for the Cluster owning the metal cluster")
+		return ctrl.Result{}, nil
+	}
+	cluster, err := getCAPIObject(ctx, r.Client, ClusterGVK, metalCluster.Namespace, clusterRef.Name)
+	if err != nil {
+		if deleting && apierrors.IsNotFound(err) {
+			return r.reconcileDelete(ctx, metalCluster, l)
+		}
+		l.WithError(err).Errorln("failed to get the cluster of the metal cluster")
+		return ctrl.Result{}, err
+	}
+	l = l.With("cluster", cluster.GetName())
+
+	if clusterPaused(cluster) {
+		l.Infoln("cluster of the metal cluster is paused, skip reconciling")
+		return ctrl.Result{}, nil
+	}
+
+	if deleting {
+		return r.reconcileDelete(ctx, metalCluster, l)
+	}
+
+	if !controllerutil.ContainsFinalizer(metalCluster, v1beta1.MetalClusterFinalizer) {
+		controllerutil.AddFinalizer(metalCluster, v1beta1.MetalClusterFinalizer)
+		status := metalCluster.Status.DeepCopy()
+		if err := r.Update(ctx, metalCluster); err != nil {
+			l.WithError(err).Errorln("failed to add metal cluster finalizer")
+			return ctrl.Result{}, err
+		}
+		metalCluster.Status = *status
+	}
+
+	metalCluster.Status.FailureDomains = metalCluster.Spec.FailureDomains
+	var result ctrl.Result
+	switch metalCluster.Spec.LoadBalancer.Type {
+	case v1beta1.LoadBalancerHAProxy:
+		if result, err = r.reconcileHAProxy(ctx, metalCluster, cluster.GetName(), l); err != nil {
+			return ctrl.Result{}, err
+		}
+	default:
+		// the endpoint is announced by kube-vip from the control plane nodes, or served outside of the cluster
+		if metalCluster.Spec.ControlPlaneEndpoint.IsZero() {
+			setLoadBalancerCondition(metalCluster, false, v1beta1.EndpointMissingReason,
+				"the control plane endpoint must be set unless the load balancer is haproxy")
+		} else {
+			setLoadBalancerCondition(metalCluster, true, v1beta1.LoadBalancerReadyReason, "the control plane endpoint is set")
+		}
+	}
+	metalCluster.Status.Ready = !metalCluster.Spec.ControlPlaneEndpoint.IsZero() &&
+		meta.IsStatusConditionTrue(metalCluster.Status.Conditions, v1beta1.LoadBalancerReadyCondition)
+
+	if err := r.Status().Update(ctx, metalCluster); err != nil {
+		l.WithError(err).Errorln("failed to update metal cluster status")
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// reconcileHAProxy claims the load balancer node of the metal cluster, defaults the endpoint to its InternalIP
+// and configures haproxy in background with the api servers of the control plane machines. haproxy is configured
+// again whenever its config changes, as the control plane machines come and go
+func (r *MetalClusterReconciler) reconcileHAProxy(ctx context.Context, metalCluster *v1beta1.MetalCluster,
+	clusterName string, l log.Logger) (ctrl.Result, error) {
+	claim := &v1beta1.MetalNodeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: metalCluster.Namespace, Name: metalCluster.Name + "-lb"}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, claim, func() error {
+		if claim.Labels == nil {
+			claim.Labels = map[string]string{}
+		}
+		claim.Labels[clusterNameLabel] = clusterName
+		if claim.Status.Phase != v1beta1.ClaimBound {
+			claim.Spec.Selector = metalCluster.Spec.LoadBalancer.Selector
+		}
+		claim.Spec.Role = loadBalancerRole
+		claim.Spec.Cluster = clusterName
+		return controllerutil.SetControllerReference(metalCluster, claim, r.Scheme)
+	}); err != nil {
+		l.WithError(err).Errorln("failed to create or update the load balancer claim of metal cluster")
+		return ctrl.Result{}, err
+	}
+	if claim.Status.Phase != v1beta1.ClaimBound {
+		message := "no available metal node matches the load balancer"
+		if claim.Status.Phase == v1beta1.ClaimLost {
+			message = "load balancer node " + claim.Status.NodeName + " was lost"
+		}
+		setLoadBalancerCondition(metalCluster, false, v1beta1.WaitingForLoadBalancerNodeReason, message)
+		return ctrl.Result{}, nil
+	}
+
+	node := &v1beta1.MetalNode{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: metalCluster.Namespace, Name: claim.Status.NodeName}, node); err != nil {
+		l.WithError(err).Errorln("failed to get the load balancer node of metal cluster")
+		return ctrl.Result{}, err
+	}
+	if metalCluster.Status.LoadBalancerNode != node.Name {
+		metalCluster.Status.LoadBalancerNode = node.Name
+		metalCluster.Status.LoadBalancerConfigHash = ""
+	}
+
+	endpoint := metalCluster.Spec.ControlPlaneEndpoint
+	if endpoint.IsZero() {
+		if endpoint.Host == "" {
+			endpoint.Host = node.InternalIP()
+		}
+		if endpoint.Host == "" {
+			endpoint.Host = node.Spec.NodeEndPoint.Host
+		}
+		if endpoint.Port == 0 {
+			endpoint.Port = apiServerPort
+		}
+		metalCluster.Spec.ControlPlaneEndpoint = endpoint
+		status := metalCluster.Status.DeepCopy()
+		if err := r.Update(ctx, metalCluster); err != nil {
+			l.WithError(err).Errorln("failed to set the control plane endpoint of metal cluster")
+			return ctrl.Result{}, err
+		}
+		metalCluster.Status = *status
+		l.With("host", endpoint.Host).Infoln("control plane endpoint of the metal cluster set to its load balancer node")
+	}
+
+	backends, err := r.controlPlaneBackends(ctx, metalCluster.Namespace, clusterName)
+	if err != nil {
+		l.WithError(err).Errorln("failed to list the control plane machines of metal cluster")
+		return ctrl.Result{}, err
+	}
+	config := haproxyConfig(endpoint.Port, backends)
+	hash := haproxyConfigHash(config)
+
+	op, tracked := r.trackedOperation(metalCluster)
+	if !tracked || op.Name != opLoadBalancer {
+		if metalCluster.Status.LoadBalancerConfigHash == hash {
+			return ctrl.Result{}, nil
+		}
+		host := metalNodeToHost(node)[0]
+		if err := r.startOperation(metalCluster, opLoadBalancer, func() (operation.Result, error) {
+			stderr, err := remote.RunOnHost(host, remote.Command{Cmds: haproxyCmds(config)})
+			return operation.Result{Stderr: stderr, Output: hash}, err
+		}); err != nil {
+			l.WithError(err).Warnln("failed to start the configuration of the load balancer")
+		}
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+	if op.Phase != operation.Done {
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+
+	metalCluster.Status.Operation = nil
+	if op.Err != nil {
+		message := "failed to configure haproxy on " + node.Name + ": " + op.Err.Error()
+		l.WithError(op.Err).Errorln("failed to configure the load balancer of metal cluster")
+		r.Recorder.Event(metalCluster, corev1.EventTypeWarning, v1beta1.LoadBalancerConfigFailedReason, message)
+		setLoadBalancerCondition(metalCluster, false, v1beta1.LoadBalancerConfigFailedReason, message)
+		return ctrl.Result{RequeueAfter: metalMachineWaitInterval}, nil
+	}
+	applied, _ := op.Output.(string)
+	metalCluster.Status.LoadBalancerConfigHash = applied
+	l.With("backends", len(backends)).Infoln("load balancer of the metal cluster configured")
+	r.Recorder.Event(metalCluster, corev1.EventTypeNormal, v1beta1.LoadBalancerReadyReason, "haproxy configured on "+node.Name)
+	setLoadBalancerCondition(metalCluster, true, v1beta1.LoadBalancerReadyReason, "haproxy runs on "+node.Name)
+	// the config may have changed while it was applied
+	if applied != hash {
+		return ctrl.Result{Requeue: true}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// controlPlaneBackends returns the InternalIP of the control plane machines of the cluster, by name
+func (r *MetalClusterReconciler) controlPlaneBackends(ctx context.Context, namespace, clusterName string) (map[string]string, error) {
+	machines := &v1beta1.MetalMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(namespace),
+		client.MatchingLabels{clusterNameLabel: clusterName}, client.HasLabels{controlPlaneLabel}); err != nil {
+		return nil, errors.Wrap(err, "failed to list metal machines")
+	}
+	backends := map[string]string{}
+	for _, machine := range machines.Items {
+		if !machine.DeletionTimestamp.IsZero() {
+			continue
+		}
+		for _, address := range machine.Status.Addresses {
+			if address.Type == v1beta1.MachineInternalIP {
+				backends[machine.Name] = address.Address
+				break
+			}
+		}
+	}
+	return backends, nil
+}
+
+// reconcileDelete deletes the load balancer claim of the metal cluster, then removes the finalizer of the metal cluster
+func (r *MetalClusterReconciler) reconcileDelete(ctx context.Context, metalCluster *v1beta1.MetalCluster, l log.Logger) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(metalCluster, v1beta1.MetalClusterFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	claim := &v1beta1.MetalNodeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: metalCluster.Namespace, Name: metalCluster.Name + "-lb"}, claim)
+	if err != nil && !apierrors.IsNotFound(err) {
+		l.WithError(err).Errorln("failed to get the load balancer claim of metal cluster")
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		if claim.DeletionTimestamp.IsZero() {
+			if err := r.Delete(ctx, claim); err != nil && !apierrors.IsNotFound(err) {
+				l.WithError(err).Errorln("failed to delete the load balancer claim of metal cluster")
+				return ctrl.Result{}, err
+			}
+			l.Infoln("load balancer claim of the metal cluster deleted")
+		}
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+
+	r.Operations.Forget(metalClusterOperationKey(metalCluster))
+	controllerutil.RemoveFinalizer(metalCluster, v1beta1.MetalClusterFinalizer)
+	if err := r.Update(ctx, metalCluster); err != nil {
+		l.WithError(err).Errorln("failed to remove metal cluster finalizer")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// startOperation runs fn in background as the operation name of the metal cluster and records it in status,
+// like the operations of the metal nodes
+func (r *MetalClusterReconciler) startOperation(metalCluster *v1beta1.MetalCluster, name string, fn operation.Func) error {
+	op, started := r.Operations.Start(metalClusterOperationKey(metalCluster), name, fn)
+	if !started && op.Name != name {
+		return errors.Errorf("operation %s is still running", op.Name)
+	}
+	metalCluster.Status.Operation = &v1beta1.OperationStatus{
+		ID:        op.ID,
+		Name:      op.Name,
+		StartTime: metav1.NewTime(op.StartTime),
+	}
+	return nil
+}
+
+// trackedOperation returns the operation recorded in the metal cluster status, tracked is false if this controller
+// does not know it
+func (r *MetalClusterReconciler) trackedOperation(metalCluster *v1beta1.MetalCluster) (op operation.Operation, tracked bool) {
+	if metalCluster.Status.Operation == nil {
+		return op, false
+	}
+	op, ok := r.Operations.Get(metalClusterOperationKey(metalCluster))
+	if !ok || op.ID != metalCluster.Status.Operation.ID {
+		return op, false
+	}
+	return op, true
+}
+
+// metalClusterOperationKey is prefixed by the kind, the tracker is shared with the metal nodes
+func metalClusterOperationKey(metalCluster *v1beta1.MetalCluster) string {
+	return "MetalCluster/" + types.NamespacedName{Namespace: metalCluster.Namespace, Name: metalCluster.Name}.String()
+}
+
+// SetupWithManager sets up the controller with the Manager, the metal clusters are reconciled again when their
+// load balancer claim or the metal machines of their cluster change
+func (r *MetalClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("metalcluster-controller")
+	}
+	if r.Operations == nil {
+		r.Operations = operation.NewTracker(0)
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.MetalCluster{}).
+		Owns(&v1beta1.MetalNodeClaim{}).
+		Watches(&source.Kind{Type: &v1beta1.MetalMachine{}}, handler.EnqueueRequestsFromMapFunc(r.metalMachineToMetalCluster)).
+		Complete(r)
+}
+
+// metalMachineToMetalCluster returns the metal clusters of the cluster of the control plane machine
+func (r *MetalClusterReconciler) metalMachineToMetalCluster(obj client.Object) []reconcile.Request {
+	clusterName, ok := obj.GetLabels()[clusterNameLabel]
+	if _, controlPlane := obj.GetLabels()[controlPlaneLabel]; !ok || !controlPlane {
+		return nil
+	}
+	cluster, err := getCAPIObject(context.Background(), r.Client, ClusterGVK, obj.GetNamespace(), clusterName)
+	if err != nil {
+		return nil
+	}
+	name := infrastructureRefName(cluster, "MetalCluster")
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+}
+
+func setLoadBalancerCondition(metalCluster *v1beta1.MetalCluster, ready bool, reason, message string) {
+	status := metav1.ConditionFalse
+	if ready {
+		status = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&metalCluster.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.LoadBalancerReadyCondition,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
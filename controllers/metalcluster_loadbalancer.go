@@ -0,0 +1,132 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	opLoadBalancer = "load-balancer"
+
+	// loadBalancerRole is the role of the metal node claimed to run haproxy
+	loadBalancerRole = "load-balancer"
+
+	// apiServerPort is the port of the api server of the control plane nodes, and of the endpoint by default
+	apiServerPort = 6443
+
+	// haproxyConfigPath is where the config of haproxy is written on the load balancer node
+	haproxyConfigPath = "/etc/haproxy/haproxy.cfg"
+)
+
+// kubeVIPManifest returns the static pod of kube-vip announcing the control plane endpoint host of the metal cluster
+// by ARP, the leader is elected among the control plane nodes with the admin kubeconfig of kubeadm.
+// The manifest is written by echo, it must not contain single quotes
+func kubeVIPManifest(metalCluster *v1beta1.MetalCluster) []byte {
+	lb := metalCluster.Spec.LoadBalancer
+	image := lb.Image
+	if image == "" {
+		image = v1beta1.DefaultKubeVIPImage
+	}
+	port := metalCluster.Spec.ControlPlaneEndpoint.Port
+	if port == 0 {
+		port = apiServerPort
+	}
+	env := []corev1.EnvVar{
+		{Name: "address", Value: metalCluster.Spec.ControlPlaneEndpoint.Host},
+		{Name: "port", Value: strconv.Itoa(int(port))},
+		{Name: "vip_arp", Value: "true"},
+		{Name: "cp_enable", Value: "true"},
+		{Name: "vip_leaderelection", Value: "true"},
+	}
+	if lb.Interface != "" {
+		env = append(env, corev1.EnvVar{Name: "vip_interface", Value: lb.Interface})
+	}
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-vip", Namespace: metav1.NamespaceSystem},
+		Spec: corev1.PodSpec{
+			HostNetwork: true,
+			// the api server is reached by the name of its certificate before the endpoint is announced
+			HostAliases: []corev1.HostAlias{{IP: "127.0.0.1", Hostnames: []string{"kubernetes"}}},
+			Containers: []corev1.Container{{
+				Name:  "kube-vip",
+				Image: image,
+				Args:  []string{"manager"},
+				Env:   env,
+				SecurityContext: &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN", "NET_RAW"}},
+				},
+				VolumeMounts: []corev1.VolumeMount{{Name: "kubeconfig", MountPath: "/etc/kubernetes/admin.conf"}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name:         "kubeconfig",
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/etc/kubernetes/admin.conf"}},
+			}},
+		},
+	}
+	data, _ := yaml.Marshal(pod)
+	return data
+}
+
+// haproxyConfig returns the config of haproxy balancing the port of the endpoint over the api servers of the
+// control plane nodes, by name. It is written by echo, it must not contain single quotes
+func haproxyConfig(port int32, backends map[string]string) string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("global\n  log /dev/log local0\n  maxconn 4096\n\n")
+	b.WriteString("defaults\n  mode tcp\n  log global\n  option tcplog\n  timeout connect 5s\n  timeout client 1h\n  timeout server 1h\n\n")
+	fmt.Fprintf(&b, "frontend kube-apiserver\n  bind *:%d\n  default_backend control-plane\n\n", port)
+	b.WriteString("backend control-plane\n  balance roundrobin\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "  server %s %s:%d check\n", name, backends[name], apiServerPort)
+	}
+	return b.String()
+}
+
+// haproxyConfigHash returns the sha256 of the config of haproxy
+func haproxyConfigHash(config string) string {
+	sum := sha256.Sum256([]byte(config))
+	return hex.EncodeToString(sum[:])
+}
+
+// haproxyCmds installs haproxy on the load balancer node if it is missing, writes its config and restarts it
+func haproxyCmds(config string) remote.Commands {
+	return remote.Commands{
+		"command -v haproxy >/dev/null 2>&1 || if command -v apt-get >/dev/null 2>&1; " +
+			"then sudo apt-get update && sudo apt-get install -y haproxy; else sudo yum install -y haproxy; fi",
+		"sudo mkdir -p /etc/haproxy",
+		"echo '" + config + "' | sudo tee " + haproxyConfigPath + " >/dev/null",
+		"sudo systemctl enable haproxy && sudo systemctl restart haproxy",
+	}
+}
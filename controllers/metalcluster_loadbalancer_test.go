@@ -0,0 +1,68 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHAProxyConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     int32
+		backends map[string]string
+		want     []string
+	}{
+		{
+			name: "no backend",
+			port: 6443,
+			want: []string{"  bind *:6443\n", "backend control-plane\n  balance roundrobin\n"},
+		},
+		{
+			name:     "backends sorted by name",
+			port:     8443,
+			backends: map[string]string{"master-1": "10.0.0.2", "master-0": "10.0.0.1", "master-2": "10.0.0.3"},
+			want: []string{
+				"  bind *:8443\n",
+				"  server master-0 10.0.0.1:6443 check\n" +
+					"  server master-1 10.0.0.2:6443 check\n" +
+					"  server master-2 10.0.0.3:6443 check\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := haproxyConfig(tt.port, tt.backends)
+			for _, want := range tt.want {
+				if !strings.Contains(config, want) {
+					t.Errorf("haproxyConfig() = %q, want it to contain %q", config, want)
+				}
+			}
+			// the config is written by echo in single quotes
+			if strings.Contains(config, "'") {
+				t.Errorf("haproxyConfig() = %q contains a single quote", config)
+			}
+			if got := strings.Count(config, "  server "); got != len(tt.backends) {
+				t.Errorf("haproxyConfig() has %d servers, want %d", got, len(tt.backends))
+			}
+			if haproxyConfigHash(config) != haproxyConfigHash(haproxyConfig(tt.port, tt.backends)) {
+				t.Errorf("haproxyConfig() is not stable")
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/kubeadm/cloudinit"
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// metalMachineWaitInterval is how often a metal machine waiting for its cluster infrastructure is looked at again
+	metalMachineWaitInterval = 30 * time.Second
+
+	// kubeVIPManifestPath is where kube-vip is written as a static pod on the control plane nodes
+	kubeVIPManifestPath = "/etc/kubernetes/manifests/kube-vip.yaml"
+
+	// metalNodeLostError is the failure reason of a machine whose metal node was lost, a MachineStatusError of Cluster API
+	metalNodeLostError = "UpdateError"
+)
+
+// MetalMachineReconciler reconciles the MetalMachines, the infrastructure machines of Cluster API. A metal machine
+// claims a metal node with a MetalNodeClaim of the same name, bootstrapped with the data secret of its Machine
+type MetalMachineReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Recorder emits the events of the metal machines
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalmachines,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalmachines/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalmachines/finalizers,verbs=update
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalmachinetemplates,verbs=get;list;watch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalnodeclaims,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters;machines,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch
+
+// Reconcile claims a metal node for the metal machine and reports it to its Machine once it is bootstrapped
+func (r *MetalMachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	metalMachine := &v1beta1.MetalMachine{}
+	if err := r.Get(ctx, req.NamespacedName, metalMachine); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.WithError(err).Error("unable to fetch MetalMachine")
+		return ctrl.Result{}, err
+	}
+	l := log.With("metalmachine", req.NamespacedName.String())
+	// the Machine and the Cluster may be gone before the metal machine, which is not paused then
+	deleting := !metalMachine.DeletionTimestamp.IsZero()
+	if metalMachine.IsPaused() {
+		l.Infoln("metal machine is paused, skip reconciling")
+		return ctrl.Result{}, nil
+	}
+
+	// the Machine sets itself as the owner once it was created from the metal machine
+	machineRef := capiOwner(metalMachine, MachineGVK.Kind)
+	if machineRef == nil {
+		if deleting {
+			return r.reconcileDelete(ctx, metalMachine, l)
+		}
+		l.Infoln("waiting for the Machine owning the metal machine")
+		return ctrl.Result{}, nil
+	}
+	machine, err := getCAPIObject(ctx, r.Client, MachineGVK, metalMachine.Namespace, machineRef.Name)
+	if err != nil {
+		if deleting && apierrors.IsNotFound(err) {
+			return r.reconcileDelete(ctx, metalMachine, l)
+		}
+		l.WithError(err).Errorln("failed to get the machine of the metal machine")
+		return ctrl.Result{}, err
+	}
+	clusterName, _, _ := unstructured.NestedString(machine.Object, "spec", "clusterName")
+	cluster, err := getCAPIObject(ctx, r.Client, ClusterGVK, metalMachine.Namespace, clusterName)
+	if err != nil {
+		if deleting && apierrors.IsNotFound(err) {
+			return r.reconcileDelete(ctx, metalMachine, l)
+		}
+		l.WithError(err).Errorln("failed to get the cluster of the metal machine")
+		return ctrl.Result{}, err
+	}
+	l = l.With("cluster", clusterName)
+
+	if clusterPaused(cluster) {
+		l.Infoln("cluster of the metal machine is paused, skip reconciling")
+		return ctrl.Result{}, nil
+	}
+
+	if deleting {
+		return r.reconcileDelete(ctx, metalMachine, l)
+	}
+
+	if !controllerutil.ContainsFinalizer(metalMachine, v1beta1.MetalMachineFinalizer) {
+		controllerutil.AddFinalizer(metalMachine, v1beta1.MetalMachineFinalizer)
+		status := metalMachine.Status.DeepCopy()
+		if err := r.Update(ctx, metalMachine); err != nil {
+			l.WithError(err).Errorln("failed to add metal machine finalizer")
+			return ctrl.Result{}, err
+		}
+		metalMachine.Status = *status
+	}
+
+	result, err := r.reconcileNormal(ctx, metalMachine, machine, cluster, l)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Status().Update(ctx, metalMachine); err != nil {
+		l.WithError(err).Errorln("failed to update metal machine status")
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// reconcileNormal claims the metal node of the metal machine and reports its state
+func (r *MetalMachineReconciler) reconcileNormal(ctx context.Context, metalMachine *v1beta1.MetalMachine,
+	machine, cluster *unstructured.Unstructured, l log.Logger) (ctrl.Result, error) {
+	// a machine failed for good is not reconciled again, Cluster API remediates it
+	if metalMachine.Status.FailureReason != nil {
+		return ctrl.Result{}, nil
+	}
+	if ready, _, _ := unstructured.NestedBool(cluster.Object, "status", "infrastructureReady"); !ready {
+		setMetalNodeReadyCondition(metalMachine, v1beta1.WaitingForClusterInfrastructureReason, "the cluster infrastructure is not ready")
+		return ctrl.Result{RequeueAfter: metalMachineWaitInterval}, nil
+	}
+	if metalMachine.Spec.FailureDomain == nil {
+		if failureDomain, ok, _ := unstructured.NestedString(machine.Object, "spec", "failureDomain"); ok && failureDomain != "" {
+			metalMachine.Spec.FailureDomain = &failureDomain
+			// the status is not part of the update, it is updated when the reconcile ends
+			status := metalMachine.Status.DeepCopy()
+			if err := r.Update(ctx, metalMachine); err != nil {
+				l.WithError(err).Errorln("failed to set the failure domain of metal machine")
+				return ctrl.Result{}, err
+			}
+			metalMachine.Status = *status
+		}
+	}
+
+	dataSecretName, err := r.bootstrapDataSecret(ctx, metalMachine, machine, cluster, l)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	claim, err := r.reconcileClaim(ctx, metalMachine, cluster.GetName(), dataSecretName, l)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	switch claim.Status.Phase {
+	case v1beta1.ClaimBound:
+	case v1beta1.ClaimLost:
+		reason, message := metalNodeLostError, "metal node "+claim.Status.NodeName+" of the machine was lost"
+		metalMachine.Status.FailureReason, metalMachine.Status.FailureMessage = &reason, &message
+		metalMachine.Status.Ready = false
+		l.Errorln(message)
+		r.Recorder.Event(metalMachine, corev1.EventTypeWarning, ClaimLostReason, message)
+		return ctrl.Result{}, nil
+	default:
+		setMetalNodeReadyCondition(metalMachine, v1beta1.WaitingForMetalNodeReason, "no available metal node matches the machine")
+		return ctrl.Result{}, nil
+	}
+
+	node := &v1beta1.MetalNode{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: metalMachine.Namespace, Name: claim.Status.NodeName}, node); err != nil {
+		l.WithError(err).Errorln("failed to get the metal node of the metal machine")
+		return ctrl.Result{}, err
+	}
+	if metalMachine.Spec.ProviderID == nil || metalMachine.Status.NodeName != node.Name {
+		providerID := node.ProviderID()
+		metalMachine.Spec.ProviderID = &providerID
+		status := metalMachine.Status.DeepCopy()
+		if err := r.Update(ctx, metalMachine); err != nil {
+			l.WithError(err).Errorln("failed to set the provider id of metal machine")
+			return ctrl.Result{}, err
+		}
+		metalMachine.Status = *status
+		l.With("metalnode", node.Name).Infoln("metal node claimed by the metal machine")
+	}
+	metalMachine.Status.NodeName = node.Name
+	metalMachine.Status.Addresses = node.Status.Addresses
+
+	switch {
+	case dataSecretName == "":
+		setMetalNodeReadyCondition(metalMachine, v1beta1.WaitingForBootstrapDataReason, "the bootstrap data secret of the machine is not set")
+	case !node.Status.Bootstrapped:
+		setMetalNodeReadyCondition(metalMachine, v1beta1.BootstrappingReason, "metal node "+node.Name+" is not bootstrapped yet")
+	default:
+		meta.SetStatusCondition(&metalMachine.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.MetalNodeReadyCondition,
+			Status:  metav1.ConditionTrue,
+			Reason:  v1beta1.MetalNodeBootstrappedReason,
+			Message: "metal node " + node.Name + " is bootstrapped",
+		})
+	}
+	metalMachine.Status.Ready = node.Status.Bootstrapped
+	return ctrl.Result{}, nil
+}
+
+// reconcileClaim creates or updates the claim of the metal machine, owned by the metal machine
+func (r *MetalMachineReconciler) reconcileClaim(ctx context.Context, metalMachine *v1beta1.MetalMachine,
+	clusterName, dataSecretName string, l log.Logger) (*v1beta1.MetalNodeClaim, error) {
+	claim := &v1beta1.MetalNodeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: metalMachine.Namespace, Name: metalMachine.Name}}
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, claim, func() error {
+		if claim.Labels == nil {
+			claim.Labels = map[string]string{}
+		}
+		claim.Labels[clusterNameLabel] = clusterName
+		// the claim bound keeps its metal node, only the data secret changes
+		if claim.Status.Phase != v1beta1.ClaimBound {
+			claim.Spec.Selector = machineSelector(metalMachine)
+			claim.Spec.Resources = metalMachine.Spec.Resources
+		}
+		claim.Spec.Role = workerRole
+		if _, ok := metalMachine.Labels[controlPlaneLabel]; ok {
+			claim.Spec.Role = controlPlaneRole
+		}
+		claim.Spec.Cluster = clusterName
+		claim.Spec.DataSecretName = dataSecretName
+		return controllerutil.SetControllerReference(metalMachine, claim, r.Scheme)
+	})
+	if err != nil {
+		l.WithError(err).Errorln("failed to create or update the claim of metal machine")
+		return nil, err
+	}
+	if result == controllerutil.OperationResultCreated {
+		l.Infoln("metal node claim of the metal machine created")
+	}
+	return claim, nil
+}
+
+// machineSelector returns the selector of the metal nodes of the metal machine, restricted to its failure domain
+func machineSelector(metalMachine *v1beta1.MetalMachine) *metav1.LabelSelector {
+	if metalMachine.Spec.FailureDomain == nil || *metalMachine.Spec.FailureDomain == "" {
+		return metalMachine.Spec.Selector
+	}
+	selector := &metav1.LabelSelector{}
+	if metalMachine.Spec.Selector != nil {
+		selector = metalMachine.Spec.Selector.DeepCopy()
+	}
+	if selector.MatchLabels == nil {
+		selector.MatchLabels = map[string]string{}
+	}
+	selector.MatchLabels[v1beta1.FailureDomainLabel] = *metalMachine.Spec.FailureDomain
+	return selector
+}
+
+// bootstrapDataSecret returns the data secret the metal node of the metal machine is bootstrapped with,
+// empty until the bootstrap provider set the one of the Machine. The control plane nodes of a cluster load balanced
+// by kube-vip are bootstrapped with a copy of it which also writes the static pod of kube-vip
+func (r *MetalMachineReconciler) bootstrapDataSecret(ctx context.Context, metalMachine *v1beta1.MetalMachine,
+	machine, cluster *unstructured.Unstructured, l log.Logger) (string, error) {
+	name, _, _ := unstructured.NestedString(machine.Object, "spec", "bootstrap", "dataSecretName")
+	if _, ok := metalMachine.Labels[controlPlaneLabel]; name == "" || !ok {
+		return name, nil
+	}
+	metalClusterName := infrastructureRefName(cluster, "MetalCluster")
+	if metalClusterName == "" {
+		return name, nil
+	}
+	metalCluster := &v1beta1.MetalCluster{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: metalMachine.Namespace, Name: metalClusterName}, metalCluster); err != nil {
+		l.WithError(err).Errorln("failed to get the metal cluster of metal machine")
+		return "", err
+	}
+	if metalCluster.Spec.LoadBalancer.Type != v1beta1.LoadBalancerKubeVIP {
+		return name, nil
+	}
+
+	source := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: metalMachine.Namespace, Name: name}, source); err != nil {
+		l.WithError(err).Errorln("failed to get the bootstrap data of the machine")
+		return "", err
+	}
+	value, err := cloudinit.AddWriteFile(source.Data["value"], kubeVIPManifestPath, "0644", kubeVIPManifest(metalCluster))
+	if err != nil {
+		l.WithError(err).Errorln("failed to add kube-vip to the bootstrap data")
+		return "", err
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: metalMachine.Namespace, Name: metalMachine.Name + "-bootstrap"}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		secret.Type = source.Type
+		secret.Data = map[string][]byte{"value": value, "format": source.Data["format"]}
+		return controllerutil.SetControllerReference(metalMachine, secret, r.Scheme)
+	}); err != nil {
+		l.WithError(err).Errorln("failed to write the bootstrap data of metal machine")
+		return "", errors.Wrap(err, "failed to write the bootstrap data")
+	}
+	return secret.Name, nil
+}
+
+// reconcileDelete deletes the claim of the metal machine, which releases and tears down its metal node,
+// then removes the finalizer of the metal machine
+func (r *MetalMachineReconciler) reconcileDelete(ctx context.Context, metalMachine *v1beta1.MetalMachine, l log.Logger) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(metalMachine, v1beta1.MetalMachineFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	claim := &v1beta1.MetalNodeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: metalMachine.Namespace, Name: metalMachine.Name}, claim)
+	if err != nil && !apierrors.IsNotFound(err) {
+		l.WithError(err).Errorln("failed to get the claim of metal machine")
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		if claim.DeletionTimestamp.IsZero() {
+			if err := r.Delete(ctx, claim); err != nil && !apierrors.IsNotFound(err) {
+				l.WithError(err).Errorln("failed to delete the claim of metal machine")
+				return ctrl.Result{}, err
+			}
+			l.Infoln("metal node claim of the metal machine deleted")
+		}
+		// the claim is gone once its metal node is released
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+
+	controllerutil.RemoveFinalizer(metalMachine, v1beta1.MetalMachineFinalizer)
+	if err := r.Update(ctx, metalMachine); err != nil {
+		l.WithError(err).Errorln("failed to remove metal machine finalizer")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager, the metal machines are reconciled again when their claim,
+// their metal node or their Machine change
+func (r *MetalMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("metalmachine-controller")
+	}
+	machine := &unstructured.Unstructured{}
+	machine.SetGroupVersionKind(MachineGVK)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.MetalMachine{}).
+		Owns(&v1beta1.MetalNodeClaim{}).
+		Watches(&source.Kind{Type: &v1beta1.MetalNode{}}, handler.EnqueueRequestsFromMapFunc(metalNodeToMetalMachine)).
+		Watches(&source.Kind{Type: machine}, handler.EnqueueRequestsFromMapFunc(machineToMetalMachine)).
+		Complete(r)
+}
+
+// metalNodeToMetalMachine returns the metal machine consuming the metal node
+func metalNodeToMetalMachine(obj client.Object) []reconcile.Request {
+	node, ok := obj.(*v1beta1.MetalNode)
+	if !ok || node.Spec.ConsumerRef == nil || node.Spec.ConsumerRef.Kind != "MetalMachine" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: node.Namespace, Name: node.Spec.ConsumerRef.Name}}}
+}
+
+// machineToMetalMachine returns the metal machine of the Machine
+func machineToMetalMachine(obj client.Object) []reconcile.Request {
+	machine, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+	name := infrastructureRefName(machine, "MetalMachine")
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: machine.GetNamespace(), Name: name}}}
+}
+
+func setMetalNodeReadyCondition(metalMachine *v1beta1.MetalMachine, reason, message string) {
+	meta.SetStatusCondition(&metalMachine.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.MetalNodeReadyCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	})
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// TestReconcileDeleteOwnerlessMetalMachine deletes a metal machine whose Machine never owned it,
+// its claim is deleted and releases the metal node before the metal machine is gone
+func TestReconcileDeleteOwnerlessMetalMachine(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	now := metav1.Now()
+	metalMachine := &v1beta1.MetalMachine{ObjectMeta: metav1.ObjectMeta{
+		Namespace:         "default",
+		Name:              "worker-0",
+		Finalizers:        []string{v1beta1.MetalMachineFinalizer},
+		DeletionTimestamp: &now,
+	}}
+	claim := &v1beta1.MetalNodeClaim{ObjectMeta: metav1.ObjectMeta{
+		Namespace:  "default",
+		Name:       "worker-0",
+		Finalizers: []string{v1beta1.MetalNodeClaimFinalizer},
+	}}
+	claim.Spec.Cluster = "cluster"
+	claim.Spec.DataSecretName = "worker-0"
+	if err := controllerutil.SetControllerReference(metalMachine, claim, scheme); err != nil {
+		t.Fatal(err)
+	}
+	metalNode := allocate(testMetalNode("node-0"), claim)
+	setClaimBound(claim, metalNode.Name)
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(metalMachine, claim, metalNode).Build()
+	machineReconciler := &MetalMachineReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+	claimReconciler := &MetalNodeClaimReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+	ctx := context.Background()
+	request := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(metalMachine)}
+
+	// the claim is deleted, the metal machine waits for it to release the metal node
+	result, err := machineReconciler.Reconcile(ctx, request)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Error("metal machine not requeued while its claim is being deleted")
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(metalMachine), &v1beta1.MetalMachine{}); err != nil {
+		t.Fatalf("metal machine gone before its claim: %v", err)
+	}
+
+	if _, err := claimReconciler.Reconcile(ctx, request); err != nil {
+		t.Fatalf("claim Reconcile() error = %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(claim), &v1beta1.MetalNodeClaim{}); !apierrors.IsNotFound(err) {
+		t.Errorf("claim of the metal machine not deleted, get error = %v", err)
+	}
+	stored := &v1beta1.MetalNode{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(metalNode), stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Spec.ClaimRef != nil || stored.IsAllocated() || stored.Spec.ConsumerRef != nil {
+		t.Errorf("metal node not released: claimRef = %v, consumerRef = %v, clusterName = %q",
+			stored.Spec.ClaimRef, stored.Spec.ConsumerRef, stored.Spec.ClusterName)
+	}
+
+	// the finalizer of the metal machine is removed once its claim is gone
+	if _, err := machineReconciler.Reconcile(ctx, request); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(metalMachine), &v1beta1.MetalMachine{}); !apierrors.IsNotFound(err) {
+		t.Errorf("metal machine finalizer not removed, get error = %v", err)
+	}
+}
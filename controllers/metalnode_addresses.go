@@ -0,0 +1,70 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+)
+
+// specHostname returns the hostname set by the set-hostname module, the node name of the metal node
+func specHostname(metalNode *v1beta1.MetalNode) string {
+	if metalNode.Spec.NodeName != "" {
+		return metalNode.Spec.NodeName
+	}
+	return metalNode.Name
+}
+
+// nodeHostname returns the hostname of the metal node once initialized: the node name set by the default steps,
+// or the hostname found on the host when the initialization commands of spec replace the steps.
+// The steps of a profile may not run the set-hostname module, the hostname found on the host is used once collected
+func nodeHostname(metalNode *v1beta1.MetalNode) string {
+	switch {
+	case metalNode.Spec.ProfileRef == nil && metalNode.Spec.InitializationCmd == nil:
+		return specHostname(metalNode)
+	case metalNode.Status.Inventory != nil && metalNode.Status.Inventory.Hostname != "":
+		return metalNode.Status.Inventory.Hostname
+	case metalNode.Spec.ProfileRef != nil:
+		return specHostname(metalNode)
+	}
+	return ""
+}
+
+// nodeAddresses returns the addresses of the metal node published in status, the SSH addresses excluded.
+// The endpoint host is the InternalIP when no InternalIP is set and it is an IP,
+// the node name is a Hostname unless it is already listed
+func nodeAddresses(metalNode *v1beta1.MetalNode) []v1beta1.MachineAddress {
+	var addresses []v1beta1.MachineAddress
+	if metalNode.InternalIP() == "" && net.ParseIP(metalNode.Spec.NodeEndPoint.Host) != nil {
+		addresses = append(addresses, v1beta1.MachineAddress{Type: v1beta1.MachineInternalIP, Address: metalNode.Spec.NodeEndPoint.Host})
+	}
+	hostname := nodeHostname(metalNode)
+	for _, address := range metalNode.Spec.Addresses {
+		if address.Type == v1beta1.MachineSSHAddress {
+			continue
+		}
+		if address.Type == v1beta1.MachineHostName && address.Address == hostname {
+			hostname = ""
+		}
+		addresses = append(addresses, address)
+	}
+	if hostname != "" {
+		addresses = append(addresses, v1beta1.MachineAddress{Type: v1beta1.MachineHostName, Address: hostname})
+	}
+	return addresses
+}
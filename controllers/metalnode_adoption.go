@@ -0,0 +1,237 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+const (
+	opAdoption   = "adoption"
+	opCompliance = "compliance"
+)
+
+// bootstrapProbeFailed check the host of the metal node could not be probed for a bootstrap, it is probed again
+// before it is initialized
+func bootstrapProbeFailed(metalNode *v1beta1.MetalNode) bool {
+	return meta.IsStatusConditionFalse(metalNode.Status.Conditions, v1beta1.BootstrapProbedCondition)
+}
+
+// probeBootstrappedCmd prints bootstrapped if the bootstrap success sentinel file exists,
+// the sentinel is removed by the teardown
+const probeBootstrappedCmd = "if sudo test -e /run/cluster-api/bootstrap-success.complete; then echo bootstrapped; fi"
+
+// reconcileAdoption probes in background if the host of a pending metal node was already bootstrapped,
+// such as a metal node moved by clusterctl move or restored from a backup, which lost its status.
+// A bootstrapped host is adopted: it is checked instead of initialized, and the metal node moves to CHECKING.
+// done is true once the metal node is adopted, known not to be bootstrapped or moved to FAIL because the probe failed.
+// The probe is retried with backoff until the host answers, so a bootstrapped host is never initialized again
+func (r *MetalNodeReconciler) reconcileAdoption(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (done bool, err error) {
+	// the check of an adopted host failed, it is checked again
+	if metalNode.Status.Bootstrapped {
+		return true, r.adopt(ctx, metalNode, l)
+	}
+
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name != opAdoption {
+		node := metalNode.DeepCopy()
+		if err := r.startOperation(metalNode, opAdoption, func() (operation.Result, error) {
+			results, err := remote.Exec(metalNodeToHost(node)[0], probeBootstrappedCmd)
+			if err != nil {
+				return operation.Result{}, err
+			}
+			if results[0].Err != nil {
+				return operation.Result{Stderr: []string{results[0].Stderr}},
+					errors.Wrap(results[0].Err, "failed to probe the bootstrap sentinel")
+			}
+			if results[0].Stderr != "" {
+				return operation.Result{Stderr: []string{results[0].Stderr}}, errors.New("failed to probe the bootstrap sentinel")
+			}
+			return operation.Result{Output: strings.TrimSpace(results[0].Stdout) == "bootstrapped"}, nil
+		}); err != nil {
+			l.WithError(err).Warnln("failed to start metal node adoption probe")
+		}
+		return false, nil
+	}
+	if op.Phase != operation.Done {
+		return false, nil
+	}
+
+	metalNode.Status.Operation = nil
+	if op.Err != nil {
+		l.WithError(op.Err).Errorln("failed to probe if the metal node is bootstrapped")
+		r.connectionEvents(metalNode, op.Err, false)
+		r.warning(metalNode, AdoptionFailedReason, "failed to probe if the host is bootstrapped: "+op.Err.Error(), op.Stderr)
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.BootstrapProbedCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  v1beta1.BootstrapProbeFailedReason,
+			Message: op.Err.Error(),
+		})
+		r.markFailed(metalNode, l, "bootstrap probe failed: "+op.Err.Error())
+		return true, nil
+	}
+	meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.BootstrapProbedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  v1beta1.BootstrapProbedReason,
+		Message: "the host was probed for a bootstrap",
+	})
+	if bootstrapped, _ := op.Output.(bool); !bootstrapped {
+		setInitializationState(metalNode, PENDING, "host is not bootstrapped")
+		return true, nil
+	}
+
+	l.Infoln("metal node host is already bootstrapped, adopt it")
+	r.event(metalNode, AdoptedReason, "the host is already bootstrapped, it is adopted without initialization", nil)
+	markBootstrapped(metalNode)
+	if bootstrappedUnallocated(metalNode) {
+		l.Warnln("metal node host is bootstrapped without allocation, it is neither claimed nor torn down")
+		r.warning(metalNode, UnallocatedHostReason, "the host is bootstrapped but the metal node is not allocated, "+
+			"it is neither claimed nor torn down: reset the host and set the annotation "+v1beta1.ReprovisionAnnotation+"="+
+			v1beta1.ReprovisionForce+" to use it", nil)
+	}
+	return true, r.adopt(ctx, metalNode, l)
+}
+
+// adopt checks the bootstrapped host of the metal node, the versions installed are recorded but not enforced
+func (r *MetalNodeReconciler) adopt(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) error {
+	started, err := r.startCheck(ctx, metalNode, l, false)
+	if err != nil || !started {
+		return err
+	}
+	setInitializationState(metalNode, CHECKING, "adopted bootstrapped host")
+	return nil
+}
+
+// compliance is the result of the probe of a host before its adoption
+type compliance struct {
+	installed v1beta1.InstalledVersions
+	compliant bool
+}
+
+// adoptionEnabled check if the host of the metal node is probed before its initialization to be adopted
+func adoptionEnabled(metalNode *v1beta1.MetalNode) bool {
+	return metalNode.Spec.Adoption == v1beta1.AdoptIfCompliant || metalNode.Spec.Adoption == v1beta1.AdoptMissingSteps
+}
+
+// reconcileCompliance probes in background if the host of a pending metal node already has the container runtime,
+// kubelet, kubeadm and kubectl of the expected versions, with the check run after the initialization.
+// The versions found are recorded, a compliant host is adopted and moves to SUCCESS without initialization,
+// the metal node moves to FAIL if the host can't be probed. done is true once the host was probed,
+// it is not probed again until the initialization clears the versions
+func (r *MetalNodeReconciler) reconcileCompliance(metalNode *v1beta1.MetalNode, options provision.Options, l log.Logger) (done bool) {
+	if metalNode.Status.InstalledVersions != nil {
+		return true
+	}
+
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name != opCompliance {
+		node := metalNode.DeepCopy()
+		if err := r.startOperation(metalNode, opCompliance, func() (operation.Result, error) {
+			stderr, err := checkMetalNodeInitialized(node)
+			if err != nil {
+				return operation.Result{Stderr: stderr}, err
+			}
+			installed, mismatches, err := checkMetalNodeVersions(node, options)
+			return operation.Result{
+				Stderr: append(stderr, mismatches...),
+				Output: compliance{installed: installed, compliant: len(stderr) == 0 && len(mismatches) == 0},
+			}, err
+		}); err != nil {
+			l.WithError(err).Warnln("failed to start metal node compliance probe")
+		}
+		return false
+	}
+	if op.Phase != operation.Done {
+		return false
+	}
+
+	metalNode.Status.Operation = nil
+	if op.Err != nil {
+		l.WithError(op.Err).Errorln("failed to probe the metal node compliance")
+		r.connectionEvents(metalNode, op.Err, false)
+		r.warning(metalNode, AdoptionFailedReason, "failed to probe the host before its initialization: "+op.Err.Error(), op.Stderr)
+		r.markFailed(metalNode, l, "adoption probe failed: "+op.Err.Error())
+		return true
+	}
+	result, _ := op.Output.(compliance)
+	metalNode.Status.InstalledVersions = &result.installed
+	if !result.compliant {
+		l.Infoln("metal node host is not compliant, initialize it")
+		r.event(metalNode, NotCompliantReason, "the host is not compliant, it is initialized", op.Stderr)
+		return true
+	}
+
+	l.Infoln("metal node host is compliant, adopt it without initialization")
+	r.event(metalNode, AdoptedReason, "the host is compliant, it is adopted without initialization", nil)
+	metalNode.Status.FailureCount = 0
+	metalNode.Status.NextRetryTime = nil
+	metalNode.Status.InitializationFailureReason = nil
+	metalNode.Status.CheckFailureReason = nil
+	metalNode.Status.Profile = nil
+	metalNode.Status.ScriptHashes = nil
+	metalNode.Status.LastHealthCheckTime = nil
+	setInitializationState(metalNode, SUCCESS, "adopted compliant host")
+	return true
+}
+
+// missingSteps returns the steps of the initialization of a host which is not compliant, without the built-in modules
+// installing the components found with the expected versions if the adoption policy is MissingSteps.
+// All the steps run if no component is missing, the host failed the check for another reason
+func missingSteps(metalNode *v1beta1.MetalNode, options provision.Options, steps []provision.Step) []provision.Step {
+	installed := metalNode.Status.InstalledVersions
+	if metalNode.Spec.Adoption != v1beta1.AdoptMissingSteps || installed == nil {
+		return steps
+	}
+
+	// the versions are compared one component at a time, the versions of the other ones are not expected
+	runtime, runtimeOptions := *installed, options
+	runtimeOptions.KubernetesVersion = ""
+	kubernetes, kubernetesOptions := *installed, options
+	kubernetesOptions.ContainerRuntimeVersion = ""
+	kubernetes.ContainerRuntimeName = ""
+	skip := map[string]bool{
+		v1beta1.ModuleInstallRuntime: installed.ContainerRuntime != "" && len(versionMismatches(runtimeOptions, runtime)) == 0,
+		v1beta1.ModuleInstallKubeadm: installed.Kubelet != "" && installed.Kubeadm != "" &&
+			len(versionMismatches(kubernetesOptions, kubernetes)) == 0,
+	}
+	if !skip[v1beta1.ModuleInstallRuntime] && !skip[v1beta1.ModuleInstallKubeadm] {
+		return steps
+	}
+	// the package repositories are only needed to install the missing components
+	skip[v1beta1.ModulePrepareHost] = skip[v1beta1.ModuleInstallRuntime] && skip[v1beta1.ModuleInstallKubeadm]
+
+	missing := make([]provision.Step, 0, len(steps))
+	for _, step := range steps {
+		if !skip[step.Module] {
+			missing = append(missing, step)
+		}
+	}
+	return missing
+}
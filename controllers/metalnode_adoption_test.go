@@ -0,0 +1,287 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMissingSteps(t *testing.T) {
+	options := provision.Options{KubernetesVersion: "v1.23.5", ContainerRuntime: provision.Containerd, ContainerRuntimeVersion: "1.6.4"}
+	runtime := v1beta1.InstalledVersions{ContainerRuntime: "1.6.4", ContainerRuntimeName: provision.Containerd}
+	all := []string{
+		v1beta1.ModulePrepareHost,
+		v1beta1.ModuleInstallRuntime,
+		v1beta1.ModuleConfigureKernel,
+		v1beta1.ModuleConfigureSystem,
+		v1beta1.ModuleInstallKubeadm,
+		v1beta1.ModuleSetHostname,
+	}
+	tests := []struct {
+		name      string
+		adoption  v1beta1.AdoptionPolicy
+		installed *v1beta1.InstalledVersions
+		want      []string
+	}{
+		{name: "adoption disabled", installed: &runtime, want: all},
+		{name: "adopt if compliant", adoption: v1beta1.AdoptIfCompliant, installed: &runtime, want: all},
+		{name: "not probed", adoption: v1beta1.AdoptMissingSteps, want: all},
+		{name: "nothing installed", adoption: v1beta1.AdoptMissingSteps, installed: &v1beta1.InstalledVersions{}, want: all},
+		{
+			name:      "runtime installed",
+			adoption:  v1beta1.AdoptMissingSteps,
+			installed: &runtime,
+			want: []string{
+				v1beta1.ModulePrepareHost,
+				v1beta1.ModuleConfigureKernel,
+				v1beta1.ModuleConfigureSystem,
+				v1beta1.ModuleInstallKubeadm,
+				v1beta1.ModuleSetHostname,
+			},
+		},
+		{
+			name:     "kubernetes installed",
+			adoption: v1beta1.AdoptMissingSteps,
+			installed: &v1beta1.InstalledVersions{
+				Kubelet: "v1.23.5", Kubeadm: "v1.23.5", ContainerRuntime: "1.5.11", ContainerRuntimeName: provision.Containerd,
+			},
+			want: []string{
+				v1beta1.ModulePrepareHost,
+				v1beta1.ModuleInstallRuntime,
+				v1beta1.ModuleConfigureKernel,
+				v1beta1.ModuleConfigureSystem,
+				v1beta1.ModuleSetHostname,
+			},
+		},
+		{
+			name:     "all installed",
+			adoption: v1beta1.AdoptMissingSteps,
+			installed: &v1beta1.InstalledVersions{
+				Kubelet: "v1.23.5", Kubeadm: "v1.23.5", ContainerRuntime: "1.6.4", ContainerRuntimeName: provision.Containerd,
+			},
+			want: []string{v1beta1.ModuleConfigureKernel, v1beta1.ModuleConfigureSystem, v1beta1.ModuleSetHostname},
+		},
+		{
+			name:     "kubeadm of another version",
+			adoption: v1beta1.AdoptMissingSteps,
+			installed: &v1beta1.InstalledVersions{
+				Kubelet: "v1.23.5", Kubeadm: "v1.22.9", ContainerRuntime: "1.6.4", ContainerRuntimeName: provision.Containerd,
+			},
+			want: []string{
+				v1beta1.ModulePrepareHost,
+				v1beta1.ModuleConfigureKernel,
+				v1beta1.ModuleConfigureSystem,
+				v1beta1.ModuleInstallKubeadm,
+				v1beta1.ModuleSetHostname,
+			},
+		},
+		{
+			name:      "another runtime",
+			adoption:  v1beta1.AdoptMissingSteps,
+			installed: &v1beta1.InstalledVersions{ContainerRuntime: "20.10.17", ContainerRuntimeName: provision.Docker},
+			want:      all,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := &v1beta1.MetalNode{}
+			metalNode.Spec.Adoption = tt.adoption
+			metalNode.Status.InstalledVersions = tt.installed
+
+			var got []string
+			for _, step := range missingSteps(metalNode, options, provision.DefaultSteps()) {
+				got = append(got, step.Module)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingSteps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileAdoption(t *testing.T) {
+	// the probe of a metal node which lost its status, such as moved by clusterctl move
+	lostStatus := func(mn *v1beta1.MetalNode) {}
+	// the probe retried once the backoff of a failed probe expired
+	probeFailed := func(mn *v1beta1.MetalNode) {
+		mn.Status.InitializationState = FAIL
+		mn.Status.LastTransitionTime = timeAgo(time.Hour)
+		mn.Status.NextRetryTime = timeAgo(time.Minute)
+		mn.Status.FailureCount = 1
+		meta.SetStatusCondition(&mn.Status.Conditions, metav1.Condition{
+			Type:   v1beta1.BootstrapProbedCondition,
+			Status: metav1.ConditionFalse,
+			Reason: v1beta1.BootstrapProbeFailedReason,
+		})
+	}
+	tests := []struct {
+		name             string
+		status           func(mn *v1beta1.MetalNode)
+		bootstrapped     bool
+		probeErr         error
+		wantState        v1beta1.InitializationState
+		wantBootstrapped bool
+		wantProbed       metav1.ConditionStatus
+		wantEvent        string
+	}{
+		{
+			name:             "bootstrapped host adopted",
+			status:           lostStatus,
+			bootstrapped:     true,
+			wantState:        CHECKING,
+			wantBootstrapped: true,
+			wantProbed:       metav1.ConditionTrue,
+			wantEvent:        AdoptedReason,
+		},
+		{name: "host not bootstrapped", status: lostStatus, wantState: PENDING, wantProbed: metav1.ConditionTrue},
+		{
+			name:       "probe failed",
+			status:     lostStatus,
+			probeErr:   errors.New("connection refused"),
+			wantState:  FAIL,
+			wantProbed: metav1.ConditionFalse,
+			wantEvent:  AdoptionFailedReason,
+		},
+		{
+			name:             "bootstrapped host adopted after a failed probe",
+			status:           probeFailed,
+			bootstrapped:     true,
+			wantState:        CHECKING,
+			wantBootstrapped: true,
+			wantProbed:       metav1.ConditionTrue,
+			wantEvent:        AdoptedReason,
+		},
+		{name: "host not bootstrapped after a failed probe", status: probeFailed, wantState: PENDING, wantProbed: metav1.ConditionTrue},
+		{
+			name:       "probe failed again",
+			status:     probeFailed,
+			probeErr:   errors.New("connection refused"),
+			wantState:  FAIL,
+			wantProbed: metav1.ConditionFalse,
+			wantEvent:  AdoptionFailedReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := testMetalNode("node-0")
+			r := newTestReconciler(t, metalNode)
+			tt.status(metalNode)
+			finishOperation(t, r, metalNode, opAdoption, operation.Result{Output: tt.bootstrapped}, tt.probeErr)
+			if err := r.Status().Update(context.Background(), metalNode); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := r.Reconcile(context.Background(), testRequest(metalNode)); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			stored := getMetalNode(t, r, metalNode)
+			if stored.Status.InitializationState != tt.wantState {
+				t.Errorf("state = %q, want %q", stored.Status.InitializationState, tt.wantState)
+			}
+			if stored.Status.Bootstrapped != tt.wantBootstrapped {
+				t.Errorf("bootstrapped = %v, want %v", stored.Status.Bootstrapped, tt.wantBootstrapped)
+			}
+			if condition := meta.FindStatusCondition(stored.Status.Conditions, v1beta1.BootstrapProbedCondition); condition == nil ||
+				condition.Status != tt.wantProbed {
+				t.Errorf("%s condition = %v, want status %s", v1beta1.BootstrapProbedCondition, condition, tt.wantProbed)
+			}
+			if stored.Status.Operation != nil && stored.Status.Operation.Name == opInitialize {
+				t.Error("host initialized before it is known not to be bootstrapped")
+			}
+			if tt.probeErr != nil && stored.Status.NextRetryTime == nil {
+				t.Error("failed probe not retried with backoff")
+			}
+			if tt.wantEvent != "" {
+				expectEvent(t, r, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestReconcileCompliance(t *testing.T) {
+	installed := v1beta1.InstalledVersions{
+		ContainerRuntime: "1.6.4", ContainerRuntimeName: provision.Containerd,
+		Kubelet: "v1.23.5", Kubeadm: "v1.23.5",
+	}
+	tests := []struct {
+		name          string
+		result        operation.Result
+		probeErr      error
+		wantState     v1beta1.InitializationState
+		wantInstalled bool
+		wantEvent     string
+	}{
+		{
+			name:          "compliant host adopted",
+			result:        operation.Result{Output: compliance{installed: installed, compliant: true}},
+			wantState:     SUCCESS,
+			wantInstalled: true,
+			wantEvent:     AdoptedReason,
+		},
+		{
+			name:          "host not compliant",
+			result:        operation.Result{Output: compliance{installed: installed}, Stderr: []string{"kubelet v1.22.0"}},
+			wantState:     PENDING,
+			wantInstalled: true,
+			wantEvent:     NotCompliantReason,
+		},
+		{name: "probe failed", probeErr: errors.New("connection refused"), wantState: FAIL, wantEvent: AdoptionFailedReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := testMetalNode("node-0")
+			metalNode.Spec.Adoption = v1beta1.AdoptIfCompliant
+			metalNode.Spec.KubernetesVersion = "v1.23.5"
+			// known not to be bootstrapped, its os is known
+			metalNode.Status.LastTransitionTime = timeAgo(time.Minute)
+			metalNode.Status.Inventory = &v1beta1.Inventory{
+				OS:             v1beta1.OSInfo{Distro: "centos", Version: "7"},
+				CollectionTime: metav1.Now(),
+			}
+			r := newTestReconciler(t, metalNode)
+			finishOperation(t, r, metalNode, opCompliance, tt.result, tt.probeErr)
+			if err := r.Status().Update(context.Background(), metalNode); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := r.Reconcile(context.Background(), testRequest(metalNode)); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			stored := getMetalNode(t, r, metalNode)
+			if stored.Status.InitializationState != tt.wantState {
+				t.Errorf("state = %q, want %q", stored.Status.InitializationState, tt.wantState)
+			}
+			if (stored.Status.InstalledVersions != nil) != tt.wantInstalled {
+				t.Errorf("installed versions = %v, want recorded %v", stored.Status.InstalledVersions, tt.wantInstalled)
+			}
+			if stored.Status.Operation != nil && stored.Status.Operation.Name == opInitialize {
+				t.Error("host initialized before its preflight checks")
+			}
+			expectEvent(t, r, tt.wantEvent)
+		})
+	}
+}
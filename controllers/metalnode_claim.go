@@ -0,0 +1,84 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// releaseLostClaim releases the metal node bound to a claim which is gone without releasing it,
+// such as when the finalizer of the claim was removed. The allocation set by the claim is reset,
+// which tears down the host if it was bootstrapped. A claim of the same name but another uid, such as
+// a claim moved by clusterctl move, still holds the metal node.
+// The metal node is only released if the claim was seen being deleted: a claim missing from the cache,
+// or not restored yet, would tear down a host in use
+func (r *MetalNodeReconciler) releaseLostClaim(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) error {
+	ref := metalNode.Spec.ClaimRef
+	if ref == nil {
+		metalNode.Status.DeletingClaim = ""
+		return nil
+	}
+	l = l.With("claim", ref.Name)
+	claim := &v1beta1.MetalNodeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: metalNode.Namespace, Name: ref.Name}, claim)
+	if err == nil {
+		metalNode.Status.DeletingClaim = ""
+		if !claim.DeletionTimestamp.IsZero() {
+			metalNode.Status.DeletingClaim = claim.Name
+		}
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		l.WithError(err).Errorln("failed to get metal node claim")
+		return err
+	}
+	if metalNode.Status.DeletingClaim != ref.Name {
+		l.Warnln("claim of the metal node is not found and was not seen being deleted, the metal node is kept")
+		r.warning(metalNode, ClaimMissingReason, "claim "+ref.Name+" is not found, the metal node is kept allocated "+
+			"until the claim is restored or spec.claimRef and the allocation are removed", nil)
+		return nil
+	}
+
+	status := metalNode.Status.DeepCopy()
+	metalNode.Spec.ClaimRef = nil
+	metalNode.ResetMetalNode()
+	if err := r.Update(ctx, metalNode); err != nil {
+		l.WithError(err).Errorln("failed to release metal node")
+		return err
+	}
+	metalNode.Status = *status
+	metalNode.Status.DeletingClaim = ""
+	l.Infoln("metal node released, its claim is gone")
+	r.event(metalNode, ClaimReleasedReason, "released, claim "+ref.Name+" is gone", nil)
+	return nil
+}
+
+// claimToMetalNode returns the metal node bound to the claim
+func claimToMetalNode(obj client.Object) []reconcile.Request {
+	claim, ok := obj.(*v1beta1.MetalNodeClaim)
+	if !ok || claim.Status.NodeName == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: claim.Namespace, Name: claim.Status.NodeName}}}
+}
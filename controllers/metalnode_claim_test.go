@@ -0,0 +1,200 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReleaseLostClaim(t *testing.T) {
+	now := metav1.Now()
+	tests := []struct {
+		name              string
+		claim             *v1beta1.MetalNodeClaim
+		deletingClaim     string
+		wantReleased      bool
+		wantDeletingClaim string
+	}{
+		{
+			name:  "claim bound",
+			claim: &v1beta1.MetalNodeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker-0"}},
+		},
+		{
+			name: "claim being deleted",
+			claim: &v1beta1.MetalNodeClaim{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", Name: "worker-0", DeletionTimestamp: &now, Finalizers: []string{"test"},
+			}},
+			wantDeletingClaim: "worker-0",
+		},
+		{name: "claim not found", wantDeletingClaim: ""},
+		{name: "claim of another name seen being deleted", deletingClaim: "worker-1", wantDeletingClaim: "worker-1"},
+		{name: "claim gone after being deleted", deletingClaim: "worker-0", wantReleased: true},
+	}
+	scheme := runtime.NewScheme()
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := &v1beta1.MetalNode{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "node-0"}}
+			metalNode.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "default", Name: "worker-0"}
+			metalNode.Spec.ClusterName = "cluster"
+			metalNode.Status.DeletingClaim = tt.deletingClaim
+			objects := []client.Object{metalNode.DeepCopy()}
+			if tt.claim != nil {
+				objects = append(objects, tt.claim)
+			}
+			r := &MetalNodeReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+				Recorder: record.NewFakeRecorder(10),
+			}
+
+			// the metal node as read by the reconcile, with its resource version
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(metalNode), metalNode); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.releaseLostClaim(context.Background(), metalNode, log.With("metalnode", metalNode.Name)); err != nil {
+				t.Fatalf("releaseLostClaim() error = %v", err)
+			}
+			if metalNode.Status.DeletingClaim != tt.wantDeletingClaim {
+				t.Errorf("status.deletingClaim = %q, want %q", metalNode.Status.DeletingClaim, tt.wantDeletingClaim)
+			}
+			stored := &v1beta1.MetalNode{}
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(metalNode), stored); err != nil {
+				t.Fatal(err)
+			}
+			if released := stored.Spec.ClaimRef == nil && stored.Spec.ClusterName == ""; released != tt.wantReleased {
+				t.Errorf("released = %v, want %v", released, tt.wantReleased)
+			}
+		})
+	}
+}
+
+func TestReconcileReleasesLostClaim(t *testing.T) {
+	metalNode := testMetalNode("node-0")
+	metalNode.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "default", Name: "worker-0"}
+	metalNode.Spec.ClusterName = "cluster"
+	metalNode.Spec.Roles = []string{"worker"}
+	metalNode.Status.InitializationState = SUCCESS
+	metalNode.Status.DeletingClaim = "worker-0"
+	r := newTestReconciler(t, metalNode)
+
+	if _, err := r.Reconcile(context.Background(), testRequest(metalNode)); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	stored := getMetalNode(t, r, metalNode)
+	if stored.Spec.ClaimRef != nil || stored.IsAllocated() {
+		t.Errorf("metal node of a lost claim not released: claimRef = %v, clusterName = %q", stored.Spec.ClaimRef, stored.Spec.ClusterName)
+	}
+	if stored.Status.DeletingClaim != "" {
+		t.Errorf("status.deletingClaim = %q, want it reset", stored.Status.DeletingClaim)
+	}
+	if !stored.Status.Ready {
+		t.Error("metal node released without bootstrap is not ready")
+	}
+	expectEvent(t, r, ClaimReleasedReason)
+}
+
+// testMetalNode returns a metal node of the default namespace with its finalizer, its host is never reachable
+func testMetalNode(name string) *v1beta1.MetalNode {
+	metalNode := &v1beta1.MetalNode{ObjectMeta: metav1.ObjectMeta{
+		Namespace:  "default",
+		Name:       name,
+		Finalizers: []string{v1beta1.MetalNodeFinalizer},
+	}}
+	metalNode.Spec.NodeEndPoint.Host = "127.0.0.1"
+	metalNode.Spec.NodeEndPoint.SSHAuth = v1beta1.Auth{User: "root", Password: "password", Port: 1}
+	return metalNode
+}
+
+// newTestReconciler returns a metal node reconciler of a fake client holding objects
+func newTestReconciler(t *testing.T, objects ...client.Object) *MetalNodeReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &MetalNodeReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Scheme:     scheme,
+		Operations: operation.NewTracker(0),
+		Recorder:   record.NewFakeRecorder(100),
+		startTime:  time.Now(),
+	}
+}
+
+// finishOperation records in the status of the metal node a finished operation with result and err,
+// as if started by a previous reconcile
+func finishOperation(t *testing.T, r *MetalNodeReconciler, metalNode *v1beta1.MetalNode, name string, result operation.Result, err error) {
+	t.Helper()
+	if startErr := r.startOperation(metalNode, name, func() (operation.Result, error) { return result, err }); startErr != nil {
+		t.Fatal(startErr)
+	}
+	for {
+		if op, _ := r.Operations.Get(operationKey(metalNode)); op.Phase == operation.Done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testRequest(metalNode *v1beta1.MetalNode) ctrl.Request {
+	return ctrl.Request{NamespacedName: client.ObjectKeyFromObject(metalNode)}
+}
+
+func getMetalNode(t *testing.T, r *MetalNodeReconciler, metalNode *v1beta1.MetalNode) *v1beta1.MetalNode {
+	t.Helper()
+	stored := &v1beta1.MetalNode{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(metalNode), stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// expectEvent check an event of reason was emitted
+func expectEvent(t *testing.T, r *MetalNodeReconciler, reason string) {
+	t.Helper()
+	events := r.Recorder.(*record.FakeRecorder).Events
+	for {
+		select {
+		case event := <-events:
+			if strings.Contains(event, " "+reason+" ") {
+				return
+			}
+		default:
+			t.Errorf("no %s event emitted", reason)
+			return
+		}
+	}
+}
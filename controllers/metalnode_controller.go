@@ -19,19 +19,30 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
+	"time"
+
 	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
 	"github.com/git-czy/cluster-api-metalnode/pkg/kubeadm/cloudinit"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
 	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 
 	util "github.com/git-czy/cluster-api-metalnode/utils"
 	"github.com/git-czy/cluster-api-metalnode/utils/log"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const (
@@ -46,12 +57,49 @@ const (
 type MetalNodeReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// MaxConcurrentReconciles is the maximum number of MetalNodes reconciled at the same time
+	MaxConcurrentReconciles int
+
+	// Operations runs the long-running remote operations (initialize,check,bootstrap) in background
+	Operations *operation.Tracker
+
+	// HealthCheckInterval is how often the health of initialized metal nodes is checked, 0 disables the health check
+	HealthCheckInterval time.Duration
+
+	// InventoryRefreshInterval is how often the inventory of initialized metal nodes is gathered again,
+	// 0 disables the refresh, the inventory is still gathered before the initialization
+	InventoryRefreshInterval time.Duration
+
+	// ProvisioningConfig is the ConfigMap of the package mirrors, proxies and CA certificates applied to the hosts
+	// when they are initialized, the defaults of the init scripts are used if it does not exist
+	ProvisioningConfig types.NamespacedName
+
+	// BundleDir is the directory of the offline bundle installed on the hosts instead of the package repositories
+	// and the registries, the hosts are provisioned online if empty
+	BundleDir string
+
+	// ScriptDir overrides the init scripts embedded in the binary with the scripts of the same name found in it,
+	// such as a mounted ConfigMap
+	ScriptDir string
+
+	// Recorder emits the events of metal nodes
+	Recorder record.EventRecorder
+
+	// startTime is when the controller started, used to detect stale in-progress metal nodes
+	startTime time.Time
 }
 
 //+kubebuilder:rbac:groups=bocloud.io,resources=metalnodes,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=bocloud.io,resources=metalnodes/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=bocloud.io,resources=metalnodes/finalizers,verbs=update
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalnodeprofiles,verbs=get;list;watch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalnodeclaims,verbs=get;list;watch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalmachines,verbs=get;list;watch
 //+kubebuilder:rbac:groups="",resources=secrets;,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines,verbs=get
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -67,131 +115,137 @@ func (r *MetalNodeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	metalNode := &v1beta1.MetalNode{}
 	if err := r.Get(ctx, req.NamespacedName, metalNode); err != nil {
 		if apierrors.IsNotFound(err) {
+			r.Operations.Forget(req.NamespacedName.String())
 			return ctrl.Result{}, nil
 		}
 		log.WithError(err).Error("unable to fetch MetalNode")
 		return ctrl.Result{}, err
 	}
 
+	l := log.With("metalnode", metalNode.Name).With("host", metalNode.Spec.NodeEndPoint.Host)
+
+	// a paused metal node is left alone, even deleted, so clusterctl move can delete it from the source cluster
+	// without tearing down its host
+	if metalNode.IsPaused() {
+		return r.reconcilePaused(ctx, metalNode, l)
+	}
+	r.resume(metalNode, l)
+
+	if !metalNode.DeletionTimestamp.IsZero() {
+		return r.reconcileDelete(ctx, metalNode, l)
+	}
+
+	if !controllerutil.ContainsFinalizer(metalNode, v1beta1.MetalNodeFinalizer) {
+		controllerutil.AddFinalizer(metalNode, v1beta1.MetalNodeFinalizer)
+		if err := r.Update(ctx, metalNode); err != nil {
+			l.WithError(err).Errorln("failed to add metal node finalizer")
+			return ctrl.Result{}, err
+		}
+	}
+
 	if err := metalNode.Spec.NodeEndPoint.Validate(); err != nil {
 		log.WithError(err).Errorln("Invalid metal node endpoint host")
 		return ctrl.Result{}, err
 	}
-	l := log.With("metalnode", metalNode.Name).With("host", metalNode.Spec.NodeEndPoint.Host)
+	if err := metalNode.ValidateAddresses(); err != nil {
+		l.WithError(err).Errorln("invalid metal node addresses")
+		return ctrl.Result{}, err
+	}
+	metalNode.Status.Addresses = nodeAddresses(metalNode)
 
 	// always update the status of the metal node,when leave reconcile
 	defer func() {
+		// a node released from its cluster is not ready until its host is torn down, nor a node whose host
+		// was bootstrapped without allocation, nor a node which failed its health check
 		if metalNode.Status.InitializationState == SUCCESS {
-			metalNode.Status.Ready = READY
+			metalNode.Status.Ready = READY && !needsTeardown(metalNode) && !bootstrappedUnallocated(metalNode) &&
+				isHealthy(metalNode) && !metalNode.Spec.Maintenance
 		}
 		if err := r.Status().Update(ctx, metalNode); err != nil {
 			l.WithError(err).Errorln("failed to update metal node status")
 		}
 	}()
 
-	// if metal node is INITIALIZING, do nothing
-	if metalNode.Status.InitializationState == INITIALIZING {
-		return ctrl.Result{}, nil
-	}
-
-	// if metal node is CHECKING, do nothing
-	if metalNode.Status.InitializationState == CHECKING {
-		return ctrl.Result{}, nil
+	// the allocation is not changed while the host is in maintenance
+	if metalNode.Spec.Maintenance {
+		return r.reconcileMaintenance(metalNode, l)
 	}
+	r.endMaintenance(metalNode, l)
 
-	if metalNode.Status.InitializationState == "" {
-		metalNode.Status.InitializationState = INITIALIZING
-		metalNode.Status.Bootstrapped = false
-		metalNode.Status.Ready = false
-		if err := r.Status().Update(ctx, metalNode); err != nil {
-			l.WithError(err).Errorln("failed to update metal node status")
-			return ctrl.Result{}, err
-		}
-
-		if err := r.initMetal(ctx, metalNode); err != nil {
-			l.WithError(err).Errorln("failed to initialize metal node")
-			return ctrl.Result{}, err
-		}
-
-		metalNode.Status.InitializationState = CHECKING
-		if err := r.Status().Update(ctx, metalNode); err != nil {
-			l.WithError(err).Errorln("failed to update metal node status")
-			return ctrl.Result{}, err
-		}
-		// if metal node InitializationFailureReason is not empty, maybe means the initialization failed
-		// so need to check the metal node is initialized or not(check docker kubelet kubeadm)
-		if err := r.checkMetalNodeInitialized(ctx, metalNode); err != nil {
-			metalNode.Status.InitializationState = FAIL
-			l.WithError(err).Errorln("failed to initialize metal node")
-			return ctrl.Result{}, errors.New("metal node initialization failed")
-		}
-
-		l.Info("initialized metal node successfully")
-
-		metalNode.Status.InitializationState = SUCCESS
-		return ctrl.Result{}, nil
+	if err := r.migrateAllocation(ctx, metalNode, l); err != nil {
+		return ctrl.Result{}, err
 	}
-
-	if metalNode.Status.DataSecretName != "" && !metalNode.Status.Bootstrapped {
-		err := r.bootstrapMetalNode(ctx, metalNode)
-		if err != nil {
-			l.WithError(err).Errorln("failed to bootstrap metal node")
-			return ctrl.Result{}, err
-		}
-		if err = r.checkMetalNodeBootstrap(ctx, metalNode); err != nil {
-			l.Error("failed to check metal node bootstrap")
-			return ctrl.Result{}, err
-		}
-		metalNode.Status.Bootstrapped = true
-		l.Infoln("bootstrapped metal node successfully")
+	if err := r.releaseLostClaim(ctx, metalNode, l); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	handler, ok := r.stateHandlers()[metalNode.Status.InitializationState]
+	if !ok {
+		l.With("state", metalNode.Status.InitializationState).Errorln("unknown metal node initialization state")
+		return ctrl.Result{}, errUnknownState
+	}
+	return handler(ctx, metalNode, l)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *MetalNodeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.startTime = time.Now()
+	if r.Operations == nil {
+		r.Operations = operation.NewTracker(0)
+	}
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("metalnode-controller")
+	}
+	if err := registerMetalNodeCollector(mgr.GetClient()); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1beta1.MetalNode{}).
+		Watches(&source.Kind{Type: &v1beta1.MetalNodeClaim{}}, handler.EnqueueRequestsFromMapFunc(claimToMetalNode)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
 
-// initMetal initializes the metal node
-func (r *MetalNodeReconciler) initMetal(ctx context.Context, metalNode *v1beta1.MetalNode) error {
+// initMetal initializes the metal node with the steps, the built-in modules run the init scripts of the provisioner
+// of its os with the options. Return the standard stderr of the initialization and an error if the host can't be
+// connected or the files can't be uploaded. provisioner and scripts may be nil if no step runs the built-in modules
+func initMetal(metalNode *v1beta1.MetalNode, provisioner *provision.Provisioner, scripts provision.Scripts,
+	options provision.Options, steps []provision.Step) ([]string, error) {
 	host := metalNodeToHost(metalNode)
-	cmd := remote.Command{
-		Cmds: []string{
-			"sudo chmod +x /tmp/init_k8s_env.sh",
-			"sudo sed -i 's/\\r//g' /tmp/init_k8s_env.sh",
-			"sudo /bin/bash /tmp/init_k8s_env.sh",
-			"sudo hostnamectl set-hostname " + host[0].Address,
-		},
-		FileUp: []remote.File{
-			{Src: "script/init_k8s_env.sh", Dst: "/tmp"},
-		},
+	// the scripts and the files of the steps are written locally to be uploaded
+	dir, err := os.MkdirTemp("", "metalnode-steps-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the directory of the steps")
 	}
+	defer os.RemoveAll(dir)
 
-	if metalNode.Spec.InitializationCmd != nil {
-		cmd.Cmds = metalNode.Spec.InitializationCmd
+	cmd, err := provision.Command(provisioner, scripts, options, steps, dir)
+	if err != nil {
+		return nil, err
 	}
-
-	errs := remote.Run(host, cmd)
-	if len(errs[metalNode.Spec.NodeEndPoint.Host]) != 0 {
-		metalNode.Status.InitializationFailureReason = errs[metalNode.Spec.NodeEndPoint.Host]
-		if err := r.Status().Update(ctx, metalNode); err != nil {
-			return err
+	// the exit status of the commands run by RunOnHost is not checked, the bundle is verified before
+	if upload, verify, ok := provision.BundleCommand(options, steps); ok {
+		if _, err := remote.RunOnHost(host[0], upload); err != nil {
+			return nil, err
+		}
+		results, err := remote.Exec(host[0], verify)
+		if err != nil {
+			return nil, err
+		}
+		if results[0].Err != nil {
+			return []string{results[0].Stderr}, errors.Wrap(results[0].Err, "the checksums of the offline bundle do not match")
 		}
 	}
-	return nil
+	return remote.RunOnHost(host[0], cmd)
 }
 
-// check metal node is already initialized
-func (r *MetalNodeReconciler) checkMetalNodeInitialized(ctx context.Context, metalNode *v1beta1.MetalNode) error {
+// checkMetalNodeInitialized check metal node is already initialized, the container runtime is checked through its CRI, return the unexpected standard stderr of the check
+// and an error if the host can't be connected
+func checkMetalNodeInitialized(metalNode *v1beta1.MetalNode) ([]string, error) {
 	host := metalNodeToHost(metalNode)
 	cmd := remote.Command{
 		Cmds: []string{
-			"sudo docker version",
+			"sudo crictl version",
 			"kubelet --version",
 			"kubectl version",
 		},
@@ -201,65 +255,56 @@ func (r *MetalNodeReconciler) checkMetalNodeInitialized(ctx context.Context, met
 	//	cmd = *metalNode.Spec.InitializationCmd
 	//}
 
-	errs := remote.Run(host, cmd)
+	errs, err := remote.RunOnHost(host[0], cmd)
+	if err != nil {
+		return errs, err
+	}
 
 	ignoreErrs := []string{
-		fmt.Sprintf("The connection to the server %s:6443 was refused - did you specify the right host or port?", host[0].Address),
-		fmt.Sprintf("The connection to the server %s:8080 was refused - did you specify the right host or port?", host[0].Address),
+		fmt.Sprintf("The connection to the server %s was refused - did you specify the right host or port?", net.JoinHostPort(host[0].Address, "6443")),
+		fmt.Sprintf("The connection to the server %s was refused - did you specify the right host or port?", net.JoinHostPort(host[0].Address, "8080")),
 		"The connection to the server localhost:6443 was refused - did you specify the right host or port?",
 		"The connection to the server localhost:8080 was refused - did you specify the right host or port?",
 	}
 
-	// it's possible to get one err when run kubectl version,but we don't care about it, because not bootstrap yet
-	checkErrs := util.SliceExcludeSlice(errs[metalNode.Spec.NodeEndPoint.Host], ignoreErrs)
-
-	if len(checkErrs) != 0 {
-		metalNode.Status.CheckFailureReason = checkErrs
-		if err := r.Status().Update(ctx, metalNode); err != nil {
-			return err
-		}
-		return errors.New("metal node is initialized failed")
+	if ip := metalNode.InternalIP(); ip != "" {
+		ignoreErrs = append(ignoreErrs,
+			fmt.Sprintf("The connection to the server %s was refused - did you specify the right host or port?", net.JoinHostPort(ip, "6443")))
 	}
-	return nil
+
+	// it's possible to get one err when run kubectl version,but we don't care about it, because not bootstrap yet
+	return util.SliceExcludeSlice(errs, ignoreErrs), nil
 }
 
-// bootstrapMetalNode bootstrap the metal node with bootstrap data
-func (r *MetalNodeReconciler) bootstrapMetalNode(ctx context.Context, metalNode *v1beta1.MetalNode) error {
+// bootstrapMetalNode bootstrap the metal node with bootstrap data cmd, return the standard stderr of the bootstrap
+// and an error if the host can't be connected
+func bootstrapMetalNode(metalNode *v1beta1.MetalNode, cmd remote.Command) ([]string, error) {
 	host := metalNodeToHost(metalNode)
-	cmd, err := r.getBootstrapDataToCmds(ctx, metalNode)
-	if err != nil {
-		return err
-	}
-
-	errs := remote.Run(host, *cmd)
-	if len(errs[metalNode.Spec.NodeEndPoint.Host]) != 0 {
-		metalNode.Status.BootstrapFailureReason = errs[metalNode.Spec.NodeEndPoint.Host]
-		if err := r.Status().Update(ctx, metalNode); err != nil {
-			return err
-		}
-	}
-	return nil
+	return remote.RunOnHost(host[0], cmd)
 }
 
-func (r *MetalNodeReconciler) checkMetalNodeBootstrap(ctx context.Context, metalNode *v1beta1.MetalNode) error {
+// checkMetalNodeBootstrap check the bootstrap success sentinel file exists on the metal node
+func checkMetalNodeBootstrap(metalNode *v1beta1.MetalNode) error {
 	host := metalNodeToHost(metalNode)
 	cmd := remote.Command{
 		Cmds: remote.Commands{
 			"sudo cat /run/cluster-api/bootstrap-success.complete",
 		},
 	}
-	errs := remote.Run(host, cmd)
-
-	if len(errs[metalNode.Spec.NodeEndPoint.Host]) != 0 {
+	errs, err := remote.RunOnHost(host[0], cmd)
+	if err != nil {
+		return err
+	}
+	if len(errs) != 0 {
 		return errors.New("metal node bootstrap failed")
 	}
 	return nil
 }
 
-//getBootstrapDataToCmds get bootstrap data from secret and converts to remote.Command
+// getBootstrapDataToCmds get bootstrap data from secret and converts to remote.Command
 func (r *MetalNodeReconciler) getBootstrapDataToCmds(ctx context.Context, metalNode *v1beta1.MetalNode) (*remote.Command, error) {
 	secret := &corev1.Secret{}
-	if err := r.Get(ctx, types.NamespacedName{Name: metalNode.Status.DataSecretName, Namespace: metalNode.Namespace}, secret); err != nil {
+	if err := r.Get(ctx, types.NamespacedName{Name: metalNode.DataSecretName(), Namespace: metalNode.Namespace}, secret); err != nil {
 		return nil, err
 	}
 	config, ok := secret.Data["value"]
@@ -273,6 +318,10 @@ func (r *MetalNodeReconciler) getBootstrapDataToCmds(ctx context.Context, metalN
 	}
 
 	parser := cloudinit.NewBootstrapDataParser()
+	// kubeadm advertises the address of the default route unless the InternalIP is set
+	parser.AdvertiseAddress = metalNode.InternalIP()
+	// Cluster API finds the node of the machine of the metal node by its provider id
+	parser.ProviderID = metalNode.ProviderID()
 
 	cmd, err := parser.Parse(config, format)
 	if err != nil {
@@ -285,11 +334,12 @@ func (r *MetalNodeReconciler) getBootstrapDataToCmds(ctx context.Context, metalN
 func metalNodeToHost(metalNode *v1beta1.MetalNode) []remote.Host {
 	return []remote.Host{
 		{
-			User:     metalNode.Spec.NodeEndPoint.SSHAuth.User,
-			Password: metalNode.Spec.NodeEndPoint.SSHAuth.Password,
-			Address:  metalNode.Spec.NodeEndPoint.Host,
-			Port:     metalNode.Spec.NodeEndPoint.SSHAuth.Port,
-			SSHKey:   metalNode.Spec.NodeEndPoint.SSHAuth.SSHKey,
+			User:      metalNode.Spec.NodeEndPoint.SSHAuth.User,
+			Password:  metalNode.Spec.NodeEndPoint.SSHAuth.Password,
+			Address:   metalNode.Spec.NodeEndPoint.Host,
+			Addresses: metalNode.AddressesOfType(v1beta1.MachineSSHAddress),
+			Port:      metalNode.Spec.NodeEndPoint.SSHAuth.Port,
+			SSHKey:    metalNode.Spec.NodeEndPoint.SSHAuth.SSHKey,
 		},
 	}
 }
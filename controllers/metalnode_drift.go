@@ -0,0 +1,189 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+// provisioningSpec is the part of the spec of a metal node the host is provisioned with, and the generations of the
+// profiles it ran. The versions are left out, they are reinstalled when they change
+type provisioningSpec struct {
+	Host               string                       `json:"host"`
+	Port               int                          `json:"port"`
+	User               string                       `json:"user"`
+	Credentials        string                       `json:"credentials"`
+	NodeName           string                       `json:"nodeName"`
+	ProfileRef         *corev1.LocalObjectReference `json:"profileRef,omitempty"`
+	ProfileGenerations []string                     `json:"profileGenerations,omitempty"`
+	InitializationCmd  remote.Commands              `json:"initializationCmd,omitempty"`
+}
+
+// provisioningHash returns the sha256 of the provisioning spec of the metal node initialized with profile
+func provisioningHash(metalNode *v1beta1.MetalNode, profile *v1beta1.AppliedProfile) string {
+	endpoint := metalNode.Spec.NodeEndPoint
+	spec := provisioningSpec{
+		Host:              endpoint.Host,
+		Port:              endpoint.SSHAuth.Port,
+		User:              endpoint.SSHAuth.User,
+		Credentials:       credentialsHMAC(metalNode),
+		NodeName:          metalNode.Spec.NodeName,
+		ProfileRef:        metalNode.Spec.ProfileRef,
+		InitializationCmd: metalNode.Spec.InitializationCmd,
+	}
+	if profile != nil {
+		spec.ProfileGenerations = profile.Generations
+	}
+	data, _ := json.Marshal(spec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// credentialsHMAC returns the HMAC-SHA256 of the password and the ssh key of the metal node keyed with its uid,
+// the metal nodes sharing the credentials don't share the hash
+func credentialsHMAC(metalNode *v1beta1.MetalNode) string {
+	auth := metalNode.Spec.NodeEndPoint.SSHAuth
+	mac := hmac.New(sha256.New, []byte(metalNode.UID))
+	mac.Write([]byte(auth.Password))
+	mac.Write([]byte{0})
+	mac.Write([]byte(auth.SSHKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// currentProfile returns the profile the metal node would be initialized with, nil if it has no profile.
+// A deleted profile is a drift, it is returned without generations
+func (r *MetalNodeReconciler) currentProfile(ctx context.Context, metalNode *v1beta1.MetalNode) (*v1beta1.AppliedProfile, error) {
+	if metalNode.Spec.ProfileRef == nil {
+		return nil, nil
+	}
+	chain, err := r.profileChain(ctx, metalNode.Namespace, metalNode.Spec.ProfileRef.Name)
+	if apierrors.IsNotFound(err) {
+		return &v1beta1.AppliedProfile{Name: metalNode.Spec.ProfileRef.Name}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return appliedProfile(chain), nil
+}
+
+// reconcileDrift compares the provisioning spec of an initialized metal node with the one its host was provisioned
+// with, the metal node initialized before the hash was recorded takes its current spec. The host is provisioned again
+// if the reprovision annotation is set, only forced if it is bootstrapped: the host is torn down first and the
+// annotation is kept until the teardown succeeded. reprovisioning is true while it tears down or once it moved to PENDING
+func (r *MetalNodeReconciler) reconcileDrift(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (reprovisioning bool, err error) {
+	profile, err := r.currentProfile(ctx, metalNode)
+	if err != nil {
+		l.WithError(err).Errorln("failed to get metal node profile")
+		return false, err
+	}
+	hash := provisioningHash(metalNode, profile)
+	if metalNode.Status.ProvisioningHash == "" {
+		metalNode.Status.ProvisioningHash = hash
+	}
+	drifted := metalNode.Status.ProvisioningHash != hash
+	r.setProvisioningSpecCondition(metalNode, l, drifted)
+
+	value, requested := metalNode.Annotations[v1beta1.ReprovisionAnnotation]
+	if !requested {
+		return false, nil
+	}
+
+	if mayBeBootstrapped(metalNode) {
+		if value != v1beta1.ReprovisionForce {
+			if err := r.removeReprovisionAnnotation(ctx, metalNode, l); err != nil {
+				return false, err
+			}
+			message := "the host is bootstrapped, set the annotation " + v1beta1.ReprovisionAnnotation + "=" +
+				v1beta1.ReprovisionForce + " to provision it again anyway"
+			l.Warnln("reprovision refused: " + message)
+			r.warning(metalNode, ReprovisionRefusedReason, message, nil)
+			return false, nil
+		}
+		if metalNode.Status.Operation == nil {
+			l.Infoln("forced reprovision of the metal node requested, tearing down the host")
+			r.event(metalNode, ReprovisionStartedReason, "forced reprovision requested, tearing down the host", nil)
+		}
+		done, err := r.reconcileTeardown(metalNode, l)
+		if err != nil || !done {
+			return true, err
+		}
+	}
+
+	if err := r.removeReprovisionAnnotation(ctx, metalNode, l); err != nil {
+		return false, err
+	}
+	l.Infoln("reprovision of the metal node requested")
+	r.event(metalNode, ReprovisionStartedReason, "reprovision requested, the host is initialized again", nil)
+	metalNode.Status.Bootstrapped = false
+	metalNode.Status.BootstrappedWith = ""
+	metalNode.Status.Ready = false
+	metalNode.Status.FailureCount = 0
+	metalNode.Status.NextRetryTime = nil
+	setInitializationState(metalNode, PENDING, "reprovision requested")
+	return true, nil
+}
+
+// removeReprovisionAnnotation removes the reprovision annotation of the metal node once handled
+func (r *MetalNodeReconciler) removeReprovisionAnnotation(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) error {
+	// status is not part of the update, keep it and restore it after
+	status := metalNode.Status.DeepCopy()
+	delete(metalNode.Annotations, v1beta1.ReprovisionAnnotation)
+	if err := r.Update(ctx, metalNode); err != nil {
+		l.WithError(err).Errorln("failed to remove reprovision annotation")
+		return err
+	}
+	metalNode.Status = *status
+	return nil
+}
+
+// setProvisioningSpecCondition sets the ProvisioningSpecMatched condition, a warning is emitted once the drift is detected
+func (r *MetalNodeReconciler) setProvisioningSpecCondition(metalNode *v1beta1.MetalNode, l log.Logger, drifted bool) {
+	if !drifted {
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.ProvisioningSpecMatchedCondition,
+			Status:  metav1.ConditionTrue,
+			Reason:  v1beta1.ProvisioningSpecMatchedReason,
+			Message: "the host was provisioned with the current spec",
+		})
+		return
+	}
+	message := "the provisioning spec changed since the host was provisioned, set the annotation " +
+		v1beta1.ReprovisionAnnotation + " to provision it again"
+	if !meta.IsStatusConditionFalse(metalNode.Status.Conditions, v1beta1.ProvisioningSpecMatchedCondition) {
+		l.Warnln("metal node provisioning spec drifted")
+		r.warning(metalNode, DriftDetectedReason, message, nil)
+	}
+	meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.ProvisioningSpecMatchedCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  v1beta1.ProvisioningSpecDriftedReason,
+		Message: message,
+	})
+}
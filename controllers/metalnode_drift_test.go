@@ -0,0 +1,256 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestProvisioningHash(t *testing.T) {
+	newMetalNode := func() *v1beta1.MetalNode {
+		mn := &v1beta1.MetalNode{ObjectMeta: metav1.ObjectMeta{Name: "node-0", UID: "uid-0"}}
+		mn.Spec.NodeEndPoint = v1beta1.Endpoint{Host: "10.0.0.1", SSHAuth: v1beta1.Auth{User: "root", Password: "secret", Port: 22}}
+		return mn
+	}
+	profile := &v1beta1.AppliedProfile{Name: "gpu", Generations: []string{"gpu@1", "base@1"}}
+	tests := []struct {
+		name      string
+		mutate    func(mn *v1beta1.MetalNode)
+		profile   *v1beta1.AppliedProfile
+		wantDrift bool
+	}{
+		{name: "unchanged", mutate: func(mn *v1beta1.MetalNode) {}},
+		{name: "host", mutate: func(mn *v1beta1.MetalNode) { mn.Spec.NodeEndPoint.Host = "10.0.0.2" }, wantDrift: true},
+		{name: "port", mutate: func(mn *v1beta1.MetalNode) { mn.Spec.NodeEndPoint.SSHAuth.Port = 2222 }, wantDrift: true},
+		{name: "user", mutate: func(mn *v1beta1.MetalNode) { mn.Spec.NodeEndPoint.SSHAuth.User = "admin" }, wantDrift: true},
+		{name: "node name", mutate: func(mn *v1beta1.MetalNode) { mn.Spec.NodeName = "worker-0" }, wantDrift: true},
+		{name: "node name defaulted", mutate: func(mn *v1beta1.MetalNode) { mn.Spec.NodeName = "node-0" }, wantDrift: true},
+		{
+			name:      "profile",
+			mutate:    func(mn *v1beta1.MetalNode) { mn.Spec.ProfileRef = &corev1.LocalObjectReference{Name: "gpu"} },
+			profile:   profile,
+			wantDrift: true,
+		},
+		{
+			name:      "initialization commands",
+			mutate:    func(mn *v1beta1.MetalNode) { mn.Spec.InitializationCmd = remote.Commands{"true"} },
+			wantDrift: true,
+		},
+		{name: "password", mutate: func(mn *v1beta1.MetalNode) { mn.Spec.NodeEndPoint.SSHAuth.Password = "rotated" }, wantDrift: true},
+		{name: "ssh key", mutate: func(mn *v1beta1.MetalNode) { mn.Spec.NodeEndPoint.SSHAuth.SSHKey = "key" }, wantDrift: true},
+		{name: "addresses", mutate: func(mn *v1beta1.MetalNode) {
+			mn.Spec.Addresses = []v1beta1.MachineAddress{{Type: v1beta1.MachineSSHAddress, Address: "10.1.0.1"}}
+		}},
+	}
+	hash := provisioningHash(newMetalNode(), nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mn := newMetalNode()
+			tt.mutate(mn)
+			if drifted := provisioningHash(mn, tt.profile) != hash; drifted != tt.wantDrift {
+				t.Errorf("provisioningHash() drifted = %v, want %v", drifted, tt.wantDrift)
+			}
+		})
+	}
+
+	// the profile generations drift when the profile or one it extends changes
+	mn := newMetalNode()
+	mn.Spec.ProfileRef = &corev1.LocalObjectReference{Name: "gpu"}
+	updated := &v1beta1.AppliedProfile{Name: "gpu", Generations: []string{"gpu@1", "base@2"}}
+	if provisioningHash(mn, profile) == provisioningHash(mn, updated) {
+		t.Error("provisioningHash() did not drift with the generation of an extended profile")
+	}
+	// the metal nodes sharing the credentials don't share their hmac
+	other := newMetalNode()
+	other.UID = "uid-1"
+	if credentialsHMAC(newMetalNode()) == credentialsHMAC(other) {
+		t.Error("credentialsHMAC() is the same for two metal nodes")
+	}
+}
+
+func TestReconcileDrift(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		bootstrapped bool
+		// profile is the generation of the profile the host was provisioned with, the profile is at its second one
+		profile       int64
+		wantState     v1beta1.InitializationState
+		wantCondition metav1.ConditionStatus
+		wantEvent     string
+	}{
+		{name: "drift detected", wantState: SUCCESS, wantCondition: metav1.ConditionFalse, wantEvent: DriftDetectedReason},
+		{
+			name:          "profile updated",
+			profile:       1,
+			wantState:     SUCCESS,
+			wantCondition: metav1.ConditionFalse,
+			wantEvent:     DriftDetectedReason,
+		},
+		{name: "profile unchanged", profile: 2, wantState: SUCCESS, wantCondition: metav1.ConditionTrue},
+		{
+			name:          "reprovision",
+			annotations:   map[string]string{v1beta1.ReprovisionAnnotation: ""},
+			wantState:     PENDING,
+			wantCondition: metav1.ConditionFalse,
+			wantEvent:     ReprovisionStartedReason,
+		},
+		{
+			name:          "reprovision of a bootstrapped host refused",
+			annotations:   map[string]string{v1beta1.ReprovisionAnnotation: ""},
+			bootstrapped:  true,
+			wantState:     SUCCESS,
+			wantCondition: metav1.ConditionFalse,
+			wantEvent:     ReprovisionRefusedReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := testMetalNode("node-0")
+			metalNode.Annotations = tt.annotations
+			if tt.bootstrapped {
+				metalNode.Spec.ClusterName = "cluster"
+				metalNode.Spec.BootstrapDataSecretRef = &corev1.LocalObjectReference{Name: "worker-0"}
+				markBootstrapped(metalNode)
+			}
+			metalNode.Status.InitializationState = SUCCESS
+			// provisioned with another spec
+			metalNode.Status.ProvisioningHash = "previous"
+			var objects []client.Object
+			if tt.profile != 0 {
+				profile := &v1beta1.MetalNodeProfile{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "base", Generation: 2}}
+				metalNode.Spec.ProfileRef = &corev1.LocalObjectReference{Name: profile.Name}
+				metalNode.Status.ProvisioningHash = provisioningHash(metalNode,
+					&v1beta1.AppliedProfile{Name: "base", Generations: []string{fmt.Sprintf("base@%d", tt.profile)}})
+				objects = append(objects, profile)
+			}
+			r := newTestReconciler(t, append(objects, metalNode)...)
+
+			if _, err := r.Reconcile(context.Background(), testRequest(metalNode)); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			stored := getMetalNode(t, r, metalNode)
+			if stored.Status.InitializationState != tt.wantState {
+				t.Errorf("state = %q, want %q", stored.Status.InitializationState, tt.wantState)
+			}
+			if condition := meta.FindStatusCondition(stored.Status.Conditions, v1beta1.ProvisioningSpecMatchedCondition); condition == nil ||
+				condition.Status != tt.wantCondition {
+				t.Errorf("%s condition = %v, want status %s", v1beta1.ProvisioningSpecMatchedCondition, condition, tt.wantCondition)
+			}
+			if _, ok := stored.Annotations[v1beta1.ReprovisionAnnotation]; ok {
+				t.Error("reprovision annotation not removed")
+			}
+			if stored.Status.Bootstrapped != tt.bootstrapped {
+				t.Errorf("bootstrapped = %v, want %v", stored.Status.Bootstrapped, tt.bootstrapped)
+			}
+			if tt.wantEvent != "" {
+				expectEvent(t, r, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestReconcileForcedReprovision(t *testing.T) {
+	tests := []struct {
+		name             string
+		teardown         func(t *testing.T, r *MetalNodeReconciler, metalNode *v1beta1.MetalNode)
+		wantErr          bool
+		wantState        v1beta1.InitializationState
+		wantBootstrapped bool
+		wantEvent        string
+	}{
+		{
+			name: "teardown started",
+			teardown: func(t *testing.T, r *MetalNodeReconciler, metalNode *v1beta1.MetalNode) {
+				// the teardown of the host never reachable keeps running until the test ends
+				stop := make(chan struct{})
+				t.Cleanup(func() { close(stop) })
+				if err := r.startOperation(metalNode, opTeardown, func() (operation.Result, error) {
+					<-stop
+					return operation.Result{}, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantState:        SUCCESS,
+			wantBootstrapped: true,
+		},
+		{
+			name: "teardown failed",
+			teardown: func(t *testing.T, r *MetalNodeReconciler, metalNode *v1beta1.MetalNode) {
+				finishOperation(t, r, metalNode, opTeardown, operation.Result{}, errors.New("connection refused"))
+			},
+			wantErr:          true,
+			wantState:        SUCCESS,
+			wantBootstrapped: true,
+			wantEvent:        TeardownFailedReason,
+		},
+		{
+			name: "torn down",
+			teardown: func(t *testing.T, r *MetalNodeReconciler, metalNode *v1beta1.MetalNode) {
+				finishOperation(t, r, metalNode, opTeardown, operation.Result{}, nil)
+			},
+			wantState: PENDING,
+			wantEvent: ReprovisionStartedReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := testMetalNode("node-0")
+			metalNode.Annotations = map[string]string{v1beta1.ReprovisionAnnotation: v1beta1.ReprovisionForce}
+			metalNode.Spec.ClusterName = "cluster"
+			metalNode.Spec.BootstrapDataSecretRef = &corev1.LocalObjectReference{Name: "worker-0"}
+			r := newTestReconciler(t, metalNode)
+			markBootstrapped(metalNode)
+			metalNode.Status.InitializationState = SUCCESS
+			metalNode.Status.ProvisioningHash = provisioningHash(metalNode, nil)
+			tt.teardown(t, r, metalNode)
+			if err := r.Status().Update(context.Background(), metalNode); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := r.Reconcile(context.Background(), testRequest(metalNode)); (err != nil) != tt.wantErr {
+				t.Fatalf("Reconcile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			stored := getMetalNode(t, r, metalNode)
+			if stored.Status.InitializationState != tt.wantState {
+				t.Errorf("state = %q, want %q", stored.Status.InitializationState, tt.wantState)
+			}
+			if stored.Status.Bootstrapped != tt.wantBootstrapped {
+				t.Errorf("bootstrapped = %v, want %v", stored.Status.Bootstrapped, tt.wantBootstrapped)
+			}
+			// the annotation is kept until the host is torn down
+			if _, ok := stored.Annotations[v1beta1.ReprovisionAnnotation]; ok != (tt.wantState == SUCCESS) {
+				t.Errorf("reprovision annotation kept = %v, want %v", ok, tt.wantState == SUCCESS)
+			}
+			if tt.wantEvent != "" {
+				expectEvent(t, r, tt.wantEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Reasons of the events emitted for a MetalNode
+const (
+	ConnectionEstablishedReason = "ConnectionEstablished"
+	ConnectionFailedReason      = "ConnectionFailed"
+	UploadSucceededReason       = "UploadSucceeded"
+	UploadFailedReason          = "UploadFailed"
+
+	InitializationStartedReason   = "InitializationStarted"
+	InitializationSucceededReason = "InitializationSucceeded"
+	InitializationFailedReason    = "InitializationFailed"
+	InitializationRetryReason     = "InitializationRetry"
+	InterruptedReason             = "Interrupted"
+	CheckFailedReason             = "CheckFailed"
+
+	BootstrapStartedReason   = "BootstrapStarted"
+	BootstrapSucceededReason = "BootstrapSucceeded"
+	BootstrapFailedReason    = "BootstrapFailed"
+	AdoptedReason            = "Adopted"
+	AdoptionFailedReason     = "AdoptionFailed"
+	UnallocatedHostReason    = "UnallocatedHost"
+	NotCompliantReason       = "NotCompliant"
+
+	InventoryGatheredReason = "InventoryGathered"
+	InventoryFailedReason   = "InventoryFailed"
+	UnsupportedOSReason     = "UnsupportedOS"
+	PreflightFailedReason   = "PreflightFailed"
+	DuplicateHostReason     = "DuplicateHost"
+	ProfileInvalidReason    = "ProfileInvalid"
+
+	ClaimBoundReason    = "Bound"
+	ClaimReleasedReason = "Released"
+	ClaimMissingReason  = "ClaimMissing"
+
+	UpgradeStartedReason = "UpgradeStarted"
+	UpgradeBlockedReason = "UpgradeBlocked"
+
+	ResetReason             = "Reset"
+	TeardownStartedReason   = "TeardownStarted"
+	TeardownSucceededReason = "TeardownSucceeded"
+	TeardownFailedReason    = "TeardownFailed"
+	TeardownSkippedReason   = "TeardownSkipped"
+
+	PausedReason             = "Paused"
+	ResumedReason            = "Resumed"
+	MaintenanceStartedReason = "MaintenanceStarted"
+	MaintenanceEndedReason   = "MaintenanceEnded"
+
+	DriftDetectedReason      = "DriftDetected"
+	ReprovisionStartedReason = "ReprovisionStarted"
+	ReprovisionRefusedReason = "ReprovisionRefused"
+)
+
+// event emits a Normal event, with an excerpt of stderr if any
+func (r *MetalNodeReconciler) event(metalNode *v1beta1.MetalNode, reason, message string, stderr []string) {
+	r.Recorder.Event(metalNode, corev1.EventTypeNormal, reason, withExcerpt(message, stderr))
+}
+
+// warning emits a Warning event, with an excerpt of stderr if any
+func (r *MetalNodeReconciler) warning(metalNode *v1beta1.MetalNode, reason, message string, stderr []string) {
+	r.Recorder.Event(metalNode, corev1.EventTypeWarning, reason, withExcerpt(message, stderr))
+}
+
+// connectionEvents emits the events telling if the remote operation could connect to the host and upload its files
+func (r *MetalNodeReconciler) connectionEvents(metalNode *v1beta1.MetalNode, err error, uploaded bool) {
+	var connErr *remote.ConnectionError
+	if errors.As(err, &connErr) {
+		r.warning(metalNode, ConnectionFailedReason, connErr.Error(), nil)
+		return
+	}
+	r.event(metalNode, ConnectionEstablishedReason, "connected to "+metalNode.Spec.NodeEndPoint.Host, nil)
+
+	var uploadErr *remote.UploadError
+	if errors.As(err, &uploadErr) {
+		r.warning(metalNode, UploadFailedReason, uploadErr.Error(), nil)
+		return
+	}
+	if uploaded {
+		r.event(metalNode, UploadSucceededReason, "uploaded the files to the host", nil)
+	}
+}
+
+func withExcerpt(message string, stderr []string) string {
+	if excerpt := stderrExcerpt(stderr); excerpt != "" {
+		return message + ", stderr: " + excerpt
+	}
+	return message
+}
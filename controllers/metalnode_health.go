@@ -0,0 +1,330 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+const (
+	opProbe = "probe"
+
+	// maxDiskUsagePercent is the disk usage of / or /var/lib from which the host is under disk pressure
+	maxDiskUsagePercent = 90
+
+	// minMemoryAvailableKB is the available memory under which the host is under memory pressure,
+	// the same as the default hard eviction threshold of kubelet
+	minMemoryAvailableKB = 100 * 1024
+)
+
+const (
+	probeContainerRuntimeCmd = "sudo crictl version"
+	probeKubeletCmd          = "systemctl is-active kubelet"
+	probeDiskCmd             = "df -P / /var/lib | awk 'NR>1 {print $6, $5}'"
+	probeMemoryCmd           = "cat /proc/meminfo"
+	probeKubeletVersionCmd   = "kubelet --version"
+	probeKubeadmVersionCmd   = "kubeadm version -o short"
+)
+
+// probeResult is the output of a health probe
+type probeResult struct {
+	// unreachable is set when the host can't be connected, nothing else is set then
+	unreachable error
+
+	containerRuntime error
+	kubelet          error
+	// diskUsage is the usage percent of the mount points
+	diskUsage map[string]int
+	// memoryAvailableKB is -1 when it can't be read
+	memoryAvailableKB int64
+	versions          v1beta1.InstalledVersions
+}
+
+// reconcileHealth probes the health of an initialized metal node every HealthCheckInterval
+func (r *MetalNodeReconciler) reconcileHealth(metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	if r.HealthCheckInterval <= 0 {
+		return ctrl.Result{}, nil
+	}
+
+	op, tracked := r.trackedOperation(metalNode)
+	if tracked && op.Name == opProbe {
+		if op.Phase != operation.Done {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+		metalNode.Status.Operation = nil
+		now := metav1.Now()
+		metalNode.Status.LastHealthCheckTime = &now
+		if result, ok := op.Output.(probeResult); ok {
+			r.applyProbeResult(metalNode, result, l)
+		}
+		return ctrl.Result{RequeueAfter: r.HealthCheckInterval}, nil
+	}
+	if !tracked && metalNode.Status.Operation != nil {
+		// a probe lost by a previous controller, just probe again
+		metalNode.Status.Operation = nil
+	}
+
+	if last := metalNode.Status.LastHealthCheckTime; last != nil {
+		if wait := r.HealthCheckInterval - time.Since(last.Time); wait > 0 {
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+
+	node := metalNode.DeepCopy()
+	if err := r.startOperation(metalNode, opProbe, func() (operation.Result, error) {
+		return operation.Result{Output: probeMetalNode(node)}, nil
+	}); err != nil {
+		l.WithError(err).Warnln("failed to start metal node health probe")
+	}
+	return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+}
+
+// probeMetalNode checks the host of the metal node is reachable, its container runtime and kubelet are running,
+// it has disk and memory left, and its packages are installed
+func probeMetalNode(metalNode *v1beta1.MetalNode) probeResult {
+	result := probeResult{memoryAvailableKB: -1}
+	results, err := remote.Exec(metalNodeToHost(metalNode)[0],
+		probeContainerRuntimeCmd,
+		probeKubeletCmd,
+		probeDiskCmd,
+		probeMemoryCmd,
+		probeKubeletVersionCmd,
+		probeKubeadmVersionCmd,
+	)
+	if err != nil {
+		result.unreachable = err
+		return result
+	}
+
+	runtime, kubelet, disk, memory, kubeletVersion, kubeadmVersion := results[0], results[1], results[2], results[3], results[4], results[5]
+
+	result.containerRuntime = resultError(runtime)
+	result.kubelet = resultError(kubelet)
+	result.diskUsage = parseDiskUsage(disk.Stdout)
+	if memory.Err == nil {
+		result.memoryAvailableKB = parseMeminfo(memory.Stdout, "MemAvailable:")
+	}
+	result.versions = parseInstalledVersions(kubeletVersion, kubeadmVersion, runtime)
+	return result
+}
+
+// applyProbeResult sets the health conditions of the metal node and emits an event for each condition changed
+func (r *MetalNodeReconciler) applyProbeResult(metalNode *v1beta1.MetalNode, result probeResult, l log.Logger) {
+	var problems []string
+	check := func(conditionType string, healthy bool, status metav1.ConditionStatus, reason, message string) {
+		if !healthy {
+			problems = append(problems, message)
+		}
+		r.setHealthCondition(metalNode, conditionType, healthy, metav1.Condition{
+			Type:    conditionType,
+			Status:  status,
+			Reason:  reason,
+			Message: message,
+		})
+	}
+
+	if result.unreachable != nil {
+		message := "host is unreachable: " + result.unreachable.Error()
+		check(v1beta1.ReachableCondition, false, metav1.ConditionFalse, v1beta1.ProbeFailedReason, message)
+		for _, conditionType := range []string{
+			v1beta1.ContainerRuntimeReadyCondition,
+			v1beta1.KubeletReadyCondition,
+			v1beta1.DiskPressureCondition,
+			v1beta1.MemoryPressureCondition,
+			v1beta1.PackagesInstalledCondition,
+		} {
+			if meta.FindStatusCondition(metalNode.Status.Conditions, conditionType) != nil {
+				meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+					Type:    conditionType,
+					Status:  metav1.ConditionUnknown,
+					Reason:  v1beta1.HostUnreachableReason,
+					Message: "host is unreachable",
+				})
+			}
+		}
+	} else {
+		check(v1beta1.ReachableCondition, true, metav1.ConditionTrue, v1beta1.ProbeSucceededReason, "host is reachable")
+
+		if result.containerRuntime != nil {
+			check(v1beta1.ContainerRuntimeReadyCondition, false, metav1.ConditionFalse, v1beta1.ProbeFailedReason,
+				"container runtime is not running: "+result.containerRuntime.Error())
+		} else {
+			check(v1beta1.ContainerRuntimeReadyCondition, true, metav1.ConditionTrue, v1beta1.ProbeSucceededReason,
+				"container runtime is running")
+		}
+
+		// kubelet crash loops until the node is bootstrapped, it is only checked after
+		if metalNode.Status.Bootstrapped {
+			if result.kubelet != nil {
+				check(v1beta1.KubeletReadyCondition, false, metav1.ConditionFalse, v1beta1.ProbeFailedReason,
+					"kubelet is not running: "+result.kubelet.Error())
+			} else {
+				check(v1beta1.KubeletReadyCondition, true, metav1.ConditionTrue, v1beta1.ProbeSucceededReason, "kubelet is running")
+			}
+		} else {
+			meta.RemoveStatusCondition(&metalNode.Status.Conditions, v1beta1.KubeletReadyCondition)
+		}
+
+		var full []string
+		for mountPoint, usage := range result.diskUsage {
+			if usage >= maxDiskUsagePercent {
+				full = append(full, fmt.Sprintf("%s is %d%% full", mountPoint, usage))
+			}
+		}
+		if len(full) != 0 {
+			check(v1beta1.DiskPressureCondition, false, metav1.ConditionTrue, v1beta1.ProbeFailedReason, strings.Join(full, ", "))
+		} else {
+			check(v1beta1.DiskPressureCondition, true, metav1.ConditionFalse, v1beta1.ProbeSucceededReason, "host has enough disk")
+		}
+
+		if result.memoryAvailableKB >= 0 && result.memoryAvailableKB < minMemoryAvailableKB {
+			check(v1beta1.MemoryPressureCondition, false, metav1.ConditionTrue, v1beta1.ProbeFailedReason,
+				fmt.Sprintf("only %dKi memory available", result.memoryAvailableKB))
+		} else {
+			check(v1beta1.MemoryPressureCondition, true, metav1.ConditionFalse, v1beta1.ProbeSucceededReason, "host has enough memory")
+		}
+
+		if metalNode.Status.InstalledVersions == nil {
+			versions := result.versions
+			metalNode.Status.InstalledVersions = &versions
+		}
+		if drifts := versionDrifts(*metalNode.Status.InstalledVersions, result.versions); len(drifts) != 0 {
+			check(v1beta1.PackagesInstalledCondition, false, metav1.ConditionFalse, v1beta1.ProbeFailedReason, strings.Join(drifts, ", "))
+		} else {
+			check(v1beta1.PackagesInstalledCondition, true, metav1.ConditionTrue, v1beta1.ProbeSucceededReason,
+				"packages are installed with the expected versions")
+		}
+	}
+
+	if len(problems) != 0 {
+		r.setHealthCondition(metalNode, v1beta1.HealthyCondition, false, metav1.Condition{
+			Type:    v1beta1.HealthyCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  v1beta1.UnhealthyReason,
+			Message: strings.Join(problems, "; "),
+		})
+		l.Warnf("metal node is unhealthy: %s", strings.Join(problems, "; "))
+		return
+	}
+	r.setHealthCondition(metalNode, v1beta1.HealthyCondition, true, metav1.Condition{
+		Type:    v1beta1.HealthyCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  v1beta1.HealthyReason,
+		Message: "all health checks passed",
+	})
+}
+
+// setHealthCondition sets the condition and emits an event if its status changed
+func (r *MetalNodeReconciler) setHealthCondition(metalNode *v1beta1.MetalNode, conditionType string, healthy bool, condition metav1.Condition) {
+	previous := meta.FindStatusCondition(metalNode.Status.Conditions, conditionType)
+	meta.SetStatusCondition(&metalNode.Status.Conditions, condition)
+	if previous != nil && previous.Status == condition.Status {
+		return
+	}
+	// a healthy condition showing up for the first time is not worth an event
+	if previous == nil && healthy {
+		return
+	}
+	if healthy {
+		r.Recorder.Event(metalNode, corev1.EventTypeNormal, conditionType, condition.Message)
+		return
+	}
+	r.Recorder.Event(metalNode, corev1.EventTypeWarning, conditionType, condition.Message)
+}
+
+// isHealthy check if the last health check of the metal node did not fail
+func isHealthy(metalNode *v1beta1.MetalNode) bool {
+	return !meta.IsStatusConditionFalse(metalNode.Status.Conditions, v1beta1.HealthyCondition)
+}
+
+// versionDrifts compares the versions found with the versions expected, a version expected but not found is a drift
+func versionDrifts(expected, found v1beta1.InstalledVersions) []string {
+	var drifts []string
+	compare := func(name, expected, found string) {
+		if expected == "" || expected == found {
+			return
+		}
+		if found == "" {
+			drifts = append(drifts, fmt.Sprintf("%s %s is not installed anymore", name, expected))
+			return
+		}
+		drifts = append(drifts, fmt.Sprintf("%s %s is installed, %s expected", name, found, expected))
+	}
+	compare("kubelet", expected.Kubelet, found.Kubelet)
+	compare("kubeadm", expected.Kubeadm, found.Kubeadm)
+	compare("container runtime", expected.ContainerRuntime, found.ContainerRuntime)
+	return drifts
+}
+
+// resultError returns an error with the stderr of the command if it failed
+func resultError(result remote.Result) error {
+	if result.Err == nil {
+		return nil
+	}
+	if stderr := strings.TrimSpace(result.Stderr); stderr != "" {
+		return fmt.Errorf("%v: %s", result.Err, stderr)
+	}
+	return result.Err
+}
+
+// parseDiskUsage parses lines like "/var/lib 42%"
+func parseDiskUsage(out string) map[string]int {
+	usage := make(map[string]int)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(fields[1], "%"))
+		if err != nil {
+			continue
+		}
+		usage[fields[0]] = percent
+	}
+	return usage
+}
+
+// parseMeminfo returns the field of /proc/meminfo in KB, such as MemAvailable:, -1 if it is missing
+func parseMeminfo(meminfo, field string) int64 {
+	scanner := bufio.NewScanner(strings.NewReader(meminfo))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == field {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return -1
+			}
+			return kb
+		}
+	}
+	return -1
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiskUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want map[string]int
+	}{
+		{name: "mount points", out: "/ 42%\n/var/lib 7%\n", want: map[string]int{"/": 42, "/var/lib": 7}},
+		{name: "header and errors skipped", out: "Mounted on Use%\n/ 100%\ndf: /missing: No such file or directory\n", want: map[string]int{"/": 100}},
+		{name: "not a percentage", out: "/ -\n", want: map[string]int{}},
+		{name: "no output", out: "", want: map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseDiskUsage(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDiskUsage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	meminfo := "MemTotal:       16303428 kB\nMemFree:         1023420 kB\nMemAvailable:    9876543 kB\nSwapTotal:             0 kB\n"
+	tests := []struct {
+		name    string
+		meminfo string
+		field   string
+		want    int64
+	}{
+		{name: "total", meminfo: meminfo, field: "MemTotal:", want: 16303428},
+		{name: "available", meminfo: meminfo, field: "MemAvailable:", want: 9876543},
+		{name: "zero", meminfo: meminfo, field: "SwapTotal:", want: 0},
+		{name: "field without colon does not match", meminfo: meminfo, field: "MemTotal", want: -1},
+		{name: "missing field", meminfo: "MemTotal:       16303428 kB\n", field: "MemAvailable:", want: -1},
+		{name: "not a number", meminfo: "MemAvailable:   n/a kB\n", field: "MemAvailable:", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMeminfo(tt.meminfo, tt.field); got != tt.want {
+				t.Errorf("parseMeminfo(%q) = %d, want %d", tt.field, got, tt.want)
+			}
+		})
+	}
+}
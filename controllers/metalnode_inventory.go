@@ -0,0 +1,371 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+const opInventory = "inventory"
+
+// inventoryLabelKeys are the labels owned by the controller
+var inventoryLabelKeys = []string{
+	v1beta1.OSLabel,
+	v1beta1.OSVersionLabel,
+	v1beta1.ArchitectureLabel,
+	v1beta1.CPUCountLabel,
+	v1beta1.MemoryGiBLabel,
+	v1beta1.VirtualizationLabel,
+}
+
+const (
+	inventoryOSReleaseCmd      = "cat /etc/os-release"
+	inventoryKernelCmd         = "uname -r"
+	inventoryArchitectureCmd   = "uname -m"
+	inventoryCPUCountCmd       = "nproc"
+	inventoryCPUModelCmd       = "lscpu"
+	inventoryMemoryCmd         = "cat /proc/meminfo"
+	inventoryDisksCmd          = "lsblk -b -d -n -o NAME,SIZE,ROTA,TYPE"
+	inventoryLinksCmd          = "ip -o link show"
+	inventoryAddressesCmd      = "ip -o addr show"
+	inventoryVirtualizationCmd = "systemd-detect-virt"
+	inventoryHostnameCmd       = "hostname"
+	inventoryProductUUIDCmd    = "sudo cat /sys/class/dmi/id/product_uuid"
+)
+
+// inventoryDue check if the inventory of the metal node was never gathered or is older than the refresh interval
+func (r *MetalNodeReconciler) inventoryDue(metalNode *v1beta1.MetalNode) bool {
+	inventory := metalNode.Status.Inventory
+	if inventory == nil {
+		return true
+	}
+	return r.InventoryRefreshInterval > 0 && time.Since(inventory.CollectionTime.Time) >= r.InventoryRefreshInterval
+}
+
+// reconcileInventory gathers the inventory of the metal node in background, done is true once it was collected
+func (r *MetalNodeReconciler) reconcileInventory(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (done bool, err error) {
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name != opInventory {
+		node := metalNode.DeepCopy()
+		if err := r.startOperation(metalNode, opInventory, func() (operation.Result, error) {
+			inventory, err := gatherInventory(node)
+			return operation.Result{Output: inventory}, err
+		}); err != nil {
+			l.WithError(err).Warnln("failed to start metal node inventory")
+		}
+		return false, nil
+	}
+	if op.Phase != operation.Done {
+		return false, nil
+	}
+
+	metalNode.Status.Operation = nil
+	if op.Err != nil {
+		l.WithError(op.Err).Warnln("failed to gather metal node inventory")
+		r.warning(metalNode, InventoryFailedReason, "failed to gather the inventory: "+op.Err.Error(), nil)
+		return true, nil
+	}
+	inventory, ok := op.Output.(*v1beta1.Inventory)
+	if !ok {
+		return true, nil
+	}
+	if metalNode.Status.Inventory == nil {
+		r.event(metalNode, InventoryGatheredReason, "gathered the inventory of the host", nil)
+	}
+	metalNode.Status.Inventory = inventory
+	return true, r.updateInventoryLabels(ctx, metalNode, l)
+}
+
+// updateInventoryLabels sets the inventory labels of the metal node, the labels of the facts gone are removed
+func (r *MetalNodeReconciler) updateInventoryLabels(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) error {
+	labels := inventoryLabels(metalNode.Status.Inventory)
+	changed := false
+	for _, key := range inventoryLabelKeys {
+		value, ok := labels[key]
+		current, exists := metalNode.Labels[key]
+		if ok != exists || value != current {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	// status is not part of the update, keep it and restore it after
+	status := metalNode.Status.DeepCopy()
+	if metalNode.Labels == nil {
+		metalNode.Labels = make(map[string]string)
+	}
+	for _, key := range inventoryLabelKeys {
+		delete(metalNode.Labels, key)
+	}
+	for key, value := range labels {
+		metalNode.Labels[key] = value
+	}
+	if err := r.Update(ctx, metalNode); err != nil {
+		l.WithError(err).Errorln("failed to update metal node inventory labels")
+		return err
+	}
+	metalNode.Status = *status
+	return nil
+}
+
+// inventoryBefore check if the inventory of the metal node was gathered before t
+func inventoryBefore(metalNode *v1beta1.MetalNode, t *metav1.Time) bool {
+	return t != nil && metalNode.Status.Inventory.CollectionTime.Before(t)
+}
+
+// selectProvisioner selects the provisioner of the os found in the inventory of the metal node
+// and reports it in the OSSupported condition
+func (r *MetalNodeReconciler) selectProvisioner(metalNode *v1beta1.MetalNode, l log.Logger) (*provision.Provisioner, error) {
+	inventory := metalNode.Status.Inventory
+	if inventory == nil || inventoryBefore(metalNode, metalNode.Status.LastTransitionTime) {
+		err := errors.New("failed to detect the os of the host")
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.OSSupportedCondition,
+			Status:  metav1.ConditionUnknown,
+			Reason:  v1beta1.OSUnknownReason,
+			Message: err.Error(),
+		})
+		return nil, err
+	}
+
+	provisioner, err := provision.ForOS(inventory.OS.Distro, inventory.OS.Version)
+	if err != nil {
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.OSSupportedCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  v1beta1.UnsupportedOSReason,
+			Message: err.Error(),
+		})
+		l.WithError(err).Errorln("metal node os is not supported")
+		r.warning(metalNode, UnsupportedOSReason, err.Error(), nil)
+		return nil, err
+	}
+	meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.OSSupportedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  v1beta1.ProvisionerSelectedReason,
+		Message: fmt.Sprintf("initializing %s with the %s provisioner", inventory.OS.PrettyName, provisioner.Name),
+	})
+	return provisioner, nil
+}
+
+// inventoryLabels returns the labels of the key facts of the inventory, the facts which are not valid label values are skipped
+func inventoryLabels(inventory *v1beta1.Inventory) map[string]string {
+	labels := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" && len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+	set(v1beta1.OSLabel, inventory.OS.Distro)
+	set(v1beta1.OSVersionLabel, inventory.OS.Version)
+	set(v1beta1.ArchitectureLabel, inventory.Architecture)
+	if inventory.CPU.Count > 0 {
+		set(v1beta1.CPUCountLabel, strconv.Itoa(inventory.CPU.Count))
+	}
+	if inventory.Memory != nil {
+		// MemTotal is a little lower than the physical memory, round it to the nearest GiB
+		gib := math.Round(float64(inventory.Memory.Value()) / (1 << 30))
+		set(v1beta1.MemoryGiBLabel, strconv.Itoa(int(gib)))
+	}
+	set(v1beta1.VirtualizationLabel, inventory.Virtualization)
+	return labels
+}
+
+// gatherInventory gathers the hardware and os facts of the host of the metal node,
+// the facts which can't be read are left empty
+func gatherInventory(metalNode *v1beta1.MetalNode) (*v1beta1.Inventory, error) {
+	results, err := remote.Exec(metalNodeToHost(metalNode)[0],
+		inventoryOSReleaseCmd,
+		inventoryKernelCmd,
+		inventoryArchitectureCmd,
+		inventoryCPUCountCmd,
+		inventoryCPUModelCmd,
+		inventoryMemoryCmd,
+		inventoryDisksCmd,
+		inventoryLinksCmd,
+		inventoryAddressesCmd,
+		inventoryVirtualizationCmd,
+		inventoryHostnameCmd,
+		inventoryProductUUIDCmd,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := &v1beta1.Inventory{CollectionTime: metav1.Now()}
+	if results[0].Err == nil {
+		inventory.OS = parseOSRelease(results[0].Stdout)
+	}
+	if results[1].Err == nil {
+		inventory.Kernel = strings.TrimSpace(results[1].Stdout)
+	}
+	if results[2].Err == nil {
+		inventory.Architecture = strings.TrimSpace(results[2].Stdout)
+	}
+	if results[3].Err == nil {
+		inventory.CPU.Count, _ = strconv.Atoi(strings.TrimSpace(results[3].Stdout))
+	}
+	if results[4].Err == nil {
+		inventory.CPU.Model = parseCPUModel(results[4].Stdout)
+	}
+	if results[5].Err == nil {
+		if kb := parseMeminfo(results[5].Stdout, "MemTotal:"); kb >= 0 {
+			inventory.Memory = resource.NewQuantity(kb*1024, resource.BinarySI)
+		}
+	}
+	if results[6].Err == nil {
+		inventory.Disks = parseDisks(results[6].Stdout)
+	}
+	if results[7].Err == nil {
+		inventory.NICs = parseNICs(results[7].Stdout, results[8].Stdout)
+	}
+	// systemd-detect-virt exits with 1 when it prints none
+	inventory.Virtualization = strings.TrimSpace(results[9].Stdout)
+	if results[10].Err == nil {
+		inventory.Hostname = strings.TrimSpace(results[10].Stdout)
+	}
+	// the product uuid is not available on some virtual machines
+	if results[11].Err == nil {
+		inventory.ProductUUID = strings.ToLower(strings.TrimSpace(results[11].Stdout))
+	}
+	return inventory, nil
+}
+
+// parseOSRelease parses the ID, VERSION_ID and PRETTY_NAME of /etc/os-release
+func parseOSRelease(out string) v1beta1.OSInfo {
+	var info v1beta1.OSInfo
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"'`)
+		switch kv[0] {
+		case "ID":
+			info.Distro = value
+		case "VERSION_ID":
+			info.Version = value
+		case "PRETTY_NAME":
+			info.PrettyName = value
+		}
+	}
+	return info
+}
+
+// parseCPUModel parses the "Model name:" line of lscpu
+func parseCPUModel(out string) string {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "Model name" {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// parseDisks parses lines like "sda 500107862016 1 disk"
+func parseDisks(out string) []v1beta1.Disk {
+	var disks []v1beta1.Disk
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || fields[3] != "disk" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		disks = append(disks, v1beta1.Disk{
+			Name:       fields[0],
+			Size:       *resource.NewQuantity(size, resource.BinarySI),
+			Rotational: fields[2] == "1",
+		})
+	}
+	return disks
+}
+
+// parseNICs parses the one line outputs of "ip link show" and "ip addr show", the loopback is skipped
+func parseNICs(links, addresses string) []v1beta1.NIC {
+	var nics []v1beta1.NIC
+	index := make(map[string]int)
+
+	scanner := bufio.NewScanner(strings.NewReader(links))
+	for scanner.Scan() {
+		// 2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 ... link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name := strings.TrimSuffix(fields[1], ":")
+		// vlan interfaces are named like eth0.100@eth0
+		if i := strings.Index(name, "@"); i >= 0 {
+			name = name[:i]
+		}
+		nic := v1beta1.NIC{Name: name}
+		for i, field := range fields {
+			if field == "link/loopback" {
+				nic.Name = ""
+				break
+			}
+			if strings.HasPrefix(field, "link/") && i+1 < len(fields) {
+				nic.MAC = fields[i+1]
+			}
+		}
+		if nic.Name == "" {
+			continue
+		}
+		index[nic.Name] = len(nics)
+		nics = append(nics, nic)
+	}
+
+	scanner = bufio.NewScanner(strings.NewReader(addresses))
+	for scanner.Scan() {
+		// 2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		if i, ok := index[fields[1]]; ok {
+			nics[i].IPs = append(nics[i].IPs, fields[3])
+		}
+	}
+	return nics
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want v1beta1.OSInfo
+	}{
+		{
+			name: "quoted values",
+			out:  "NAME=\"CentOS Linux\"\nVERSION=\"7 (Core)\"\nID=\"centos\"\nVERSION_ID=\"7\"\nPRETTY_NAME=\"CentOS Linux 7 (Core)\"\n",
+			want: v1beta1.OSInfo{Distro: "centos", Version: "7", PrettyName: "CentOS Linux 7 (Core)"},
+		},
+		{
+			name: "unquoted values",
+			out:  "PRETTY_NAME=\"Ubuntu 22.04.1 LTS\"\nID=ubuntu\nID_LIKE=debian\nVERSION_ID=\"22.04\"\n",
+			want: v1beta1.OSInfo{Distro: "ubuntu", Version: "22.04", PrettyName: "Ubuntu 22.04.1 LTS"},
+		},
+		{
+			name: "single quotes and equal signs in values",
+			out:  "ID='openEuler'\nVERSION_ID='22.03'\nPRETTY_NAME='openEuler 22.03 (a=b)'\n",
+			want: v1beta1.OSInfo{Distro: "openEuler", Version: "22.03", PrettyName: "openEuler 22.03 (a=b)"},
+		},
+		{
+			name: "garbage",
+			out:  "cat: /etc/os-release: No such file or directory\n",
+			want: v1beta1.OSInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseOSRelease(tt.out); got != tt.want {
+				t.Errorf("parseOSRelease() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNICs(t *testing.T) {
+	tests := []struct {
+		name      string
+		links     string
+		addresses string
+		want      []v1beta1.NIC
+	}{
+		{
+			name: "loopback skipped",
+			links: "1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\\    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00\n" +
+				"2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc fq_codel state UP mode DEFAULT group default qlen 1000\\    link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff\n",
+			addresses: "1: lo    inet 127.0.0.1/8 scope host lo\\       valid_lft forever preferred_lft forever\n" +
+				"2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0\\       valid_lft forever preferred_lft forever\n" +
+				"2: eth0    inet6 fe80::5054:ff:fe12:3456/64 scope link \\       valid_lft forever preferred_lft forever\n",
+			want: []v1beta1.NIC{{Name: "eth0", MAC: "52:54:00:12:34:56", IPs: []string{"10.0.0.5/24", "fe80::5054:ff:fe12:3456/64"}}},
+		},
+		{
+			name:      "vlan interface",
+			links:     "3: eth0.100@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP\\    link/ether 52:54:00:12:34:57 brd ff:ff:ff:ff:ff:ff\n",
+			addresses: "3: eth0.100    inet 192.168.100.5/24 brd 192.168.100.255 scope global eth0.100\n",
+			want:      []v1beta1.NIC{{Name: "eth0.100", MAC: "52:54:00:12:34:57", IPs: []string{"192.168.100.5/24"}}},
+		},
+		{
+			name:      "interface without address",
+			links:     "2: eth1: <BROADCAST,MULTICAST> mtu 1500 qdisc noop state DOWN\\    link/ether 52:54:00:12:34:58 brd ff:ff:ff:ff:ff:ff\n",
+			addresses: "4: docker0    inet 172.17.0.1/16 brd 172.17.255.255 scope global docker0\n",
+			want:      []v1beta1.NIC{{Name: "eth1", MAC: "52:54:00:12:34:58"}},
+		},
+		{
+			name: "no output",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseNICs(tt.links, tt.addresses); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNICs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
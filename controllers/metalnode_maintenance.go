@@ -0,0 +1,80 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+// reconcilePaused only records the metal node is paused in its status, nothing else is reconciled
+func (r *MetalNodeReconciler) reconcilePaused(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	if metalNode.Status.Paused {
+		return ctrl.Result{}, nil
+	}
+	metalNode.Status.Paused = true
+	if err := r.Status().Update(ctx, metalNode); err != nil {
+		l.WithError(err).Errorln("failed to update metal node status")
+		return ctrl.Result{}, err
+	}
+	l.Infoln("metal node is paused, skip reconciling")
+	r.event(metalNode, PausedReason, "metal node is paused", nil)
+	return ctrl.Result{}, nil
+}
+
+// resume clears the paused status of the metal node once its pause annotations are removed
+func (r *MetalNodeReconciler) resume(metalNode *v1beta1.MetalNode, l log.Logger) {
+	if !metalNode.Status.Paused {
+		return
+	}
+	metalNode.Status.Paused = false
+	l.Infoln("metal node is resumed")
+	r.event(metalNode, ResumedReason, "metal node is resumed", nil)
+}
+
+// reconcileMaintenance keeps the metal node in maintenance: the operation running is left to finish,
+// but no remote action is started and the host is not probed, the allocation is kept
+func (r *MetalNodeReconciler) reconcileMaintenance(metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	if meta.IsStatusConditionTrue(metalNode.Status.Conditions, v1beta1.MaintenanceCondition) {
+		return ctrl.Result{}, nil
+	}
+	meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.MaintenanceCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  v1beta1.InMaintenanceReason,
+		Message: "no remote action nor health check runs on the host",
+	})
+	l.Infoln("metal node is in maintenance")
+	r.event(metalNode, MaintenanceStartedReason, "metal node is in maintenance", nil)
+	return ctrl.Result{}, nil
+}
+
+// endMaintenance removes the maintenance condition once the maintenance of the metal node ends
+func (r *MetalNodeReconciler) endMaintenance(metalNode *v1beta1.MetalNode, l log.Logger) {
+	if meta.FindStatusCondition(metalNode.Status.Conditions, v1beta1.MaintenanceCondition) == nil {
+		return
+	}
+	meta.RemoveStatusCondition(&metalNode.Status.Conditions, v1beta1.MaintenanceCondition)
+	l.Infoln("metal node maintenance ended")
+	r.event(metalNode, MaintenanceEndedReason, "metal node maintenance ended", nil)
+}
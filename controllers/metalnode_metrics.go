@@ -0,0 +1,96 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+// metalNodesDesc describes the number of metal nodes by state, ready status and cluster
+var metalNodesDesc = prometheus.NewDesc(
+	"metalnode_nodes",
+	"Number of MetalNodes by initialization state, ready status and cluster.",
+	[]string{"state", "ready", "cluster"},
+	nil,
+)
+
+// metalNodeCollector counts the metal nodes of the cache each time the metrics are scraped
+type metalNodeCollector struct {
+	reader client.Reader
+}
+
+func (c *metalNodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metalNodesDesc
+}
+
+func (c *metalNodeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	metalNodes := &v1beta1.MetalNodeList{}
+	if err := c.reader.List(ctx, metalNodes); err != nil {
+		log.WithError(err).Errorln("failed to list metal nodes for metrics")
+		return
+	}
+
+	type key struct{ state, ready, cluster string }
+	counts := make(map[key]int)
+	for _, metalNode := range metalNodes.Items {
+		state := string(metalNode.Status.InitializationState)
+		if metalNode.Status.InitializationState == PENDING {
+			state = "PENDING"
+		}
+		counts[key{state, strconv.FormatBool(metalNode.Status.Ready), metalNode.Spec.ClusterName}]++
+	}
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(metalNodesDesc, prometheus.GaugeValue, float64(n), k.state, k.ready, k.cluster)
+	}
+}
+
+// registerMetalNodeCollector registers the metal node collector to the controller-runtime metrics registry
+func registerMetalNodeCollector(reader client.Reader) error {
+	err := ctrlmetrics.Registry.Register(&metalNodeCollector{reader: reader})
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		return nil
+	}
+	return err
+}
+
+// observeInitialization records the duration of the initialization which ended with err,
+// from the last time the metal node entered INITIALIZING
+func observeInitialization(metalNode *v1beta1.MetalNode, err error) {
+	transitions := metalNode.Status.Transitions
+	for i := len(transitions) - 1; i >= 0; i-- {
+		if transitions[i].State == INITIALIZING {
+			metrics.InitializationDuration.WithLabelValues(metrics.Result(err)).
+				Observe(time.Since(transitions[i].Time.Time).Seconds())
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// migrateAllocation moves the role, the cluster and the data secret of the metal node from status into spec,
+// where they survive a status wipe or a restore. The fields already set in spec win, the status ones are cleared
+// once spec is updated, so the metal nodes allocated by writing status, as before, are migrated too
+func (r *MetalNodeReconciler) migrateAllocation(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) error {
+	if len(metalNode.Status.Role) == 0 && metalNode.Status.RefCluster == "" && metalNode.Status.DataSecretName == "" {
+		return nil
+	}
+
+	changed := false
+	if len(metalNode.Spec.Roles) == 0 && len(metalNode.Status.Role) != 0 {
+		metalNode.Spec.Roles = metalNode.Status.Role
+		changed = true
+	}
+	if metalNode.Spec.ClusterName == "" && metalNode.Status.RefCluster != "" {
+		metalNode.Spec.ClusterName = metalNode.Status.RefCluster
+		changed = true
+	}
+	if metalNode.Spec.BootstrapDataSecretRef == nil && metalNode.Status.DataSecretName != "" {
+		metalNode.Spec.BootstrapDataSecretRef = &corev1.LocalObjectReference{Name: metalNode.Status.DataSecretName}
+		changed = true
+	}
+	if changed {
+		status := metalNode.Status.DeepCopy()
+		if err := r.Update(ctx, metalNode); err != nil {
+			l.WithError(err).Errorln("failed to migrate metal node allocation to spec")
+			return err
+		}
+		metalNode.Status = *status
+		l.Infoln("migrated metal node allocation from status to spec")
+	}
+
+	// the status is updated when the reconcile ends
+	metalNode.Status.Role = nil
+	metalNode.Status.RefCluster = ""
+	metalNode.Status.DataSecretName = ""
+	return nil
+}
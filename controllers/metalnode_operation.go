@@ -0,0 +1,68 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	opInitialize = "initialize"
+	opCheck      = "check"
+	opBootstrap  = "bootstrap"
+
+	// operationPollInterval is how often a running operation is polled
+	operationPollInterval = 10 * time.Second
+)
+
+// startOperation runs fn in background as the operation name of the metal node and records it in status,
+// if the same operation is still running from a previous reconcile, it is recorded instead
+func (r *MetalNodeReconciler) startOperation(metalNode *v1beta1.MetalNode, name string, fn operation.Func) error {
+	op, started := r.Operations.Start(operationKey(metalNode), name, fn)
+	if !started && op.Name != name {
+		return errors.Errorf("operation %s is still running", op.Name)
+	}
+	metalNode.Status.Operation = &v1beta1.OperationStatus{
+		ID:        op.ID,
+		Name:      op.Name,
+		StartTime: metav1.NewTime(op.StartTime),
+	}
+	return nil
+}
+
+// trackedOperation returns the operation recorded in the metal node status,
+// tracked is false if this controller does not know it, e.g. it was started by a previous leader
+func (r *MetalNodeReconciler) trackedOperation(metalNode *v1beta1.MetalNode) (op operation.Operation, tracked bool) {
+	if metalNode.Status.Operation == nil {
+		return op, false
+	}
+	op, ok := r.Operations.Get(operationKey(metalNode))
+	if !ok || op.ID != metalNode.Status.Operation.ID {
+		return op, false
+	}
+	return op, true
+}
+
+func operationKey(metalNode *v1beta1.MetalNode) string {
+	return types.NamespacedName{Namespace: metalNode.Namespace, Name: metalNode.Name}.String()
+}
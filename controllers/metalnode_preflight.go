@@ -0,0 +1,426 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/git-czy/cluster-api-metalnode/utils"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+const opPreflight = "preflight"
+
+const (
+	preflightSwapsCmd       = "cat /proc/swaps"
+	preflightMeminfoCmd     = "cat /proc/meminfo"
+	preflightPortsCmd       = "ss -tln"
+	preflightTimeSyncCmd    = "timedatectl status"
+	preflightBrNetfilterCmd = "modinfo br_netfilter || test -d /sys/module/br_netfilter"
+	preflightDiskCmd        = "df -Pk /var/lib | awk 'NR>1 {print $4}'"
+)
+
+// the minimum requirements of kubeadm, and the room for the packages and the images in /var/lib
+var (
+	preflightMinCPUs   = 2
+	preflightMinMemory = resource.MustParse("1700Mi")
+	preflightMinVarLib = resource.MustParse("10Gi")
+)
+
+// preflightPorts are the ports of the apiserver, kubelet and etcd, which must be free
+var preflightPorts = []int{6443, 10250, 2379, 2380}
+
+// reconcilePreflight runs the preflight checks of the metal node in background and records them in status,
+// done is true once they were run and passed is false if one of them failed
+func (r *MetalNodeReconciler) reconcilePreflight(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (done, passed bool, err error) {
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name != opPreflight {
+		node := metalNode.DeepCopy()
+		if err := r.startOperation(metalNode, opPreflight, func() (operation.Result, error) {
+			results, err := remote.Exec(metalNodeToHost(node)[0],
+				preflightSwapsCmd,
+				preflightMeminfoCmd,
+				preflightPortsCmd,
+				preflightTimeSyncCmd,
+				preflightBrNetfilterCmd,
+				preflightDiskCmd,
+			)
+			return operation.Result{Output: results}, err
+		}); err != nil {
+			l.WithError(err).Warnln("failed to start metal node preflight checks")
+		}
+		return false, false, nil
+	}
+	if op.Phase != operation.Done {
+		return false, false, nil
+	}
+
+	metalNode.Status.Operation = nil
+	if op.Err != nil {
+		l.WithError(op.Err).Errorln("failed to run metal node preflight checks")
+		r.connectionEvents(metalNode, op.Err, false)
+		setPreflightCondition(metalNode, false, "the preflight checks could not run: "+op.Err.Error())
+		return true, false, nil
+	}
+	results, ok := op.Output.([]remote.Result)
+	if !ok {
+		return true, false, nil
+	}
+
+	others, err := r.otherMetalNodes(ctx, metalNode)
+	if err != nil {
+		l.WithError(err).Errorln("failed to list metal nodes")
+		return false, false, err
+	}
+	checks := []v1beta1.PreflightCheck{
+		checkCPU(metalNode.Status.Inventory),
+		checkMemory(metalNode.Status.Inventory),
+		checkSwap(results[0], results[1]),
+		checkPorts(results[2]),
+		checkUniqueHostname(metalNode, others),
+		checkUniqueMAC(metalNode, others),
+		checkUniqueProductUUID(metalNode, others),
+		checkTimeSync(results[3]),
+		checkBrNetfilter(results[4]),
+		checkDisk(results[5]),
+		checkNodeIP(metalNode),
+	}
+	metalNode.Status.Preflight = checks
+
+	var failures []string
+	for _, check := range checks {
+		if check.Result == v1beta1.PreflightFailed {
+			failures = append(failures, check.Name+": "+check.Message)
+		}
+	}
+	if len(failures) != 0 {
+		message := "preflight checks failed: " + strings.Join(failures, "; ")
+		l.Errorln(message)
+		r.warning(metalNode, PreflightFailedReason, message, nil)
+		setPreflightCondition(metalNode, false, message)
+		return true, false, nil
+	}
+	setPreflightCondition(metalNode, true, "the preflight checks passed")
+	return true, true, nil
+}
+
+func setPreflightCondition(metalNode *v1beta1.MetalNode, passed bool, message string) {
+	condition := metav1.Condition{
+		Type:    v1beta1.PreflightPassedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  v1beta1.PreflightPassedReason,
+		Message: message,
+	}
+	if !passed {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = v1beta1.PreflightFailedReason
+	}
+	meta.SetStatusCondition(&metalNode.Status.Conditions, condition)
+}
+
+// otherMetalNodes lists the metal nodes of all namespaces but metalNode
+func (r *MetalNodeReconciler) otherMetalNodes(ctx context.Context, metalNode *v1beta1.MetalNode) ([]v1beta1.MetalNode, error) {
+	list := &v1beta1.MetalNodeList{}
+	if err := r.List(ctx, list); err != nil {
+		return nil, err
+	}
+	others := make([]v1beta1.MetalNode, 0, len(list.Items))
+	for _, item := range list.Items {
+		if item.UID != metalNode.UID {
+			others = append(others, item)
+		}
+	}
+	return others, nil
+}
+
+// duplicateHost returns the oldest other metal node sharing an address identifying the host of the metal node if it
+// was created before, the webhook misses the metal nodes created concurrently. The first metal node keeps the host
+func (r *MetalNodeReconciler) duplicateHost(ctx context.Context, metalNode *v1beta1.MetalNode) (*v1beta1.MetalNode, error) {
+	others, err := r.otherMetalNodes(ctx, metalNode)
+	if err != nil {
+		return nil, err
+	}
+	keys := metalNode.HostKeys()
+	var first *v1beta1.MetalNode
+	for i := range others {
+		other := &others[i]
+		if !sharesHostKey(keys, other.HostKeys()) || !createdBefore(other, metalNode) {
+			continue
+		}
+		if first == nil || createdBefore(other, first) {
+			first = other
+		}
+	}
+	return first, nil
+}
+
+func sharesHostKey(keys, others []string) bool {
+	for _, key := range others {
+		if utils.SliceContainsString(keys, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// createdBefore orders the metal nodes by creation, then by namespace and name as the timestamps have a second precision
+func createdBefore(a, b *v1beta1.MetalNode) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+func preflightCheck(name string, result v1beta1.PreflightResult, format string, args ...interface{}) v1beta1.PreflightCheck {
+	return v1beta1.PreflightCheck{Name: name, Result: result, Message: fmt.Sprintf(format, args...)}
+}
+
+func checkCPU(inventory *v1beta1.Inventory) v1beta1.PreflightCheck {
+	if inventory == nil || inventory.CPU.Count == 0 {
+		return preflightCheck(v1beta1.PreflightCPU, v1beta1.PreflightWarning, "the number of CPUs is unknown")
+	}
+	if inventory.CPU.Count < preflightMinCPUs {
+		return preflightCheck(v1beta1.PreflightCPU, v1beta1.PreflightFailed,
+			"%d CPUs, at least %d are required", inventory.CPU.Count, preflightMinCPUs)
+	}
+	return preflightCheck(v1beta1.PreflightCPU, v1beta1.PreflightPassed, "%d CPUs", inventory.CPU.Count)
+}
+
+func checkMemory(inventory *v1beta1.Inventory) v1beta1.PreflightCheck {
+	if inventory == nil || inventory.Memory == nil {
+		return preflightCheck(v1beta1.PreflightMemory, v1beta1.PreflightWarning, "the memory is unknown")
+	}
+	if inventory.Memory.Cmp(preflightMinMemory) < 0 {
+		return preflightCheck(v1beta1.PreflightMemory, v1beta1.PreflightFailed,
+			"%s of memory, at least %s is required", inventory.Memory, &preflightMinMemory)
+	}
+	return preflightCheck(v1beta1.PreflightMemory, v1beta1.PreflightPassed, "%s of memory", inventory.Memory)
+}
+
+// checkSwap passes if swap is disabled, or the swap used fits in the memory available so swapoff can disable it
+func checkSwap(swaps, meminfo remote.Result) v1beta1.PreflightCheck {
+	if swaps.Err != nil {
+		return preflightCheck(v1beta1.PreflightSwap, v1beta1.PreflightWarning, "the swap could not be read: %v", swaps.Err)
+	}
+	enabled, used := parseSwaps(swaps.Stdout)
+	if !enabled {
+		return preflightCheck(v1beta1.PreflightSwap, v1beta1.PreflightPassed, "swap is disabled")
+	}
+	available := int64(-1)
+	if meminfo.Err == nil {
+		available = parseMeminfo(meminfo.Stdout, "MemAvailable:")
+	}
+	if available >= 0 && used > available {
+		return preflightCheck(v1beta1.PreflightSwap, v1beta1.PreflightFailed,
+			"%dKiB of swap is used but only %dKiB of memory is available, free some memory so swap can be disabled",
+			used, available)
+	}
+	return preflightCheck(v1beta1.PreflightSwap, v1beta1.PreflightPassed, "swap is enabled, it is disabled by the initialization")
+}
+
+// parseSwaps parses /proc/swaps, used is the swap used in KB
+func parseSwaps(out string) (enabled bool, used int64) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		// Filename Type Size Used Priority
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 || fields[0] == "Filename" {
+			continue
+		}
+		enabled = true
+		if kb, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			used += kb
+		}
+	}
+	return enabled, used
+}
+
+func checkPorts(ports remote.Result) v1beta1.PreflightCheck {
+	if ports.Err != nil {
+		return preflightCheck(v1beta1.PreflightPorts, v1beta1.PreflightWarning, "the ports could not be read: %v", ports.Err)
+	}
+	listening := parseListeningPorts(ports.Stdout)
+	var used []string
+	for _, port := range preflightPorts {
+		if listening[port] {
+			used = append(used, strconv.Itoa(port))
+		}
+	}
+	if len(used) != 0 {
+		return preflightCheck(v1beta1.PreflightPorts, v1beta1.PreflightFailed,
+			"ports %s are in use, stop the processes listening on them or reset the host", strings.Join(used, ", "))
+	}
+	return preflightCheck(v1beta1.PreflightPorts, v1beta1.PreflightPassed, "the kubernetes ports are free")
+}
+
+// parseListeningPorts parses the local addresses of ss -tln, such as 0.0.0.0:22 or [::]:22
+func parseListeningPorts(out string) map[int]bool {
+	ports := make(map[int]bool)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		// State Recv-Q Send-Q Local-Address:Port Peer-Address:Port
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != "LISTEN" {
+			continue
+		}
+		address := fields[3]
+		port, err := strconv.Atoi(address[strings.LastIndex(address, ":")+1:])
+		if err == nil {
+			ports[port] = true
+		}
+	}
+	return ports
+}
+
+func checkUniqueHostname(metalNode *v1beta1.MetalNode, others []v1beta1.MetalNode) v1beta1.PreflightCheck {
+	hostname := nodeHostname(metalNode)
+	if hostname == "" {
+		return preflightCheck(v1beta1.PreflightHostname, v1beta1.PreflightWarning, "the hostname is unknown")
+	}
+	for i := range others {
+		if strings.EqualFold(nodeHostname(&others[i]), hostname) {
+			return preflightCheck(v1beta1.PreflightHostname, v1beta1.PreflightFailed,
+				"hostname %s is also used by metal node %s/%s", hostname, others[i].Namespace, others[i].Name)
+		}
+	}
+	return preflightCheck(v1beta1.PreflightHostname, v1beta1.PreflightPassed, "hostname %s is unique", hostname)
+}
+
+func checkUniqueMAC(metalNode *v1beta1.MetalNode, others []v1beta1.MetalNode) v1beta1.PreflightCheck {
+	macs := nodeMACs(metalNode)
+	if len(macs) == 0 {
+		return preflightCheck(v1beta1.PreflightMAC, v1beta1.PreflightWarning, "the MAC addresses are unknown")
+	}
+	var duplicates []string
+	for i := range others {
+		for mac := range nodeMACs(&others[i]) {
+			if macs[mac] {
+				duplicates = append(duplicates, fmt.Sprintf("%s (metal node %s/%s)", mac, others[i].Namespace, others[i].Name))
+			}
+		}
+	}
+	if len(duplicates) != 0 {
+		sort.Strings(duplicates)
+		return preflightCheck(v1beta1.PreflightMAC, v1beta1.PreflightFailed,
+			"MAC addresses are also used by other metal nodes: %s", strings.Join(duplicates, ", "))
+	}
+	return preflightCheck(v1beta1.PreflightMAC, v1beta1.PreflightPassed, "the MAC addresses are unique")
+}
+
+// nodeMACs returns the MAC addresses of the metal node found in its inventory
+func nodeMACs(metalNode *v1beta1.MetalNode) map[string]bool {
+	macs := make(map[string]bool)
+	if metalNode.Status.Inventory == nil {
+		return macs
+	}
+	for _, nic := range metalNode.Status.Inventory.NICs {
+		// tunnels have no hardware address
+		if nic.MAC != "" && strings.Trim(nic.MAC, "0:") != "" {
+			macs[strings.ToLower(nic.MAC)] = true
+		}
+	}
+	return macs
+}
+
+func checkUniqueProductUUID(metalNode *v1beta1.MetalNode, others []v1beta1.MetalNode) v1beta1.PreflightCheck {
+	var uuid string
+	if metalNode.Status.Inventory != nil {
+		uuid = metalNode.Status.Inventory.ProductUUID
+	}
+	if uuid == "" {
+		return preflightCheck(v1beta1.PreflightProductUUID, v1beta1.PreflightWarning, "the product uuid is unknown")
+	}
+	for i := range others {
+		if others[i].Status.Inventory != nil && others[i].Status.Inventory.ProductUUID == uuid {
+			return preflightCheck(v1beta1.PreflightProductUUID, v1beta1.PreflightFailed,
+				"product uuid %s is also used by metal node %s/%s, the host may be a clone", uuid, others[i].Namespace, others[i].Name)
+		}
+	}
+	return preflightCheck(v1beta1.PreflightProductUUID, v1beta1.PreflightPassed, "product uuid %s is unique", uuid)
+}
+
+// checkNodeIP check the InternalIP of the metal node is assigned to a NIC of the host, kubelet can't run on it otherwise
+func checkNodeIP(metalNode *v1beta1.MetalNode) v1beta1.PreflightCheck {
+	nodeIP := net.ParseIP(metalNode.InternalIP())
+	if nodeIP == nil {
+		return preflightCheck(v1beta1.PreflightNodeIP, v1beta1.PreflightPassed, "no InternalIP is set, kubelet uses the address of the default route")
+	}
+	if metalNode.Status.Inventory == nil {
+		return preflightCheck(v1beta1.PreflightNodeIP, v1beta1.PreflightWarning, "the addresses of the host are unknown")
+	}
+	for _, nic := range metalNode.Status.Inventory.NICs {
+		for _, cidr := range nic.IPs {
+			if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.Equal(nodeIP) {
+				return preflightCheck(v1beta1.PreflightNodeIP, v1beta1.PreflightPassed, "InternalIP %s is assigned to %s", nodeIP, nic.Name)
+			}
+		}
+	}
+	return preflightCheck(v1beta1.PreflightNodeIP, v1beta1.PreflightFailed, "InternalIP %s is not assigned to a NIC of the host", nodeIP)
+}
+
+// checkTimeSync parses the "System clock synchronized: yes" line of timedatectl, "NTP synchronized: yes" on CentOS 7
+func checkTimeSync(timeSync remote.Result) v1beta1.PreflightCheck {
+	if timeSync.Err != nil {
+		return preflightCheck(v1beta1.PreflightTimeSync, v1beta1.PreflightWarning, "the clock could not be read: %v", timeSync.Err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(timeSync.Stdout))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) == 2 && strings.HasSuffix(strings.TrimSpace(kv[0]), "synchronized") && strings.TrimSpace(kv[1]) == "yes" {
+			return preflightCheck(v1beta1.PreflightTimeSync, v1beta1.PreflightPassed, "the clock is synchronized")
+		}
+	}
+	return preflightCheck(v1beta1.PreflightTimeSync, v1beta1.PreflightWarning,
+		"the clock is not synchronized, the certificates may look invalid, enable chronyd or systemd-timesyncd")
+}
+
+func checkBrNetfilter(brNetfilter remote.Result) v1beta1.PreflightCheck {
+	if brNetfilter.Err != nil {
+		return preflightCheck(v1beta1.PreflightBrNetfilter, v1beta1.PreflightFailed,
+			"the br_netfilter kernel module is not available, install the modules of the running kernel")
+	}
+	return preflightCheck(v1beta1.PreflightBrNetfilter, v1beta1.PreflightPassed, "the br_netfilter kernel module is available")
+}
+
+func checkDisk(disk remote.Result) v1beta1.PreflightCheck {
+	kb, err := strconv.ParseInt(strings.TrimSpace(disk.Stdout), 10, 64)
+	if disk.Err != nil || err != nil {
+		return preflightCheck(v1beta1.PreflightDisk, v1beta1.PreflightWarning, "the disk space of /var/lib could not be read")
+	}
+	available := resource.NewQuantity(kb*1024, resource.BinarySI)
+	if available.Cmp(preflightMinVarLib) < 0 {
+		return preflightCheck(v1beta1.PreflightDisk, v1beta1.PreflightFailed,
+			"%s available in /var/lib, at least %s is required", available, &preflightMinVarLib)
+	}
+	return preflightCheck(v1beta1.PreflightDisk, v1beta1.PreflightPassed, "%s available in /var/lib", available)
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseSwaps(t *testing.T) {
+	tests := []struct {
+		name        string
+		out         string
+		wantEnabled bool
+		wantUsed    int64
+	}{
+		{name: "empty"},
+		{name: "disabled", out: "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n"},
+		{
+			name:        "partition",
+			out:         "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n/dev/dm-1                               partition\t2097148\t\t0\t\t-2\n",
+			wantEnabled: true,
+		},
+		{
+			name: "partition and file",
+			out: "Filename\tType\tSize\tUsed\tPriority\n" +
+				"/dev/sda2\tpartition\t4194300\t1024\t-2\n" +
+				"/swapfile\tfile\t1048572\t512\t-3\n",
+			wantEnabled: true,
+			wantUsed:    1536,
+		},
+		{name: "truncated line", out: "Filename\tType\tSize\tUsed\tPriority\n/swapfile\tfile\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enabled, used := parseSwaps(tt.out)
+			if enabled != tt.wantEnabled || used != tt.wantUsed {
+				t.Errorf("parseSwaps() = %v, %d, want %v, %d", enabled, used, tt.wantEnabled, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func TestParseListeningPorts(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want map[int]bool
+	}{
+		{name: "empty", want: map[int]bool{}},
+		{
+			name: "ipv4 and ipv6",
+			out: "State  Recv-Q Send-Q Local Address:Port Peer Address:Port Process\n" +
+				"LISTEN 0      128           0.0.0.0:22        0.0.0.0:*\n" +
+				"LISTEN 0      4096        127.0.0.1:10248     0.0.0.0:*\n" +
+				"LISTEN 0      128              [::]:22           [::]:*\n" +
+				"LISTEN 0      4096                *:6443            *:*\n",
+			want: map[int]bool{22: true, 10248: true, 6443: true},
+		},
+		{
+			name: "interface scoped address",
+			out:  "LISTEN 0      4096   127.0.0.53%lo:53        0.0.0.0:*\n",
+			want: map[int]bool{53: true},
+		},
+		{
+			name: "not listening",
+			out:  "ESTAB  0      0      10.0.0.1:22   10.0.0.2:51234\n",
+			want: map[int]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseListeningPorts(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseListeningPorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeHostname(t *testing.T) {
+	inventory := &v1beta1.Inventory{Hostname: "host-1"}
+	tests := []struct {
+		name      string
+		nodeName  string
+		profile   bool
+		cmd       bool
+		inventory *v1beta1.Inventory
+		want      string
+	}{
+		{name: "default steps", inventory: inventory, want: "node"},
+		{name: "default steps node name", nodeName: "worker-1", inventory: inventory, want: "worker-1"},
+		{name: "initialization commands", cmd: true, inventory: inventory, want: "host-1"},
+		{name: "initialization commands not collected", cmd: true},
+		{name: "profile", profile: true, inventory: inventory, want: "host-1"},
+		{name: "profile ignores initialization commands", profile: true, cmd: true, inventory: inventory, want: "host-1"},
+		{name: "profile not collected", profile: true, cmd: true, want: "node"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := testMetalNode("node")
+			metalNode.Spec.NodeName = tt.nodeName
+			if tt.profile {
+				metalNode.Spec.ProfileRef = &corev1.LocalObjectReference{Name: "base"}
+			}
+			if tt.cmd {
+				metalNode.Spec.InitializationCmd = []string{"true"}
+			}
+			metalNode.Status.Inventory = tt.inventory
+			if got := nodeHostname(metalNode); got != tt.want {
+				t.Errorf("nodeHostname() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileDuplicateHost(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	first := testMetalNode("node-0")
+	first.UID = "node-0"
+	first.CreationTimestamp = metav1.NewTime(created)
+	// the webhook missed the duplicate created concurrently, on an InternalIP of the first metal node
+	first.Spec.Addresses = []v1beta1.MachineAddress{{Type: v1beta1.MachineInternalIP, Address: "10.0.0.1"}}
+	duplicate := testMetalNode("node-1")
+	duplicate.UID = "node-1"
+	duplicate.CreationTimestamp = metav1.NewTime(created.Add(time.Minute))
+	duplicate.Spec.NodeEndPoint.Host = "10.0.0.1"
+	r := newTestReconciler(t, first, duplicate)
+
+	if _, err := r.Reconcile(context.Background(), testRequest(duplicate)); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	stored := getMetalNode(t, r, duplicate)
+	if stored.Status.InitializationState != FAIL || stored.Status.NextRetryTime == nil {
+		t.Errorf("duplicate state = %q, next retry = %v, want FAIL with a retry", stored.Status.InitializationState, stored.Status.NextRetryTime)
+	}
+	if op, tracked := r.trackedOperation(stored); tracked {
+		t.Errorf("operation %s started on the host of another metal node", op.Name)
+	}
+	expectEvent(t, r, DuplicateHostReason)
+
+	if _, err := r.Reconcile(context.Background(), testRequest(first)); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if stored := getMetalNode(t, r, first); stored.Status.InitializationState == FAIL {
+		t.Errorf("first metal node of the host failed: %v", stored.Status.Transitions)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	"github.com/git-czy/cluster-api-metalnode/utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// maxProfileDepth bounds the chain of the profiles extending each other
+	maxProfileDepth = 10
+
+	// defaultProfileFileMode is the permission of the files uploaded by a profile without mode
+	defaultProfileFileMode = 0600
+)
+
+// initializationSteps returns the steps of the initialization of the metal node and the profile they come from,
+// the profile is nil if the metal node references none. The steps of the profile which don't match the metal node
+// are skipped, provisioner is the one of the os of the host, nil if it is not supported
+func (r *MetalNodeReconciler) initializationSteps(ctx context.Context, metalNode *v1beta1.MetalNode,
+	provisioner *provision.Provisioner) ([]provision.Step, *v1beta1.AppliedProfile, error) {
+	if metalNode.Spec.ProfileRef == nil {
+		if metalNode.Spec.InitializationCmd != nil {
+			return []provision.Step{{Name: "initializationCmd", Commands: metalNode.Spec.InitializationCmd}}, nil, nil
+		}
+		return provision.DefaultSteps(), nil, nil
+	}
+
+	chain, err := r.profileChain(ctx, metalNode.Namespace, metalNode.Spec.ProfileRef.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	applied := appliedProfile(chain)
+
+	// the hooks of the extended profiles run first, the steps of the profile replace the extended ones
+	var preSteps, mainSteps, postSteps []v1beta1.ProfileStep
+	for i := len(chain) - 1; i >= 0; i-- {
+		spec := chain[i].Spec
+		preSteps = append(preSteps, spec.PreSteps...)
+		if len(spec.Steps) != 0 {
+			mainSteps = spec.Steps
+		}
+		postSteps = append(postSteps, spec.PostSteps...)
+	}
+
+	var steps []provision.Step
+	add := func(profileSteps []v1beta1.ProfileStep) error {
+		for _, profileStep := range profileSteps {
+			match, err := stepMatches(metalNode, provisioner, profileStep.When)
+			if err != nil {
+				return errors.Wrapf(err, "invalid condition of step %s", profileStep.Name)
+			}
+			if !match {
+				continue
+			}
+			step, err := r.profileStep(ctx, metalNode.Namespace, profileStep)
+			if err != nil {
+				return err
+			}
+			steps = append(steps, step)
+		}
+		return nil
+	}
+	if err := add(preSteps); err != nil {
+		return nil, nil, err
+	}
+	if mainSteps == nil {
+		steps = append(steps, provision.DefaultSteps()...)
+	} else if err := add(mainSteps); err != nil {
+		return nil, nil, err
+	}
+	if err := add(postSteps); err != nil {
+		return nil, nil, err
+	}
+	return steps, applied, nil
+}
+
+// appliedProfile returns the profile of the chain with the generations of the chain
+func appliedProfile(chain []*v1beta1.MetalNodeProfile) *v1beta1.AppliedProfile {
+	applied := &v1beta1.AppliedProfile{Name: chain[0].Name}
+	for _, profile := range chain {
+		applied.Generations = append(applied.Generations, fmt.Sprintf("%s@%d", profile.Name, profile.Generation))
+	}
+	return applied
+}
+
+// profileChain returns the profile name of the namespace followed by the profiles it extends
+func (r *MetalNodeReconciler) profileChain(ctx context.Context, namespace, name string) ([]*v1beta1.MetalNodeProfile, error) {
+	var chain []*v1beta1.MetalNodeProfile
+	var names []string
+	for name != "" {
+		if utils.SliceContainsString(names, name) {
+			return nil, errors.Errorf("profile %s extends itself", name)
+		}
+		if len(chain) == maxProfileDepth {
+			return nil, errors.Errorf("profile %s extends more than %d profiles", chain[0].Name, maxProfileDepth)
+		}
+		profile := &v1beta1.MetalNodeProfile{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, profile); err != nil {
+			return nil, errors.Wrapf(err, "failed to get profile %s", name)
+		}
+		chain = append(chain, profile)
+		names = append(names, name)
+		name = profile.Spec.Extends
+	}
+	return chain, nil
+}
+
+// profileStep reads the script and the files of the step of a profile from the ConfigMaps and the Secrets of the namespace
+func (r *MetalNodeReconciler) profileStep(ctx context.Context, namespace string, profileStep v1beta1.ProfileStep) (provision.Step, error) {
+	step := provision.Step{
+		Name:     profileStep.Name,
+		Module:   profileStep.Module,
+		Commands: profileStep.Commands,
+	}
+	actions := 0
+	for _, set := range []bool{profileStep.Module != "", profileStep.Script != nil, len(profileStep.Commands) != 0} {
+		if set {
+			actions++
+		}
+	}
+	if actions > 1 || actions == 0 && len(profileStep.Files) == 0 {
+		return step, errors.Errorf("step %s must set one of module, script or commands, or only files", profileStep.Name)
+	}
+
+	if ref := profileStep.Script; ref != nil {
+		cm := &corev1.ConfigMap{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, cm); err != nil {
+			if ref.Optional != nil && *ref.Optional {
+				return step, nil
+			}
+			return step, errors.Wrapf(err, "failed to get the script of step %s", profileStep.Name)
+		}
+		script, ok := cm.Data[ref.Key]
+		if !ok && (ref.Optional == nil || !*ref.Optional) {
+			return step, errors.Errorf("the script of step %s is not found in key %s of ConfigMap %s", profileStep.Name, ref.Key, ref.Name)
+		}
+		step.Script = script
+	}
+
+	for _, file := range profileStep.Files {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: file.Secret.Name}, secret); err != nil {
+			if file.Secret.Optional != nil && *file.Secret.Optional {
+				continue
+			}
+			return step, errors.Wrapf(err, "failed to get file %s of step %s", file.Path, profileStep.Name)
+		}
+		content, ok := secret.Data[file.Secret.Key]
+		if !ok {
+			if file.Secret.Optional != nil && *file.Secret.Optional {
+				continue
+			}
+			return step, errors.Errorf("file %s of step %s is not found in key %s of Secret %s",
+				file.Path, profileStep.Name, file.Secret.Key, file.Secret.Name)
+		}
+		mode := int32(defaultProfileFileMode)
+		if file.Mode != nil {
+			mode = *file.Mode
+		}
+		step.Files = append(step.Files, provision.File{Path: file.Path, Mode: mode, Content: content})
+	}
+	return step, nil
+}
+
+// stepMatches check if the metal node matches the condition of a step, a nil condition matches all the metal nodes
+func stepMatches(metalNode *v1beta1.MetalNode, provisioner *provision.Provisioner, when *v1beta1.StepCondition) (bool, error) {
+	if when == nil {
+		return true, nil
+	}
+	if len(when.Provisioners) != 0 && (provisioner == nil || !utils.SliceContainsString(when.Provisioners, provisioner.Name)) {
+		return false, nil
+	}
+	if when.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(when.Selector)
+		if err != nil {
+			return false, err
+		}
+		if !selector.Matches(labels.Set(metalNode.Labels)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestProfileChain(t *testing.T) {
+	// profiles maps the name of a profile to the profile it extends
+	deep := map[string]string{}
+	for i := 0; i <= maxProfileDepth; i++ {
+		deep[fmt.Sprintf("p%d", i)] = fmt.Sprintf("p%d", i+1)
+	}
+	deep[fmt.Sprintf("p%d", maxProfileDepth+1)] = ""
+
+	tests := []struct {
+		name     string
+		profiles map[string]string
+		profile  string
+		want     []string
+		wantErr  string
+	}{
+		{name: "single", profiles: map[string]string{"base": ""}, profile: "base", want: []string{"base"}},
+		{
+			name:     "extends",
+			profiles: map[string]string{"gpu": "worker", "worker": "base", "base": ""},
+			profile:  "gpu",
+			want:     []string{"gpu", "worker", "base"},
+		},
+		{name: "extends itself", profiles: map[string]string{"base": "base"}, profile: "base", wantErr: "extends itself"},
+		{
+			name:     "cycle",
+			profiles: map[string]string{"a": "b", "b": "c", "c": "a"},
+			profile:  "a",
+			wantErr:  "extends itself",
+		},
+		{name: "too deep", profiles: deep, profile: "p0", wantErr: "extends more than"},
+		{name: "missing", profiles: map[string]string{"worker": "base"}, profile: "worker", wantErr: "failed to get profile base"},
+	}
+	scheme := runtime.NewScheme()
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []client.Object
+			for name, extends := range tt.profiles {
+				objects = append(objects, &v1beta1.MetalNodeProfile{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+					Spec:       v1beta1.MetalNodeProfileSpec{Extends: extends},
+				})
+			}
+			r := &MetalNodeReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()}
+
+			chain, err := r.profileChain(context.Background(), "default", tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("profileChain() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("profileChain() error = %v", err)
+			}
+			var got []string
+			for _, profile := range chain {
+				got = append(got, profile.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("profileChain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// keys of the provisioning ConfigMap, the settings apply to all the metal nodes initialized by the manager
+const (
+	osRepoKey          = "osRepo"
+	osRepoFilesKey     = "osRepoFiles"
+	dockerRepoKey      = "dockerRepo"
+	kubernetesRepoKey  = "kubernetesRepo"
+	registryMirrorsKey = "registryMirrors"
+	sandboxImageKey    = "sandboxImage"
+	httpProxyKey       = "httpProxy"
+	httpsProxyKey      = "httpsProxy"
+	noProxyKey         = "noProxy"
+	caCertificatesKey  = "caCertificates"
+)
+
+// applyProvisioningConfig sets the options from the provisioning ConfigMap,
+// the defaults of the init scripts are kept if the ConfigMap is not set or not found
+func (r *MetalNodeReconciler) applyProvisioningConfig(ctx context.Context, options *provision.Options) error {
+	if r.ProvisioningConfig.Name == "" {
+		return nil
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, r.ProvisioningConfig, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get provisioning config %s", r.ProvisioningConfig)
+	}
+
+	get := func(key string) string {
+		return strings.TrimSpace(cm.Data[key])
+	}
+	options.OSRepo = get(osRepoKey)
+	options.OSRepoFiles = splitList(cm.Data[osRepoFilesKey])
+	options.DockerRepo = get(dockerRepoKey)
+	options.KubernetesRepo = get(kubernetesRepoKey)
+	options.RegistryMirrors = splitList(cm.Data[registryMirrorsKey])
+	options.SandboxImage = get(sandboxImageKey)
+	options.HTTPProxy = get(httpProxyKey)
+	options.HTTPSProxy = get(httpsProxyKey)
+	options.NoProxy = get(noProxyKey)
+	options.CACertificates = get(caCertificatesKey)
+	return nil
+}
+
+// splitList splits a list separated by commas or new lines
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(list, func(c rune) bool { return c == ',' || c == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// selectBundle loads the offline bundle and selects the part installed on the metal node,
+// nil is returned when the hosts are provisioned online or no step runs the built-in modules
+func (r *MetalNodeReconciler) selectBundle(metalNode *v1beta1.MetalNode, provisioner *provision.Provisioner,
+	steps []provision.Step) (*provision.Bundle, error) {
+	if r.BundleDir == "" || provisioner == nil || !provision.NeedsProvisioner(steps) {
+		return nil, nil
+	}
+	bundle, err := provision.LoadBundle(r.BundleDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load bundle %s", r.BundleDir)
+	}
+	var arch string
+	if metalNode.Status.Inventory != nil {
+		arch = metalNode.Status.Inventory.Architecture
+	}
+	return bundle.Select(provisioner, arch)
+}
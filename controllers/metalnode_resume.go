@@ -0,0 +1,102 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+const opResume = "resume"
+
+// probeBusyCmd prints busy while an init script, a step script or a package manager runs on the host.
+// The brackets keep pgrep from matching the shell running the probe
+const probeBusyCmd = "if pgrep -f '[i]nit_k8s_env|[/]tmp/metalnode-steps/' >/dev/null || " +
+	"pgrep -x 'yum|dnf|apt|apt-get|dpkg|rpm|zypper' >/dev/null; then echo busy; fi"
+
+// reconcileInterrupted resumes a metal node INITIALIZING or CHECKING whose operation is not tracked by this
+// controller, which restarted or took over the leadership since the operation was recorded in status.operation.
+// The check only reads the host, it is run again. The initialization is run again once the host is probed idle:
+// the commands of the interrupted one may still run on the host, and it is probed again until they finished
+func (r *MetalNodeReconciler) reconcileInterrupted(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	interrupted := "unknown"
+	if metalNode.Status.Operation != nil {
+		interrupted = metalNode.Status.Operation.Name
+	}
+	l = l.With("operation", interrupted)
+
+	if metalNode.Status.InitializationState == CHECKING {
+		// the versions of an adopted host are recorded, not enforced
+		started, err := r.startCheck(ctx, metalNode, l, !metalNode.Status.Bootstrapped)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if started {
+			l.Warnln("check of the metal node was interrupted, run it again")
+			r.warning(metalNode, InterruptedReason, "the check was interrupted, the controller may have restarted, it is run again", nil)
+		}
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name != opResume {
+		node := metalNode.DeepCopy()
+		if err := r.startOperation(metalNode, opResume, func() (operation.Result, error) {
+			results, err := remote.Exec(metalNodeToHost(node)[0], probeBusyCmd)
+			if err != nil {
+				return operation.Result{}, err
+			}
+			if results[0].Err != nil {
+				return operation.Result{Stderr: []string{results[0].Stderr}},
+					errors.Wrap(results[0].Err, "failed to probe the running initialization")
+			}
+			return operation.Result{Output: strings.TrimSpace(results[0].Stdout) == "busy"}, nil
+		}); err != nil {
+			l.WithError(err).Warnln("failed to start the probe of the interrupted initialization")
+		}
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+	if op.Phase != operation.Done {
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+
+	metalNode.Status.Operation = nil
+	if op.Err != nil {
+		// the initialization is not run again before the host tells it is idle
+		l.WithError(op.Err).Errorln("failed to probe the interrupted initialization")
+		r.connectionEvents(metalNode, op.Err, false)
+		return ctrl.Result{RequeueAfter: inProgressRequeueAfter}, nil
+	}
+	if busy, _ := op.Output.(bool); busy {
+		l.Infoln("the interrupted initialization still runs on the host, wait for it")
+		return ctrl.Result{RequeueAfter: inProgressRequeueAfter}, nil
+	}
+
+	l.Warnln("initialization of the metal node was interrupted, run it again")
+	r.warning(metalNode, InterruptedReason,
+		"the initialization was interrupted, the controller may have restarted, it is run again", nil)
+	setInitializationState(metalNode, PENDING, "interrupted initialization resumed")
+	return ctrl.Result{Requeue: true}, nil
+}
@@ -0,0 +1,500 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/metrics"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+const (
+	// PENDING is the state of a metal node waiting for initialization
+	PENDING v1beta1.InitializationState = ""
+
+	// maxTransitions is the number of state transitions kept in status
+	maxTransitions = 10
+
+	// initializationTimeout is how long a metal node may stay INITIALIZING or CHECKING
+	// before it's considered stale
+	initializationTimeout = time.Hour
+
+	// inProgressRequeueAfter is how often an in-progress metal node is looked at again
+	inProgressRequeueAfter = 30 * time.Second
+
+	// retryBaseDelay and retryMaxDelay bound the exponential backoff of failed initializations
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = 30 * time.Minute
+)
+
+// errUnknownState is returned when the metal node is in a state without handler
+var errUnknownState = errors.New("unknown metal node initialization state")
+
+// stateHandler reconciles a metal node in one InitializationState
+type stateHandler func(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error)
+
+func (r *MetalNodeReconciler) stateHandlers() map[v1beta1.InitializationState]stateHandler {
+	return map[v1beta1.InitializationState]stateHandler{
+		PENDING:      r.reconcilePending,
+		INITIALIZING: r.reconcileInProgress,
+		CHECKING:     r.reconcileInProgress,
+		FAIL:         r.reconcileFail,
+		SUCCESS:      r.reconcileSuccess,
+	}
+}
+
+// reconcilePending starts the initialization of the metal node
+func (r *MetalNodeReconciler) reconcilePending(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	// the host of another metal node is never touched
+	duplicate, err := r.duplicateHost(ctx, metalNode)
+	if err != nil {
+		l.WithError(err).Errorln("failed to list metal nodes")
+		return ctrl.Result{}, err
+	}
+	if duplicate != nil {
+		message := fmt.Sprintf("host is already used by metal node %s/%s", duplicate.Namespace, duplicate.Name)
+		r.warning(metalNode, DuplicateHostReason, message, nil)
+		return r.markFailed(metalNode, l, message)
+	}
+	// a host bootstrapped before the status was lost, such as by clusterctl move, is adopted instead of initialized,
+	// a host which could not be probed is probed again
+	if metalNode.Status.LastTransitionTime == nil || metalNode.Status.Bootstrapped || bootstrapProbeFailed(metalNode) {
+		done, err := r.reconcileAdoption(ctx, metalNode, l)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		// the metal node adopted or failed is requeued to be reconciled in its new state
+		if !done || metalNode.Status.Bootstrapped || metalNode.Status.InitializationState != PENDING {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+	}
+	// detect the os of the host before each initialization
+	if metalNode.Status.Inventory == nil || inventoryBefore(metalNode, metalNode.Status.LastTransitionTime) {
+		done, err := r.reconcileInventory(ctx, metalNode, l)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+	}
+	// the steps which don't run the built-in modules are run whatever the os is
+	provisioner, osErr := r.selectProvisioner(metalNode, l)
+	steps, profile, err := r.initializationSteps(ctx, metalNode, provisioner)
+	if err != nil {
+		l.WithError(err).Errorln("failed to get metal node profile")
+		r.warning(metalNode, ProfileInvalidReason, err.Error(), nil)
+		return r.markFailed(metalNode, l, err.Error())
+	}
+	if osErr != nil && provision.NeedsProvisioner(steps) {
+		return r.markFailed(metalNode, l, osErr.Error())
+	}
+	options, err := r.provisionOptions(ctx, metalNode)
+	if err != nil {
+		l.WithError(err).Errorln("failed to get metal node provision options")
+		return ctrl.Result{}, err
+	}
+	// the hostname of the host is kept unless a step sets it
+	if provision.SetsHostname(steps) {
+		options.Hostname = specHostname(metalNode)
+	}
+	if err := options.Validate(); err != nil {
+		r.warning(metalNode, InitializationFailedReason, err.Error(), nil)
+		return r.markFailed(metalNode, l, err.Error())
+	}
+	// a compliant host is adopted, only the missing components of the others may be installed
+	if adoptionEnabled(metalNode) {
+		// the metal node adopted or failed is requeued to be reconciled in its new state
+		if done := r.reconcileCompliance(metalNode, options, l); !done || metalNode.Status.InitializationState != PENDING {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+		steps = missingSteps(metalNode, options, steps)
+	}
+	// the host is checked before each initialization, once its os is known
+	done, passed, err := r.reconcilePreflight(ctx, metalNode, l)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !done {
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+	if !passed {
+		return r.markFailed(metalNode, l, "preflight checks failed")
+	}
+	var scripts provision.Scripts
+	if provisioner != nil && provision.NeedsProvisioner(steps) {
+		if scripts, err = provision.LoadScripts(provisioner, r.ScriptDir); err != nil {
+			l.WithError(err).Errorln("failed to load the init scripts")
+			r.warning(metalNode, InitializationFailedReason, err.Error(), nil)
+			return r.markFailed(metalNode, l, err.Error())
+		}
+	}
+	if options.Bundle, err = r.selectBundle(metalNode, provisioner, steps); err != nil {
+		l.WithError(err).Errorln("failed to select the offline bundle")
+		r.warning(metalNode, InitializationFailedReason, err.Error(), nil)
+		return r.markFailed(metalNode, l, err.Error())
+	}
+
+	node := metalNode.DeepCopy()
+	if err := r.startOperation(metalNode, opInitialize, func() (operation.Result, error) {
+		stderr, err := initMetal(node, provisioner, scripts, options, steps)
+		result := operation.Result{Stderr: stderr}
+		if options.Bundle != nil {
+			result.Output = options.Bundle.Version
+		}
+		return result, err
+	}); err != nil {
+		l.WithError(err).Errorln("failed to start metal node initialization")
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+	r.event(metalNode, InitializationStartedReason, "initialization started", nil)
+
+	setInitializationState(metalNode, INITIALIZING, "initialization started")
+	metalNode.Status.Bootstrapped = false
+	metalNode.Status.BootstrappedWith = ""
+	metalNode.Status.Ready = false
+	metalNode.Status.InitializationFailureReason = nil
+	metalNode.Status.CheckFailureReason = nil
+	// the versions are recorded again by the check
+	metalNode.Status.InstalledVersions = nil
+	metalNode.Status.BundleVersion = ""
+	metalNode.Status.Profile = profile
+	metalNode.Status.ProvisioningHash = provisioningHash(metalNode, profile)
+	metalNode.Status.ScriptHashes = nil
+	if scripts != nil {
+		metalNode.Status.ScriptHashes = scripts.Hashes()
+	}
+	metalNode.Status.LastHealthCheckTime = nil
+	return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+}
+
+// reconcileInProgress collects the operation of a metal node which is INITIALIZING or CHECKING.
+// A metal node in progress without operation tracked by this controller was either written by a controller
+// that has restarted since (or lost the leadership), which is resumed, or comes from a cache which is not up-to-date yet
+func (r *MetalNodeReconciler) reconcileInProgress(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name == opResume {
+		if tracked || isStale(metalNode, r.startTime) {
+			return r.reconcileInterrupted(ctx, metalNode, l)
+		}
+		return ctrl.Result{RequeueAfter: inProgressRequeueAfter}, nil
+	}
+	if op.Phase != operation.Done {
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+	metalNode.Status.Operation = nil
+
+	if metalNode.Status.InitializationState == INITIALIZING {
+		// if metal node InitializationFailureReason is not empty, maybe means the initialization failed
+		// so need to check the metal node is initialized or not(check docker kubelet kubeadm)
+		metalNode.Status.InitializationFailureReason = op.Stderr
+		r.connectionEvents(metalNode, op.Err, true)
+		if op.Err != nil {
+			l.WithError(op.Err).Errorln("failed to initialize metal node")
+			observeInitialization(metalNode, op.Err)
+			r.warning(metalNode, InitializationFailedReason, "initialization failed: "+op.Err.Error(), op.Stderr)
+			return r.markFailed(metalNode, l, "initialization failed: "+op.Err.Error())
+		}
+		if version, ok := op.Output.(string); ok {
+			metalNode.Status.BundleVersion = version
+		}
+
+		started, err := r.startCheck(ctx, metalNode, l, true)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if started {
+			setInitializationState(metalNode, CHECKING, "initialization finished")
+		}
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+
+	if op.Err != nil || len(op.Stderr) != 0 {
+		metalNode.Status.CheckFailureReason = op.Stderr
+		l.WithError(op.Err).Errorln("failed to initialize metal node")
+		observeInitialization(metalNode, errors.New("check failed"))
+		if op.Err != nil {
+			r.connectionEvents(metalNode, op.Err, false)
+			r.warning(metalNode, CheckFailedReason, "check failed: "+op.Err.Error(), op.Stderr)
+		} else {
+			r.warning(metalNode, CheckFailedReason, "check failed", op.Stderr)
+		}
+		return r.markFailed(metalNode, l, "check failed")
+	}
+
+	l.Info("initialized metal node successfully")
+	observeInitialization(metalNode, nil)
+	if installed, ok := op.Output.(v1beta1.InstalledVersions); ok {
+		metalNode.Status.InstalledVersions = &installed
+	}
+	r.event(metalNode, InitializationSucceededReason, "initialized metal node successfully", nil)
+
+	metalNode.Status.FailureCount = 0
+	metalNode.Status.NextRetryTime = nil
+	setInitializationState(metalNode, SUCCESS, "check passed")
+	return ctrl.Result{}, nil
+}
+
+// startCheck checks in background that the metal node is initialized, the installed versions are compared
+// with the versions in spec if strict, otherwise they are only recorded
+func (r *MetalNodeReconciler) startCheck(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger, strict bool) (bool, error) {
+	options, err := r.provisionOptions(ctx, metalNode)
+	if err != nil {
+		l.WithError(err).Errorln("failed to get metal node provision options")
+		return false, err
+	}
+	node := metalNode.DeepCopy()
+	if err := r.startOperation(metalNode, opCheck, func() (operation.Result, error) {
+		stderr, err := checkMetalNodeInitialized(node)
+		if err != nil || len(stderr) != 0 {
+			return operation.Result{Stderr: stderr}, err
+		}
+		installed, mismatches, err := checkMetalNodeVersions(node, options)
+		if !strict {
+			mismatches = nil
+		}
+		return operation.Result{Stderr: mismatches, Output: installed}, err
+	}); err != nil {
+		l.WithError(err).Errorln("failed to start metal node check")
+		return false, nil
+	}
+	return true, nil
+}
+
+// reconcileFail retries a failed initialization once its backoff expired or a retry is requested
+func (r *MetalNodeReconciler) reconcileFail(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	if hasAnnotation(metalNode, v1beta1.RetryAnnotation) {
+		// status is not part of the update, keep it and restore it after
+		status := metalNode.Status.DeepCopy()
+		delete(metalNode.Annotations, v1beta1.RetryAnnotation)
+		if err := r.Update(ctx, metalNode); err != nil {
+			l.WithError(err).Errorln("failed to remove retry annotation")
+			return ctrl.Result{}, err
+		}
+		metalNode.Status = *status
+		l.Infoln("retry of the initialization requested")
+		r.event(metalNode, InitializationRetryReason, "retry of the initialization requested", nil)
+		setInitializationState(metalNode, PENDING, "retry requested")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	if metalNode.Status.NextRetryTime != nil {
+		if wait := time.Until(metalNode.Status.NextRetryTime.Time); wait > 0 {
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+
+	// the host is probed again before the metal node goes back to PENDING, it is adopted if bootstrapped
+	if bootstrapProbeFailed(metalNode) {
+		done, err := r.reconcileAdoption(ctx, metalNode, l)
+		if err != nil || !done || metalNode.Status.InitializationState != PENDING {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	l.Infof("retrying the initialization, %d failures so far", metalNode.Status.FailureCount)
+	r.event(metalNode, InitializationRetryReason,
+		fmt.Sprintf("retrying the initialization, %d failures so far", metalNode.Status.FailureCount), nil)
+	setInitializationState(metalNode, PENDING, "backoff expired")
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// reconcileSuccess bootstraps the initialized metal node once its bootstrap data is available
+func (r *MetalNodeReconciler) reconcileSuccess(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	// the hosts bootstrapped before the data secret was recorded, or adopted allocated, are bootstrapped with their allocation
+	if metalNode.Status.Bootstrapped && metalNode.Status.BootstrappedWith == "" && metalNode.DataSecretName() != "" {
+		metalNode.Status.BootstrappedWith = metalNode.DataSecretName()
+	}
+	if needsTeardown(metalNode) {
+		if metalNode.Status.Operation == nil {
+			r.event(metalNode, ResetReason, "metal node released from its cluster, tearing down the host", nil)
+		}
+		done, err := r.reconcileTeardown(metalNode, l)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+		l.Infoln("metal node released from its cluster")
+		return ctrl.Result{}, nil
+	}
+
+	// provision the metal node again when requested, or reinstall it when its versions changed,
+	// between two operations only but the teardown of a forced reprovision
+	if metalNode.Status.Operation == nil || metalNode.Status.Operation.Name == opTeardown {
+		reprovisioning, err := r.reconcileDrift(ctx, metalNode, l)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if reprovisioning && metalNode.Status.InitializationState != PENDING {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+		if reprovisioning {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		upgrading, err := r.reconcileVersions(ctx, metalNode, l)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if upgrading {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
+	if metalNode.DataSecretName() == "" || metalNode.Status.Bootstrapped {
+		return r.reconcileIdle(ctx, metalNode, l)
+	}
+
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name != opBootstrap {
+		if metalNode.Status.Operation != nil {
+			l.Warnf("operation %s of metal node is lost, the controller may have restarted", metalNode.Status.Operation.Name)
+		}
+		cmd, err := r.getBootstrapDataToCmds(ctx, metalNode)
+		if err != nil {
+			l.WithError(err).Errorln("failed to get bootstrap data")
+			return ctrl.Result{}, err
+		}
+		node := metalNode.DeepCopy()
+		if err := r.startOperation(metalNode, opBootstrap, func() (operation.Result, error) {
+			// the bootstrap may have been run by a previous controller already, never run kubeadm twice
+			err := checkMetalNodeBootstrap(node)
+			if err == nil {
+				return operation.Result{}, nil
+			}
+			var connErr *remote.ConnectionError
+			if errors.As(err, &connErr) {
+				return operation.Result{}, err
+			}
+			stderr, err := bootstrapMetalNode(node, *cmd)
+			if err != nil {
+				return operation.Result{Stderr: stderr}, err
+			}
+			return operation.Result{Stderr: stderr}, checkMetalNodeBootstrap(node)
+		}); err != nil {
+			l.WithError(err).Errorln("failed to start metal node bootstrap")
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+		r.event(metalNode, BootstrapStartedReason, "bootstrap started with data secret "+metalNode.DataSecretName(), nil)
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+	if op.Phase != operation.Done {
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+
+	metalNode.Status.Operation = nil
+	metrics.BootstrapDuration.WithLabelValues(metrics.Result(op.Err)).Observe(time.Since(op.StartTime).Seconds())
+	if len(op.Stderr) != 0 {
+		metalNode.Status.BootstrapFailureReason = op.Stderr
+	}
+	r.connectionEvents(metalNode, op.Err, false)
+	if op.Err != nil {
+		l.WithError(op.Err).Errorln("failed to bootstrap metal node")
+		r.warning(metalNode, BootstrapFailedReason, "bootstrap failed: "+op.Err.Error(), op.Stderr)
+		return ctrl.Result{}, op.Err
+	}
+	markBootstrapped(metalNode)
+	l.Infoln("bootstrapped metal node successfully")
+	r.event(metalNode, BootstrapSucceededReason, "bootstrapped metal node successfully", nil)
+	return ctrl.Result{}, nil
+}
+
+// reconcileIdle refreshes the inventory of an idle metal node when it is due, then probes its health
+func (r *MetalNodeReconciler) reconcileIdle(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	op, tracked := r.trackedOperation(metalNode)
+	if (tracked && op.Name == opInventory) || (metalNode.Status.Operation == nil && r.inventoryDue(metalNode)) {
+		done, err := r.reconcileInventory(ctx, metalNode, l)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+	}
+
+	result, err := r.reconcileHealth(metalNode, l)
+	if err != nil || metalNode.Status.Operation != nil || metalNode.Status.Inventory == nil || r.InventoryRefreshInterval <= 0 {
+		return result, err
+	}
+	// a refresh which just failed is retried with the health check
+	if wait := r.InventoryRefreshInterval - time.Since(metalNode.Status.Inventory.CollectionTime.Time); wait > 0 &&
+		(result.RequeueAfter == 0 || wait < result.RequeueAfter) {
+		result.RequeueAfter = wait
+	}
+	return result, nil
+}
+
+// markFailed moves the metal node to FAIL and schedules the next retry
+func (r *MetalNodeReconciler) markFailed(metalNode *v1beta1.MetalNode, l log.Logger, reason string) (ctrl.Result, error) {
+	metalNode.Status.FailureCount++
+	backoff := retryBackoff(metalNode.Status.FailureCount)
+	next := metav1.NewTime(time.Now().Add(backoff))
+	metalNode.Status.NextRetryTime = &next
+	setInitializationState(metalNode, FAIL, reason)
+	l.Errorf("metal node initialization failed %d times, retry in %s", metalNode.Status.FailureCount, backoff)
+	return ctrl.Result{RequeueAfter: backoff}, nil
+}
+
+// setInitializationState moves the metal node to state and records the transition
+func setInitializationState(metalNode *v1beta1.MetalNode, state v1beta1.InitializationState, reason string) {
+	now := metav1.Now()
+	metalNode.Status.InitializationState = state
+	metalNode.Status.LastTransitionTime = &now
+	metalNode.Status.Transitions = append(metalNode.Status.Transitions, v1beta1.StateTransition{
+		State:  state,
+		Time:   now,
+		Reason: reason,
+	})
+	if n := len(metalNode.Status.Transitions); n > maxTransitions {
+		metalNode.Status.Transitions = metalNode.Status.Transitions[n-maxTransitions:]
+	}
+}
+
+// isStale check if the in-progress state of the metal node was entered before the controller started,
+// or has lasted longer than initializationTimeout
+func isStale(metalNode *v1beta1.MetalNode, startTime time.Time) bool {
+	transition := metalNode.Status.LastTransitionTime
+	if transition == nil {
+		return true
+	}
+	return transition.Time.Before(startTime) || time.Since(transition.Time) > initializationTimeout
+}
+
+// retryBackoff returns the delay before the next retry after failures failed initializations
+func retryBackoff(failures int) time.Duration {
+	backoff := retryBaseDelay
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: retryBaseDelay},
+		{failures: 1, want: retryBaseDelay},
+		{failures: 2, want: 2 * retryBaseDelay},
+		{failures: 3, want: 4 * retryBaseDelay},
+		{failures: 6, want: 32 * retryBaseDelay},
+		{failures: 7, want: retryMaxDelay},
+		{failures: 100, want: retryMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.failures); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	ago := func(d time.Duration) time.Time { return time.Now().Add(-d) }
+	tests := []struct {
+		name       string
+		startTime  time.Time
+		transition *metav1.Time
+		want       bool
+	}{
+		{name: "no transition", startTime: ago(10 * time.Minute), want: true},
+		{name: "entered before the controller started", startTime: ago(10 * time.Minute), transition: timeAgo(20 * time.Minute), want: true},
+		{name: "entered after the controller started", startTime: ago(10 * time.Minute), transition: timeAgo(time.Minute), want: false},
+		{name: "timed out", startTime: ago(3 * initializationTimeout), transition: timeAgo(2 * initializationTimeout), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := &v1beta1.MetalNode{}
+			metalNode.Status.LastTransitionTime = tt.transition
+			if got := isStale(metalNode, tt.startTime); got != tt.want {
+				t.Errorf("isStale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func timeAgo(d time.Duration) *metav1.Time {
+	t := metav1.NewTime(time.Now().Add(-d))
+	return &t
+}
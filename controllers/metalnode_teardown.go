@@ -0,0 +1,215 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+const (
+	opTeardown = "teardown"
+
+	// maxExcerptLength is the maximum length of a stderr excerpt put in conditions
+	maxExcerptLength = 512
+)
+
+// defaultTeardownCmds removes everything a kubeadm bootstrap left on the host,
+// the container runtime and the kubernetes packages installed by the initialization are kept
+var defaultTeardownCmds = remote.Commands{
+	// kubeadm can't guess the CRI socket when several runtimes are installed, such as docker and containerd
+	"sudo kubeadm reset -f $(test -f /etc/crictl.yaml && awk '/^runtime-endpoint:/ {print \"--cri-socket\", $2}' /etc/crictl.yaml)",
+	"sudo systemctl stop kubelet",
+	"sudo rm -rf /etc/cni/net.d /var/lib/cni",
+	"sudo iptables -F && sudo iptables -t nat -F && sudo iptables -t mangle -F && sudo iptables -X",
+	"if command -v ipvsadm >/dev/null 2>&1; then sudo ipvsadm --clear; fi",
+	"sudo rm -rf /etc/kubernetes /var/lib/etcd $HOME/.kube",
+	"sudo rm -f /run/cluster-api/bootstrap-success.complete",
+}
+
+// verifyTeardownCmd writes to stderr if the host still looks bootstrapped
+const verifyTeardownCmd = "if sudo test -e /etc/kubernetes/kubelet.conf -o -e /run/cluster-api/bootstrap-success.complete; " +
+	"then echo 'kubernetes files still exist after teardown' >&2; fi"
+
+// needsTeardown check if the metal node was released from its cluster but the host is still bootstrapped,
+// the host must have been bootstrapped while allocated
+func needsTeardown(metalNode *v1beta1.MetalNode) bool {
+	return metalNode.Status.Bootstrapped && metalNode.Status.BootstrappedWith != "" && metalNode.DataSecretName() == ""
+}
+
+// bootstrappedUnallocated check if the host of the metal node was found bootstrapped without allocation,
+// such as a host joined to a cluster by hand. It is neither torn down nor claimed
+func bootstrappedUnallocated(metalNode *v1beta1.MetalNode) bool {
+	return metalNode.Status.Bootstrapped && metalNode.Status.BootstrappedWith == "" && metalNode.DataSecretName() == ""
+}
+
+// markBootstrapped records the host of the metal node as bootstrapped, with the data secret of its allocation if any
+func markBootstrapped(metalNode *v1beta1.MetalNode) {
+	metalNode.Status.Bootstrapped = true
+	metalNode.Status.BootstrappedWith = metalNode.DataSecretName()
+}
+
+// mayBeBootstrapped check if a bootstrap may have been run on the host
+func mayBeBootstrapped(metalNode *v1beta1.MetalNode) bool {
+	return metalNode.Status.Bootstrapped || metalNode.DataSecretName() != ""
+}
+
+// reconcileDelete tears down the host of a deleted metal node, then removes the finalizer
+func (r *MetalNodeReconciler) reconcileDelete(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(metalNode, v1beta1.MetalNodeFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	switch {
+	case hasAnnotation(metalNode, v1beta1.ForceDeleteAnnotation):
+		l.Warnln("force delete metal node, the host is not torn down")
+		r.warning(metalNode, TeardownSkippedReason, "force delete metal node, the host is not torn down", nil)
+	case !mayBeBootstrapped(metalNode):
+		l.Infoln("metal node was never bootstrapped, nothing to tear down")
+	case bootstrappedUnallocated(metalNode):
+		l.Warnln("metal node host was bootstrapped without allocation, it is not torn down")
+		r.warning(metalNode, TeardownSkippedReason, "the host was bootstrapped without allocation, it is not torn down", nil)
+	case metalNode.Spec.Maintenance:
+		l.Infoln("metal node is in maintenance, the host is torn down once the maintenance ends")
+		return ctrl.Result{}, nil
+	case metalNode.Spec.NodeEndPoint.Validate() != nil:
+		l.Warnln("metal node endpoint is invalid, the host can't be torn down")
+	default:
+		done, err := r.reconcileTeardown(metalNode, l)
+		if updateErr := r.Status().Update(ctx, metalNode); updateErr != nil {
+			l.WithError(updateErr).Errorln("failed to update metal node status")
+			return ctrl.Result{}, updateErr
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+		}
+	}
+
+	r.Operations.Forget(operationKey(metalNode))
+	controllerutil.RemoveFinalizer(metalNode, v1beta1.MetalNodeFinalizer)
+	if err := r.Update(ctx, metalNode); err != nil {
+		l.WithError(err).Errorln("failed to remove metal node finalizer")
+		return ctrl.Result{}, err
+	}
+	l.Infoln("metal node deleted")
+	return ctrl.Result{}, nil
+}
+
+// reconcileTeardown runs the teardown of the metal node in background, done is true once it succeeded
+func (r *MetalNodeReconciler) reconcileTeardown(metalNode *v1beta1.MetalNode, l log.Logger) (done bool, err error) {
+	op, tracked := r.trackedOperation(metalNode)
+	if !tracked || op.Name != opTeardown {
+		node := metalNode.DeepCopy()
+		if err := r.startOperation(metalNode, opTeardown, func() (operation.Result, error) {
+			stderr, err := teardownMetalNode(node)
+			return operation.Result{Stderr: stderr}, err
+		}); err != nil {
+			l.WithError(err).Warnln("failed to start metal node teardown")
+			return false, nil
+		}
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.TornDownCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  v1beta1.TeardownInProgressReason,
+			Message: "tearing down the host",
+		})
+		l.Infoln("metal node teardown started")
+		r.event(metalNode, TeardownStartedReason, "tearing down the host", nil)
+		return false, nil
+	}
+	if op.Phase != operation.Done {
+		return false, nil
+	}
+
+	metalNode.Status.Operation = nil
+	if op.Err != nil {
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.TornDownCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  v1beta1.TeardownFailedReason,
+			Message: op.Err.Error() + ": " + stderrExcerpt(op.Stderr),
+		})
+		l.WithError(op.Err).Errorln("failed to tear down metal node")
+		r.connectionEvents(metalNode, op.Err, false)
+		r.warning(metalNode, TeardownFailedReason, "teardown failed: "+op.Err.Error(), op.Stderr)
+		return false, op.Err
+	}
+
+	meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.TornDownCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  v1beta1.TeardownSucceededReason,
+		Message: "the host was torn down",
+	})
+	metalNode.Status.Bootstrapped = false
+	metalNode.Status.BootstrappedWith = ""
+	metalNode.Status.BootstrapFailureReason = nil
+	l.Infoln("tore down metal node successfully")
+	r.event(metalNode, TeardownSucceededReason, "tore down the host successfully", nil)
+	return true, nil
+}
+
+// teardownMetalNode runs the teardown of the metal node, return the standard stderr of the teardown
+// and an error if the host still looks bootstrapped after it
+func teardownMetalNode(metalNode *v1beta1.MetalNode) ([]string, error) {
+	host := metalNodeToHost(metalNode)
+	cmd := remote.Command{Cmds: defaultTeardownCmds}
+	if metalNode.Spec.TeardownCmd != nil {
+		cmd.Cmds = metalNode.Spec.TeardownCmd
+	}
+	stderr, err := remote.RunOnHost(host[0], cmd)
+	if err != nil {
+		return stderr, err
+	}
+
+	verifyErrs, err := remote.RunOnHost(host[0], remote.Command{Cmds: remote.Commands{verifyTeardownCmd}})
+	if err != nil {
+		return stderr, err
+	}
+	if len(verifyErrs) != 0 {
+		return append(stderr, verifyErrs...), errors.New("metal node teardown failed")
+	}
+	return stderr, nil
+}
+
+// stderrExcerpt joins the last lines of stderr, truncated to maxExcerptLength
+func stderrExcerpt(stderr []string) string {
+	excerpt := strings.TrimSpace(strings.Join(stderr, "\n"))
+	if len(excerpt) > maxExcerptLength {
+		excerpt = "..." + excerpt[len(excerpt)-maxExcerptLength:]
+	}
+	return excerpt
+}
+
+func hasAnnotation(metalNode *v1beta1.MetalNode, annotation string) bool {
+	_, ok := metalNode.Annotations[annotation]
+	return ok
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestNeedsTeardown(t *testing.T) {
+	allocate := func(mn *v1beta1.MetalNode) {
+		mn.Spec.BootstrapDataSecretRef = &corev1.LocalObjectReference{Name: "worker-0"}
+	}
+	release := func(mn *v1beta1.MetalNode) { mn.ResetMetalNode() }
+	tests := []struct {
+		name string
+		// steps run in order on a new metal node
+		steps             []func(mn *v1beta1.MetalNode)
+		wantTeardown      bool
+		wantUnallocated   bool
+		wantMayBootstrap  bool
+		wantBootstrapWith string
+	}{
+		{name: "never allocated"},
+		{name: "allocated", steps: []func(mn *v1beta1.MetalNode){allocate}, wantMayBootstrap: true},
+		{
+			name:              "bootstrapped",
+			steps:             []func(mn *v1beta1.MetalNode){allocate, markBootstrapped},
+			wantMayBootstrap:  true,
+			wantBootstrapWith: "worker-0",
+		},
+		{
+			name:              "released after the bootstrap",
+			steps:             []func(mn *v1beta1.MetalNode){allocate, markBootstrapped, release},
+			wantTeardown:      true,
+			wantMayBootstrap:  true,
+			wantBootstrapWith: "worker-0",
+		},
+		{
+			name:             "sentinel present, no allocation",
+			steps:            []func(mn *v1beta1.MetalNode){markBootstrapped},
+			wantUnallocated:  true,
+			wantMayBootstrap: true,
+		},
+		{
+			name: "bootstrapped before the data secret was recorded",
+			steps: []func(mn *v1beta1.MetalNode){allocate, func(mn *v1beta1.MetalNode) {
+				mn.Status.Bootstrapped = true
+			}},
+			wantMayBootstrap: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := &v1beta1.MetalNode{}
+			for _, step := range tt.steps {
+				step(metalNode)
+			}
+			if got := needsTeardown(metalNode); got != tt.wantTeardown {
+				t.Errorf("needsTeardown() = %v, want %v", got, tt.wantTeardown)
+			}
+			if got := bootstrappedUnallocated(metalNode); got != tt.wantUnallocated {
+				t.Errorf("bootstrappedUnallocated() = %v, want %v", got, tt.wantUnallocated)
+			}
+			if got := mayBeBootstrapped(metalNode); got != tt.wantMayBootstrap {
+				t.Errorf("mayBeBootstrapped() = %v, want %v", got, tt.wantMayBootstrap)
+			}
+			if got := metalNode.Status.BootstrappedWith; got != tt.wantBootstrapWith {
+				t.Errorf("status.bootstrappedWith = %q, want %q", got, tt.wantBootstrapWith)
+			}
+		})
+	}
+}
+
+func TestReconcileUnallocatedBootstrappedHost(t *testing.T) {
+	unallocated := func() *v1beta1.MetalNode {
+		metalNode := testMetalNode("node-0")
+		metalNode.Status.InitializationState = SUCCESS
+		markBootstrapped(metalNode)
+		return metalNode
+	}
+
+	t.Run("not torn down nor ready", func(t *testing.T) {
+		metalNode := unallocated()
+		r := newTestReconciler(t, metalNode)
+		if _, err := r.Reconcile(context.Background(), testRequest(metalNode)); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		stored := getMetalNode(t, r, metalNode)
+		if stored.Status.Operation != nil && stored.Status.Operation.Name == opTeardown {
+			t.Error("teardown started on an unallocated bootstrapped host")
+		}
+		if !stored.Status.Bootstrapped || stored.Status.Ready {
+			t.Errorf("bootstrapped = %v, ready = %v, want bootstrapped and not ready", stored.Status.Bootstrapped, stored.Status.Ready)
+		}
+	})
+
+	t.Run("deleted without teardown", func(t *testing.T) {
+		metalNode := unallocated()
+		now := metav1.Now()
+		metalNode.DeletionTimestamp = &now
+		r := newTestReconciler(t, metalNode)
+		if _, err := r.Reconcile(context.Background(), testRequest(metalNode)); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		if op, tracked := r.Operations.Get(operationKey(metalNode)); tracked && op.Name == opTeardown {
+			t.Error("teardown started on an unallocated bootstrapped host being deleted")
+		}
+		err := r.Get(context.Background(), client.ObjectKeyFromObject(metalNode), &v1beta1.MetalNode{})
+		if !apierrors.IsNotFound(err) {
+			t.Errorf("metal node finalizer not removed, get error = %v", err)
+		}
+		expectEvent(t, r, TeardownSkippedReason)
+	})
+}
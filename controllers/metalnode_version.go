@@ -0,0 +1,256 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+)
+
+// machineGroup is the api group of the CAPI Machines, which may consume metal nodes
+const machineGroup = "cluster.x-k8s.io"
+
+// provisionOptions returns the options of the initialization of the metal node, the spec of the metal node overrides
+// the provisioning ConfigMap. The kubernetes version is the one of spec first, then the one of the Machine the metal node is allocated to
+func (r *MetalNodeReconciler) provisionOptions(ctx context.Context, metalNode *v1beta1.MetalNode) (provision.Options, error) {
+	options := provision.Options{
+		KubernetesVersion: metalNode.Spec.KubernetesVersion,
+		ContainerRuntime:  provision.Containerd,
+	}
+	if err := r.applyProvisioningConfig(ctx, &options); err != nil {
+		return options, err
+	}
+	if runtime := metalNode.Spec.ContainerRuntime; runtime != nil {
+		if runtime.Type != "" {
+			options.ContainerRuntime = runtime.Type
+		}
+		options.ContainerRuntimeVersion = runtime.Version
+		if runtime.SandboxImage != "" {
+			options.SandboxImage = runtime.SandboxImage
+		}
+		if len(runtime.RegistryMirrors) > 0 {
+			options.RegistryMirrors = runtime.RegistryMirrors
+		}
+	}
+	if options.KubernetesVersion != "" {
+		return options, nil
+	}
+
+	version, err := r.ownerMachineVersion(ctx, metalNode)
+	if err != nil {
+		return options, err
+	}
+	options.KubernetesVersion = version
+	return options, nil
+}
+
+// ownerMachineVersion returns spec.version of the CAPI Machine the metal node is allocated to, found through
+// its consumer: the Machine itself or the MetalMachine it owns. Empty if the metal node has no such consumer
+// or the consumer is gone
+func (r *MetalNodeReconciler) ownerMachineVersion(ctx context.Context, metalNode *v1beta1.MetalNode) (string, error) {
+	ref := metalNode.Spec.ConsumerRef
+	if ref == nil {
+		return "", nil
+	}
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return "", nil
+	}
+	var machineName string
+	switch {
+	case gv.Group == machineGroup && ref.Kind == MachineGVK.Kind:
+		machineName = ref.Name
+	case gv.Group == v1beta1.GroupVersion.Group && ref.Kind == "MetalMachine":
+		metalMachine := &v1beta1.MetalMachine{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: metalNode.Namespace, Name: ref.Name}, metalMachine); err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", nil
+			}
+			return "", errors.Wrapf(err, "failed to get consumer metal machine %s", ref.Name)
+		}
+		owner := capiOwner(metalMachine, MachineGVK.Kind)
+		if owner == nil {
+			return "", nil
+		}
+		machineName = owner.Name
+	default:
+		return "", nil
+	}
+
+	machine, err := getCAPIObject(ctx, r.Client, MachineGVK, metalNode.Namespace, machineName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to get machine %s", machineName)
+	}
+	version, _, err := unstructured.NestedString(machine.Object, "spec", "version")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the version of machine %s", machineName)
+	}
+	return version, nil
+}
+
+// reconcileVersions reinstalls the metal node when the versions in spec changed since its initialization,
+// upgrading is true if the metal node went back to PENDING to be reinstalled
+func (r *MetalNodeReconciler) reconcileVersions(ctx context.Context, metalNode *v1beta1.MetalNode, l log.Logger) (upgrading bool, err error) {
+	if metalNode.Status.InstalledVersions == nil {
+		return false, nil
+	}
+	desired, err := r.provisionOptions(ctx, metalNode)
+	if err != nil {
+		l.WithError(err).Errorln("failed to get metal node versions")
+		return false, err
+	}
+	if err := desired.Validate(); err != nil {
+		// reported by the next initialization
+		return false, nil
+	}
+
+	mismatches := versionMismatches(desired, *metalNode.Status.InstalledVersions)
+	if len(mismatches) == 0 {
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.VersionsMatchedCondition,
+			Status:  metav1.ConditionTrue,
+			Reason:  v1beta1.VersionsMatchedReason,
+			Message: "the versions installed are the versions in spec",
+		})
+		return false, nil
+	}
+
+	message := strings.Join(mismatches, ", ")
+	if metalNode.Status.Bootstrapped {
+		message += ", the host is reinstalled once released from its cluster"
+		previous := meta.FindStatusCondition(metalNode.Status.Conditions, v1beta1.VersionsMatchedCondition)
+		meta.SetStatusCondition(&metalNode.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.VersionsMatchedCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  v1beta1.UpgradeBlockedReason,
+			Message: message,
+		})
+		if previous == nil || previous.Reason != v1beta1.UpgradeBlockedReason {
+			l.Warnf("metal node versions changed but it is bootstrapped: %s", message)
+			r.warning(metalNode, UpgradeBlockedReason, message, nil)
+		}
+		return false, nil
+	}
+
+	l.Infof("metal node versions changed, reinstalling: %s", message)
+	r.event(metalNode, UpgradeStartedReason, "versions changed, reinstalling: "+message, nil)
+	setInitializationState(metalNode, PENDING, "versions changed")
+	return true, nil
+}
+
+// checkMetalNodeVersions reads the versions installed on the host, return a line for each version which does not match
+// the desired version and an error if the host can't be connected
+func checkMetalNodeVersions(metalNode *v1beta1.MetalNode, desired provision.Options) (v1beta1.InstalledVersions, []string, error) {
+	results, err := remote.Exec(metalNodeToHost(metalNode)[0],
+		probeKubeletVersionCmd,
+		probeKubeadmVersionCmd,
+		probeContainerRuntimeCmd,
+	)
+	if err != nil {
+		return v1beta1.InstalledVersions{}, nil, err
+	}
+	versions := parseInstalledVersions(results[0], results[1], results[2])
+	return versions, versionMismatches(desired, versions), nil
+}
+
+// parseInstalledVersions parses the outputs of the version commands of kubelet, kubeadm and crictl
+func parseInstalledVersions(kubelet, kubeadm, runtime remote.Result) v1beta1.InstalledVersions {
+	var versions v1beta1.InstalledVersions
+	if kubelet.Err == nil {
+		// Kubernetes v1.23.5
+		if fields := strings.Fields(kubelet.Stdout); len(fields) > 0 {
+			versions.Kubelet = fields[len(fields)-1]
+		}
+	}
+	if kubeadm.Err == nil {
+		versions.Kubeadm = strings.TrimSpace(kubeadm.Stdout)
+	}
+	if runtime.Err == nil {
+		versions.ContainerRuntimeName, versions.ContainerRuntime = parseCrictlVersion(runtime.Stdout)
+	}
+	return versions
+}
+
+// parseCrictlVersion parses the RuntimeName and RuntimeVersion lines of crictl version
+func parseCrictlVersion(out string) (name, version string) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "RuntimeName:":
+			name = fields[1]
+		case "RuntimeVersion:":
+			// containerd reports v1.6.4
+			version = strings.TrimPrefix(fields[1], "v")
+		}
+	}
+	return name, version
+}
+
+// versionMismatches compares the versions installed with the desired versions, an empty desired version matches any
+func versionMismatches(desired provision.Options, installed v1beta1.InstalledVersions) []string {
+	var mismatches []string
+	compare := func(name, want, found string) {
+		if want == "" || versionMatches(found, want) {
+			return
+		}
+		if found == "" {
+			mismatches = append(mismatches, fmt.Sprintf("%s is not installed, %s expected", name, want))
+			return
+		}
+		mismatches = append(mismatches, fmt.Sprintf("%s %s is installed, %s expected", name, found, want))
+	}
+	if desired.KubernetesVersion != "" {
+		kubernetes := "v" + strings.TrimPrefix(desired.KubernetesVersion, "v")
+		compare("kubelet", kubernetes, installed.Kubelet)
+		compare("kubeadm", kubernetes, installed.Kubeadm)
+	}
+	// the runtime name was not recorded by the previous versions of the controller
+	if installed.ContainerRuntimeName != "" && installed.ContainerRuntimeName != desired.ContainerRuntime {
+		mismatches = append(mismatches, fmt.Sprintf("container runtime %s is installed, %s expected",
+			installed.ContainerRuntimeName, desired.ContainerRuntime))
+		return mismatches
+	}
+	compare("container runtime", strings.TrimPrefix(desired.ContainerRuntimeVersion, "v"), installed.ContainerRuntime)
+	return mismatches
+}
+
+// versionMatches check if version is want or a patch of want, such as v1.23.5 for v1.23
+func versionMatches(version, want string) bool {
+	return version == want || strings.HasPrefix(version, want+".") || strings.HasPrefix(version, want+"-")
+}
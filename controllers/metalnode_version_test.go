@@ -0,0 +1,205 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/provision"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestVersionMatches(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		match   bool
+	}{
+		{version: "v1.23.5", want: "v1.23.5", match: true},
+		{version: "v1.23.5", want: "v1.23", match: true},
+		{version: "v1.23.5", want: "v1", match: true},
+		{version: "1.6.4-1", want: "1.6.4", match: true},
+		{version: "v1.23.15", want: "v1.23.1", match: false},
+		{version: "v1.230.0", want: "v1.23", match: false},
+		{version: "v1.23.5", want: "v1.24", match: false},
+		{version: "", want: "v1.23", match: false},
+	}
+	for _, tt := range tests {
+		if got := versionMatches(tt.version, tt.want); got != tt.match {
+			t.Errorf("versionMatches(%q, %q) = %v, want %v", tt.version, tt.want, got, tt.match)
+		}
+	}
+}
+
+func TestVersionMismatches(t *testing.T) {
+	installed := v1beta1.InstalledVersions{
+		Kubelet:              "v1.23.5",
+		Kubeadm:              "v1.23.5",
+		ContainerRuntime:     "1.6.4",
+		ContainerRuntimeName: provision.Containerd,
+	}
+	tests := []struct {
+		name      string
+		desired   provision.Options
+		installed v1beta1.InstalledVersions
+		want      []string
+	}{
+		{
+			name:      "any version",
+			desired:   provision.Options{ContainerRuntime: provision.Containerd},
+			installed: installed,
+		},
+		{
+			name:      "matching versions",
+			desired:   provision.Options{KubernetesVersion: "1.23", ContainerRuntime: provision.Containerd, ContainerRuntimeVersion: "v1.6.4"},
+			installed: installed,
+		},
+		{
+			name:      "kubernetes upgrade",
+			desired:   provision.Options{KubernetesVersion: "v1.24.3", ContainerRuntime: provision.Containerd},
+			installed: installed,
+			want:      []string{"kubelet v1.23.5 is installed, v1.24.3 expected", "kubeadm v1.23.5 is installed, v1.24.3 expected"},
+		},
+		{
+			name:      "not installed",
+			desired:   provision.Options{KubernetesVersion: "v1.23.5", ContainerRuntime: provision.Containerd, ContainerRuntimeVersion: "1.6.4"},
+			installed: v1beta1.InstalledVersions{},
+			want: []string{"kubelet is not installed, v1.23.5 expected", "kubeadm is not installed, v1.23.5 expected",
+				"container runtime is not installed, 1.6.4 expected"},
+		},
+		{
+			name:      "other runtime",
+			desired:   provision.Options{ContainerRuntime: provision.CRIO, ContainerRuntimeVersion: "1.24"},
+			installed: installed,
+			want:      []string{"container runtime containerd is installed, cri-o expected"},
+		},
+		{
+			name:      "runtime name not recorded",
+			desired:   provision.Options{ContainerRuntime: provision.CRIO, ContainerRuntimeVersion: "1.6"},
+			installed: v1beta1.InstalledVersions{ContainerRuntime: "1.6.4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := versionMismatches(tt.desired, tt.installed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("versionMismatches() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCrictlVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		out         string
+		wantName    string
+		wantVersion string
+	}{
+		{
+			name:        "containerd",
+			out:         "Version:  0.1.0\nRuntimeName:  containerd\nRuntimeVersion:  v1.6.4\nRuntimeApiVersion:  v1\n",
+			wantName:    "containerd",
+			wantVersion: "1.6.4",
+		},
+		{
+			name:        "cri-o",
+			out:         "Version:  0.1.0\nRuntimeName:  cri-o\nRuntimeVersion:  1.24.2\nRuntimeApiVersion:  v1\n",
+			wantName:    "cri-o",
+			wantVersion: "1.24.2",
+		},
+		{
+			name:        "docker through cri-dockerd",
+			out:         "Version:  0.1.0\nRuntimeName:  docker\nRuntimeVersion:  20.10.17\nRuntimeApiVersion:  1.41.0\n",
+			wantName:    "docker",
+			wantVersion: "20.10.17",
+		},
+		{
+			name: "runtime not running",
+			out:  "time=\"2022-07-01T10:00:00Z\" level=fatal msg=\"connect: connect endpoint 'unix:///run/containerd/containerd.sock'\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, version := parseCrictlVersion(tt.out)
+			if name != tt.wantName || version != tt.wantVersion {
+				t.Errorf("parseCrictlVersion() = %q, %q, want %q, %q", name, version, tt.wantName, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestOwnerMachineVersion(t *testing.T) {
+	machine := &unstructured.Unstructured{}
+	machine.SetGroupVersionKind(MachineGVK)
+	machine.SetNamespace("default")
+	machine.SetName("worker-abcde")
+	if err := unstructured.SetNestedField(machine.Object, "v1.23.5", "spec", "version"); err != nil {
+		t.Fatal(err)
+	}
+	metalMachine := &v1beta1.MetalMachine{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "default",
+		Name:            "worker-0",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: MachineGVK.GroupVersion().String(), Kind: "Machine", Name: "worker-abcde"}},
+	}}
+	ownerless := &v1beta1.MetalMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker-1"}}
+
+	tests := []struct {
+		name     string
+		consumer *corev1.ObjectReference
+		want     string
+	}{
+		{name: "no consumer"},
+		{
+			name:     "machine",
+			consumer: &corev1.ObjectReference{APIVersion: MachineGVK.GroupVersion().String(), Kind: "Machine", Name: "worker-abcde"},
+			want:     "v1.23.5",
+		},
+		{
+			name:     "metal machine owned by a machine",
+			consumer: &corev1.ObjectReference{APIVersion: v1beta1.GroupVersion.String(), Kind: "MetalMachine", Name: "worker-0"},
+			want:     "v1.23.5",
+		},
+		{
+			name:     "metal machine without machine",
+			consumer: &corev1.ObjectReference{APIVersion: v1beta1.GroupVersion.String(), Kind: "MetalMachine", Name: "worker-1"},
+		},
+		{
+			name:     "metal machine gone",
+			consumer: &corev1.ObjectReference{APIVersion: v1beta1.GroupVersion.String(), Kind: "MetalMachine", Name: "worker-2"},
+		},
+		{name: "other consumer", consumer: &corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Name: "worker-abcde"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metalNode := testMetalNode("node-0")
+			metalNode.Spec.ConsumerRef = tt.consumer
+			r := newTestReconciler(t, metalNode, metalMachine.DeepCopy(), ownerless.DeepCopy(), machine.DeepCopy())
+			got, err := r.ownerMachineVersion(context.Background(), metalNode)
+			if err != nil {
+				t.Fatalf("ownerMachineVersion() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ownerMachineVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/utils/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// claimPendingInterval is how often a pending claim looks for a matching metal node,
+// besides the changes of the metal nodes of its namespace
+const claimPendingInterval = time.Minute
+
+// ClaimLostReason is the reason of the event emitted for a MetalNodeClaim when its metal node is lost,
+// the claims share the other reasons of the metal nodes such as ClaimBoundReason
+const ClaimLostReason = "MetalNodeLost"
+
+// MetalNodeClaimReconciler binds the MetalNodeClaims to the available metal nodes matching them
+type MetalNodeClaimReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Recorder emits the events of the claims
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalnodeclaims,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalnodeclaims/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=bocloud.io,resources=metalnodeclaims/finalizers,verbs=update
+
+// Reconcile binds the claim to a metal node, or releases the metal node once the claim is deleted
+func (r *MetalNodeClaimReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	claim := &v1beta1.MetalNodeClaim{}
+	if err := r.Get(ctx, req.NamespacedName, claim); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.WithError(err).Error("unable to fetch MetalNodeClaim")
+		return ctrl.Result{}, err
+	}
+	l := log.With("metalnodeclaim", req.NamespacedName.String())
+
+	// a paused claim neither binds nor releases a metal node, e.g. while it is moved by clusterctl move
+	if claim.IsPaused() {
+		l.Infoln("metal node claim is paused, skip reconciling")
+		return ctrl.Result{}, nil
+	}
+
+	if !claim.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.reconcileDelete(ctx, claim, l)
+	}
+
+	if !controllerutil.ContainsFinalizer(claim, v1beta1.MetalNodeClaimFinalizer) {
+		controllerutil.AddFinalizer(claim, v1beta1.MetalNodeClaimFinalizer)
+		status := claim.Status.DeepCopy()
+		if err := r.Update(ctx, claim); err != nil {
+			l.WithError(err).Errorln("failed to add metal node claim finalizer")
+			return ctrl.Result{}, err
+		}
+		claim.Status = *status
+	}
+
+	result, err := r.reconcileBinding(ctx, claim, l)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Status().Update(ctx, claim); err != nil {
+		l.WithError(err).Errorln("failed to update metal node claim status")
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// reconcileBinding binds the claim to a metal node unless it is bound, the metal node is bound first
+// so a claim never holds a metal node unknown to it
+func (r *MetalNodeClaimReconciler) reconcileBinding(ctx context.Context, claim *v1beta1.MetalNodeClaim, l log.Logger) (ctrl.Result, error) {
+	nodes := &v1beta1.MetalNodeList{}
+	if err := r.List(ctx, nodes, client.InNamespace(claim.Namespace)); err != nil {
+		l.WithError(err).Errorln("failed to list metal nodes")
+		return ctrl.Result{}, err
+	}
+
+	// the metal node may already be bound when the status of the claim could not be updated,
+	// the changes of the claim are applied to the metal node bound
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !claimedBy(node, claim) {
+			continue
+		}
+		if allocated := allocate(node, claim); !equality.Semantic.DeepEqual(allocated.Spec, node.Spec) {
+			if err := r.Update(ctx, allocated); err != nil {
+				l.WithError(err).Errorln("failed to update the allocation of metal node")
+				return ctrl.Result{}, err
+			}
+		}
+		setClaimBound(claim, node.Name)
+		return ctrl.Result{}, nil
+	}
+	if claim.Status.NodeName != "" {
+		if claim.Status.Phase != v1beta1.ClaimLost {
+			l.With("metalnode", claim.Status.NodeName).Warnln("the metal node bound to the claim is lost")
+			r.Recorder.Event(claim, corev1.EventTypeWarning, ClaimLostReason, "metal node "+claim.Status.NodeName+" is lost")
+		}
+		claim.Status.Phase = v1beta1.ClaimLost
+		meta.SetStatusCondition(&claim.Status.Conditions, metav1.Condition{
+			Type:    v1beta1.ClaimBoundCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  v1beta1.MetalNodeLostReason,
+			Message: "metal node " + claim.Status.NodeName + " was deleted or released",
+		})
+		return ctrl.Result{}, nil
+	}
+
+	candidates, err := matchingMetalNodes(nodes.Items, claim)
+	if err != nil {
+		l.WithError(err).Errorln("invalid metal node claim selector")
+		return ctrl.Result{}, nil
+	}
+	for _, node := range candidates {
+		// the update fails on conflict when another claim binds the metal node at the same time
+		if err := r.Update(ctx, allocate(node, claim)); err != nil {
+			if apierrors.IsConflict(err) {
+				l.With("metalnode", node.Name).Infoln("metal node was bound by another claim, trying the next one")
+				continue
+			}
+			l.WithError(err).Errorln("failed to bind metal node")
+			return ctrl.Result{}, err
+		}
+		l.With("metalnode", node.Name).Infoln("metal node claim bound")
+		r.Recorder.Event(claim, corev1.EventTypeNormal, ClaimBoundReason, "bound to metal node "+node.Name)
+		setClaimBound(claim, node.Name)
+		return ctrl.Result{}, nil
+	}
+
+	claim.Status.Phase = v1beta1.ClaimPending
+	meta.SetStatusCondition(&claim.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.ClaimBoundCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  v1beta1.NoMatchingMetalNodeReason,
+		Message: "no available metal node matches the claim",
+	})
+	return ctrl.Result{RequeueAfter: claimPendingInterval}, nil
+}
+
+// reconcileDelete releases the metal node bound to the claim and removes the finalizer of the claim
+func (r *MetalNodeClaimReconciler) reconcileDelete(ctx context.Context, claim *v1beta1.MetalNodeClaim, l log.Logger) error {
+	if !controllerutil.ContainsFinalizer(claim, v1beta1.MetalNodeClaimFinalizer) {
+		return nil
+	}
+	nodes := &v1beta1.MetalNodeList{}
+	if err := r.List(ctx, nodes, client.InNamespace(claim.Namespace)); err != nil {
+		l.WithError(err).Errorln("failed to list metal nodes")
+		return err
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !claimedBy(node, claim) {
+			continue
+		}
+		node.Spec.ClaimRef = nil
+		node.ResetMetalNode()
+		if err := r.Update(ctx, node); err != nil {
+			l.WithError(err).Errorln("failed to release metal node")
+			return err
+		}
+		l.With("metalnode", node.Name).Infoln("metal node released")
+		r.Recorder.Event(claim, corev1.EventTypeNormal, ClaimReleasedReason, "released metal node "+node.Name)
+	}
+
+	controllerutil.RemoveFinalizer(claim, v1beta1.MetalNodeClaimFinalizer)
+	if err := r.Update(ctx, claim); err != nil {
+		l.WithError(err).Errorln("failed to remove metal node claim finalizer")
+		return err
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager, the pending claims are reconciled again
+// when a metal node of their namespace changes
+func (r *MetalNodeClaimReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("metalnodeclaim-controller")
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.MetalNodeClaim{}).
+		Watches(&source.Kind{Type: &v1beta1.MetalNode{}}, handler.EnqueueRequestsFromMapFunc(r.metalNodeToClaims)).
+		Complete(r)
+}
+
+// metalNodeToClaims returns the claims of the namespace of the metal node which are not bound,
+// and the claim bound to it
+func (r *MetalNodeClaimReconciler) metalNodeToClaims(obj client.Object) []reconcile.Request {
+	claims := &v1beta1.MetalNodeClaimList{}
+	if err := r.List(context.Background(), claims, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.WithError(err).Errorln("failed to list metal node claims")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, claim := range claims.Items {
+		if claim.Status.Phase != v1beta1.ClaimBound || claim.Status.NodeName == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: claim.Namespace, Name: claim.Name}})
+		}
+	}
+	return requests
+}
+
+// matchingMetalNodes returns the metal nodes which can be bound to the claim, by name
+func matchingMetalNodes(nodes []v1beta1.MetalNode, claim *v1beta1.MetalNodeClaim) ([]*v1beta1.MetalNode, error) {
+	selector := labels.Everything()
+	if claim.Spec.Selector != nil {
+		var err error
+		if selector, err = metav1.LabelSelectorAsSelector(claim.Spec.Selector); err != nil {
+			return nil, errors.Wrap(err, "invalid selector")
+		}
+	}
+	var matching []*v1beta1.MetalNode
+	for i := range nodes {
+		node := &nodes[i]
+		// the metal nodes allocated without a claim are not available either, nor the paused ones or in maintenance
+		if node.Spec.ClaimRef != nil || node.IsAllocated() || !node.Status.Ready || !node.DeletionTimestamp.IsZero() ||
+			node.IsPaused() || node.Spec.Maintenance {
+			continue
+		}
+		if !selector.Matches(labels.Set(node.Labels)) || !hasResources(node, claim.Spec.Resources) {
+			continue
+		}
+		matching = append(matching, node)
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].Name < matching[j].Name })
+	return matching, nil
+}
+
+// hasResources check the inventory of the metal node meets the resources, the capacity of a host without inventory is unknown
+func hasResources(node *v1beta1.MetalNode, resources v1beta1.ClaimResources) bool {
+	if resources.CPU == 0 && resources.Memory == nil {
+		return true
+	}
+	inventory := node.Status.Inventory
+	if inventory == nil {
+		return false
+	}
+	if inventory.CPU.Count < resources.CPU {
+		return false
+	}
+	return resources.Memory == nil || inventory.Memory != nil && inventory.Memory.Cmp(*resources.Memory) >= 0
+}
+
+// allocate returns a copy of the metal node bound to the claim, with the role, the cluster and the data secret
+// of the claim, the consumer is the controller of the claim such as a CAPI Machine
+func allocate(node *v1beta1.MetalNode, claim *v1beta1.MetalNodeClaim) *v1beta1.MetalNode {
+	allocated := node.DeepCopy()
+	allocated.Spec.ClaimRef = &corev1.ObjectReference{
+		APIVersion: v1beta1.GroupVersion.String(),
+		Kind:       "MetalNodeClaim",
+		Namespace:  claim.Namespace,
+		Name:       claim.Name,
+		UID:        claim.UID,
+	}
+	allocated.Spec.ClusterName = claim.Spec.Cluster
+	allocated.Spec.Roles = nil
+	if claim.Spec.Role != "" {
+		allocated.Spec.Roles = []string{claim.Spec.Role}
+	}
+	allocated.Spec.BootstrapDataSecretRef = nil
+	if claim.Spec.DataSecretName != "" {
+		allocated.Spec.BootstrapDataSecretRef = &corev1.LocalObjectReference{Name: claim.Spec.DataSecretName}
+	}
+	allocated.Spec.ConsumerRef = nil
+	if owner := metav1.GetControllerOf(claim); owner != nil {
+		allocated.Spec.ConsumerRef = &corev1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Namespace:  claim.Namespace,
+			Name:       owner.Name,
+			UID:        owner.UID,
+		}
+	}
+	return allocated
+}
+
+// claimedBy check the metal node is bound to the claim. The claim is matched by name, the uid changes
+// when the claim is moved by clusterctl move or restored from a backup, it is updated by the next allocation
+func claimedBy(node *v1beta1.MetalNode, claim *v1beta1.MetalNodeClaim) bool {
+	return node.Spec.ClaimRef != nil && node.Spec.ClaimRef.Namespace == claim.Namespace && node.Spec.ClaimRef.Name == claim.Name
+}
+
+func setClaimBound(claim *v1beta1.MetalNodeClaim, nodeName string) {
+	claim.Status.Phase = v1beta1.ClaimBound
+	claim.Status.NodeName = nodeName
+	meta.SetStatusCondition(&claim.Status.Conditions, metav1.Condition{
+		Type:    v1beta1.ClaimBoundCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  v1beta1.ClaimBoundReason,
+		Message: "bound to metal node " + nodeName,
+	})
+}
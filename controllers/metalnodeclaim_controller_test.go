@@ -0,0 +1,105 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMatchingMetalNodes(t *testing.T) {
+	node := func(name string, mutate func(mn *v1beta1.MetalNode)) v1beta1.MetalNode {
+		mn := v1beta1.MetalNode{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"role": "worker"}}}
+		mn.Status.Ready = true
+		mn.Status.Inventory = &v1beta1.Inventory{}
+		mn.Status.Inventory.CPU.Count = 8
+		memory := resource.MustParse("16Gi")
+		mn.Status.Inventory.Memory = &memory
+		if mutate != nil {
+			mutate(&mn)
+		}
+		return mn
+	}
+	now := metav1.Now()
+	nodes := []v1beta1.MetalNode{
+		node("worker-1", nil),
+		node("worker-0", nil),
+		node("claimed", func(mn *v1beta1.MetalNode) { mn.Spec.ClaimRef = &corev1.ObjectReference{Name: "claim"} }),
+		node("allocated", func(mn *v1beta1.MetalNode) { mn.Spec.ClusterName = "cluster" }),
+		node("not-ready", func(mn *v1beta1.MetalNode) { mn.Status.Ready = false }),
+		node("deleting", func(mn *v1beta1.MetalNode) { mn.DeletionTimestamp = &now }),
+		node("paused", func(mn *v1beta1.MetalNode) { mn.Annotations = map[string]string{v1beta1.PausedAnnotation: ""} }),
+		node("maintenance", func(mn *v1beta1.MetalNode) { mn.Spec.Maintenance = true }),
+		node("master", func(mn *v1beta1.MetalNode) { mn.Labels["role"] = "master" }),
+		node("small", func(mn *v1beta1.MetalNode) {
+			mn.Status.Inventory.CPU.Count = 2
+			memory := resource.MustParse("4Gi")
+			mn.Status.Inventory.Memory = &memory
+		}),
+		node("no-inventory", func(mn *v1beta1.MetalNode) { mn.Status.Inventory = nil }),
+	}
+	memory := resource.MustParse("8Gi")
+	tests := []struct {
+		name    string
+		spec    v1beta1.MetalNodeClaimSpec
+		want    []string
+		wantErr bool
+	}{
+		{name: "any", want: []string{"master", "no-inventory", "small", "worker-0", "worker-1"}},
+		{
+			name: "selector",
+			spec: v1beta1.MetalNodeClaimSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "worker"}}},
+			want: []string{"no-inventory", "small", "worker-0", "worker-1"},
+		},
+		{
+			name: "resources",
+			spec: v1beta1.MetalNodeClaimSpec{Resources: v1beta1.ClaimResources{CPU: 4, Memory: &memory}},
+			want: []string{"master", "worker-0", "worker-1"},
+		},
+		{
+			name: "no match",
+			spec: v1beta1.MetalNodeClaimSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "gpu"}}},
+		},
+		{
+			name: "invalid selector",
+			spec: v1beta1.MetalNodeClaimSpec{Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "role", Operator: "Unknown"},
+			}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matching, err := matchingMetalNodes(nodes, &v1beta1.MetalNodeClaim{Spec: tt.spec})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("matchingMetalNodes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, mn := range matching {
+				got = append(got, mn.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matchingMetalNodes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -19,12 +19,15 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -33,6 +36,7 @@ import (
 
 	metalv1beta1 "github.com/git-czy/cluster-api-metalnode/api/v1beta1"
 	"github.com/git-czy/cluster-api-metalnode/controllers"
+	"github.com/git-czy/cluster-api-metalnode/pkg/operation"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -52,11 +56,32 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxConcurrentReconciles int
+	var maxConcurrentOperations int
+	var healthCheckInterval time.Duration
+	var inventoryRefreshInterval time.Duration
+	var provisioningConfig string
+	var bundleDir string
+	var scriptDir string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The maximum number of MetalNodes reconciled at the same time.")
+	flag.IntVar(&maxConcurrentOperations, "max-concurrent-operations", 10,
+		"The maximum number of remote operations (initialize, check, bootstrap) running at the same time, 0 means no limit.")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", 5*time.Minute,
+		"How often the health of initialized MetalNodes is checked, 0 disables the health check.")
+	flag.DurationVar(&inventoryRefreshInterval, "inventory-refresh-interval", time.Hour,
+		"How often the hardware and os inventory of initialized MetalNodes is gathered again, 0 disables the refresh.")
+	flag.StringVar(&provisioningConfig, "provisioning-config", "metalnode-system/metalnode-provisioning-config",
+		"The namespace/name of the ConfigMap of the package mirrors, proxies and CA certificates applied to the hosts.")
+	flag.StringVar(&bundleDir, "bundle-dir", "",
+		"The directory of the offline bundle installed on the hosts instead of the package repositories, empty to provision online.")
+	flag.StringVar(&scriptDir, "script-dir", "",
+		"The directory of the init scripts replacing the ones embedded in the binary, such as a mounted ConfigMap.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,6 +90,16 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	provisioningConfigName := types.NamespacedName{}
+	if provisioningConfig != "" {
+		parts := strings.SplitN(provisioningConfig, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			setupLog.Info("invalid provisioning config, it must be namespace/name", "provisioning-config", provisioningConfig)
+			os.Exit(1)
+		}
+		provisioningConfigName = types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -78,13 +113,64 @@ func main() {
 		os.Exit(1)
 	}
 
+	operations := operation.NewTracker(maxConcurrentOperations)
 	if err = (&controllers.MetalNodeReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                   mgr.GetClient(),
+		Scheme:                   mgr.GetScheme(),
+		MaxConcurrentReconciles:  maxConcurrentReconciles,
+		Operations:               operations,
+		HealthCheckInterval:      healthCheckInterval,
+		InventoryRefreshInterval: inventoryRefreshInterval,
+		ProvisioningConfig:       provisioningConfigName,
+		BundleDir:                bundleDir,
+		ScriptDir:                scriptDir,
+		Recorder:                 mgr.GetEventRecorderFor("metalnode-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "MetalNode")
 		os.Exit(1)
 	}
+	if err = (&controllers.MetalNodeClaimReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("metalnodeclaim-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MetalNodeClaim")
+		os.Exit(1)
+	}
+	// the infrastructure provider of Cluster API only runs when Cluster API is installed
+	if _, err := mgr.GetRESTMapper().RESTMapping(controllers.ClusterGVK.GroupKind(), controllers.ClusterGVK.Version); err != nil {
+		setupLog.Info("Cluster API is not installed, the MetalCluster and MetalMachine controllers are disabled", "error", err.Error())
+	} else {
+		if err = (&controllers.MetalClusterReconciler{
+			Client:     mgr.GetClient(),
+			Scheme:     mgr.GetScheme(),
+			Operations: operations,
+			Recorder:   mgr.GetEventRecorderFor("metalcluster-controller"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "MetalCluster")
+			os.Exit(1)
+		}
+		if err = (&controllers.MetalMachineReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("metalmachine-controller"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "MetalMachine")
+			os.Exit(1)
+		}
+	}
+	// the webhooks need the certificates of cert-manager, disable them to run the manager out of the cluster
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		username := controllerUsername()
+		if username == "" {
+			setupLog.Info("POD_NAMESPACE or SERVICE_ACCOUNT_NAME is not set, " +
+				"the status and the inventory labels of the metal nodes are not protected from the other users")
+		}
+		if err = metalv1beta1.SetupMetalNodeWebhookWithManager(mgr, username); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "MetalNode")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -102,3 +188,13 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// controllerUsername returns the user of the service account of the manager,
+// from the POD_NAMESPACE and SERVICE_ACCOUNT_NAME set by the deployment
+func controllerUsername() string {
+	namespace, serviceAccount := os.Getenv("POD_NAMESPACE"), os.Getenv("SERVICE_ACCOUNT_NAME")
+	if namespace == "" || serviceAccount == "" {
+		return ""
+	}
+	return "system:serviceaccount:" + namespace + ":" + serviceAccount
+}
@@ -0,0 +1,93 @@
+package cloudinit
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// kubeadmConfigDir is where the kubeadm bootstrap provider writes the kubeadm configs, such as kubeadm.yaml
+	kubeadmConfigDir = "/run/kubeadm"
+
+	kubeadmInitConfiguration = "InitConfiguration"
+	kubeadmJoinConfiguration = "JoinConfiguration"
+)
+
+// isKubeadmConfig check if the file written is a kubeadm config
+func isKubeadmConfig(p string) bool {
+	return path.Dir(p) == kubeadmConfigDir && path.Ext(p) == ".yaml"
+}
+
+// setAdvertiseAddress sets the advertise address of the api server and the node ip of kubelet in the
+// InitConfiguration and the JoinConfiguration of the kubeadm config, the ones already set are kept.
+// The other documents of the config are not changed
+func setAdvertiseAddress(config string, address string) (string, error) {
+	return editKubeadmConfig(config, func(obj map[string]interface{}) {
+		var endpoint map[string]interface{}
+		if obj["kind"] == kubeadmInitConfiguration {
+			endpoint = child(obj, "localAPIEndpoint")
+		} else if controlPlane, ok := obj["controlPlane"].(map[string]interface{}); ok {
+			// only the control plane nodes run an api server
+			endpoint = child(controlPlane, "localAPIEndpoint")
+		}
+		if current, _ := endpoint["advertiseAddress"].(string); endpoint != nil && current == "" {
+			endpoint["advertiseAddress"] = address
+		}
+		setKubeletExtraArg(obj, "node-ip", address)
+	})
+}
+
+// setProviderID sets the provider id of kubelet in the InitConfiguration and the JoinConfiguration of the kubeadm config,
+// so Cluster API matches the node with its machine, the one already set is kept
+func setProviderID(config string, providerID string) (string, error) {
+	return editKubeadmConfig(config, func(obj map[string]interface{}) {
+		setKubeletExtraArg(obj, "provider-id", providerID)
+	})
+}
+
+// setKubeletExtraArg sets an extra arg of kubelet in the node registration of the kubeadm configuration unless it is set
+func setKubeletExtraArg(obj map[string]interface{}, name, value string) {
+	args := child(child(obj, "nodeRegistration"), "kubeletExtraArgs")
+	if _, ok := args[name]; !ok {
+		args[name] = value
+	}
+}
+
+// editKubeadmConfig calls edit with the InitConfiguration and the JoinConfiguration of the kubeadm config,
+// the other documents of the config are not changed
+func editKubeadmConfig(config string, edit func(obj map[string]interface{})) (string, error) {
+	docs := strings.Split(config, "\n---")
+	for i, doc := range docs {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return config, errors.Wrap(err, "failed to parse the kubeadm config")
+		}
+		if obj["kind"] != kubeadmInitConfiguration && obj["kind"] != kubeadmJoinConfiguration {
+			continue
+		}
+		edit(obj)
+
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return config, errors.Wrap(err, "failed to write the kubeadm config")
+		}
+		docs[i] = "\n" + string(data)
+		if i == 0 {
+			docs[i] = string(data)
+		}
+	}
+	return strings.Join(docs, "\n---"), nil
+}
+
+// child returns the map of the key of the parent map, created if it is not set
+func child(parent map[string]interface{}, key string) map[string]interface{} {
+	if m, ok := parent[key].(map[string]interface{}); ok {
+		return m
+	}
+	m := map[string]interface{}{}
+	parent[key] = m
+	return m
+}
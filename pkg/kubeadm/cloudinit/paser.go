@@ -11,6 +11,13 @@ const (
 
 type BootstrapDataParser struct {
 	actions []action
+
+	// AdvertiseAddress is set in the kubeadm configs written as the advertise address and the node ip,
+	// empty to let kubeadm pick the address of the default route
+	AdvertiseAddress string
+
+	// ProviderID is set in the kubeadm configs written as the provider id of kubelet, empty to keep the one of the configs
+	ProviderID string
 }
 
 func NewBootstrapDataParser() *BootstrapDataParser {
@@ -37,6 +44,10 @@ func (p *BootstrapDataParser) Parse(bootstrapData []byte, format []byte) (remote
 func (p *BootstrapDataParser) actionToRemoteCmd() (remote.Command, error) {
 	var command remote.Command
 	for _, action := range p.actions {
+		if a, ok := action.(*writeFilesAction); ok {
+			a.advertiseAddress = p.AdvertiseAddress
+			a.providerID = p.ProviderID
+		}
 		cmds, err := action.Commands()
 		if err != nil {
 			return command, err
@@ -14,6 +14,12 @@ import (
 
 type writeFilesAction struct {
 	Files []files `json:"write_files,"`
+
+	// advertiseAddress is set in the kubeadm configs, see setAdvertiseAddress
+	advertiseAddress string
+
+	// providerID is set in the kubeadm configs, see setProviderID
+	providerID string
 }
 
 type files struct {
@@ -41,6 +47,16 @@ func (a *writeFilesAction) Commands() (remote.Commands, error) {
 		if err != nil {
 			return nil, err
 		}
+		if a.advertiseAddress != "" && isKubeadmConfig(path) {
+			if content, err = setAdvertiseAddress(content, a.advertiseAddress); err != nil {
+				return nil, err
+			}
+		}
+		if a.providerID != "" && isKubeadmConfig(path) {
+			if content, err = setProviderID(content, a.providerID); err != nil {
+				return nil, err
+			}
+		}
 		// 创建文件目录
 		cmds = append(cmds, joinMkdirCmd(path))
 		// 写入文件
@@ -57,6 +73,35 @@ func (a *writeFilesAction) Commands() (remote.Commands, error) {
 	return cmds, nil
 }
 
+// AddWriteFile adds a file written before the other files to the cloud-config bootstrap data,
+// the content is encoded in base64 so it keeps its format
+func AddWriteFile(data []byte, path, permissions string, content []byte) ([]byte, error) {
+	entry, err := yaml.Marshal([]files{{
+		Path:        path,
+		Encoding:    "base64",
+		Permissions: permissions,
+		Content:     base64.StdEncoding.EncodeToString(content),
+	}})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write the file entry")
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != writefiles+":" {
+			continue
+		}
+		added := append(append([]string{}, lines[:i+1]...), strings.TrimSuffix(string(entry), "\n"))
+		return []byte(strings.Join(append(added, lines[i+1:]...), "\n")), nil
+	}
+	// the data without files starts with the #cloud-config header
+	block := writefiles + ":\n" + strings.TrimSuffix(string(entry), "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#") {
+		return []byte(strings.Join(append([]string{lines[0], block}, lines[1:]...), "\n")), nil
+	}
+	return []byte(block + "\n" + string(data)), nil
+}
+
 func joinMkdirCmd(path string) string {
 	return "sudo mkdir -p " + filepath.Dir(path)
 }
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "metalnode"
+
+// Reasons of ssh dial failures
+const (
+	DialFailureAuth    = "auth"
+	DialFailureTimeout = "timeout"
+	DialFailureRefused = "refused"
+	DialFailureHostKey = "host_key"
+	DialFailureOther   = "other"
+)
+
+var (
+	// SSHDialDuration is the latency of ssh dials, successful or not
+	SSHDialDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ssh_dial_duration_seconds",
+		Help:      "Latency of ssh dials to the hosts.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+
+	// SSHDialFailures counts the failed ssh dials by reason
+	SSHDialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ssh_dial_failures_total",
+		Help:      "Number of failed ssh dials to the hosts by reason (auth, timeout, refused, host_key, other).",
+	}, []string{"reason"})
+
+	// CommandsExecuted counts the commands run on the hosts
+	CommandsExecuted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "remote_commands_total",
+		Help:      "Number of commands executed on the hosts.",
+	})
+
+	// CommandsFailed counts the commands which could not run or exited with a non-zero status
+	CommandsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "remote_command_failures_total",
+		Help:      "Number of commands executed on the hosts which failed.",
+	})
+
+	// UploadedBytes counts the bytes uploaded to the hosts over sftp
+	UploadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Number of bytes uploaded to the hosts.",
+	})
+
+	// OperationsInFlight is the number of remote operations started and not done yet by operation
+	OperationsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "remote_operations_in_flight",
+		Help:      "Number of remote operations in flight by operation.",
+	}, []string{"operation"})
+
+	// InitializationDuration is the duration of the initializations (initialize and check) by result
+	InitializationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "initialization_duration_seconds",
+		Help:      "Duration of the MetalNode initializations by result.",
+		Buckets:   []float64{30, 60, 120, 300, 600, 900, 1200, 1800, 3600},
+	}, []string{"result"})
+
+	// BootstrapDuration is the duration of the bootstraps by result
+	BootstrapDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bootstrap_duration_seconds",
+		Help:      "Duration of the MetalNode bootstraps by result.",
+		Buckets:   []float64{10, 30, 60, 120, 300, 600, 900, 1800},
+	}, []string{"result"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		SSHDialDuration,
+		SSHDialFailures,
+		CommandsExecuted,
+		CommandsFailed,
+		UploadedBytes,
+		OperationsInFlight,
+		InitializationDuration,
+		BootstrapDuration,
+	)
+}
+
+// Result returns the result label of an operation which returned err
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// DialFailureReason classifies an error returned by a ssh dial
+func DialFailureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return DialFailureAuth
+	case strings.Contains(err.Error(), "host key"):
+		return DialFailureHostKey
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialFailureRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return DialFailureTimeout
+	default:
+		return DialFailureOther
+	}
+}
@@ -0,0 +1,153 @@
+package operation
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/git-czy/cluster-api-metalnode/pkg/metrics"
+)
+
+type Phase string
+
+const (
+	// Waiting denotes the operation waits for a free slot
+	Waiting Phase = "Waiting"
+	// Running denotes the operation is running
+	Running Phase = "Running"
+	// Done denotes the operation finished, its result can be read
+	Done Phase = "Done"
+)
+
+// Result is what an operation returns
+type Result struct {
+	// Stderr is the standard stderr the operation got
+	Stderr []string
+
+	// Output is the operation specific result, such as the results of a probe
+	Output interface{}
+}
+
+// Func is a long-running operation, it returns an error if it failed
+type Func func() (Result, error)
+
+// Operation is a snapshot of an operation started by a Tracker
+type Operation struct {
+	// ID identifies the operation among all the operations of the Tracker
+	ID        string
+	Name      string
+	StartTime time.Time
+	Phase     Phase
+
+	// Result and Err are set once the operation is Done
+	Result
+	Err error
+}
+
+// Tracker runs operations in background, at most one at a time per key.
+// The last operation of a key is kept until another one is started or the key is forgotten,
+// so its result can be read as many times as needed
+type Tracker struct {
+	mu         sync.Mutex
+	operations map[string]*Operation
+	slots      chan struct{}
+}
+
+// NewTracker returns a Tracker running at most maxConcurrent operations at the same time,
+// a maxConcurrent lower than 1 means no limit
+func NewTracker(maxConcurrent int) *Tracker {
+	t := &Tracker{
+		operations: make(map[string]*Operation),
+	}
+	if maxConcurrent > 0 {
+		t.slots = make(chan struct{}, maxConcurrent)
+	}
+	return t
+}
+
+// Start runs fn in background as the operation name of key and returns it,
+// if an operation of key is still running, it is returned instead and started is false
+func (t *Tracker) Start(key, name string, fn Func) (op Operation, started bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if running, ok := t.operations[key]; ok && running.Phase != Done {
+		return *running, false
+	}
+	now := time.Now()
+	o := &Operation{
+		ID:        fmt.Sprintf("%s-%d", name, now.UnixNano()),
+		Name:      name,
+		StartTime: now,
+		Phase:     Waiting,
+	}
+	t.operations[key] = o
+
+	go t.run(o, fn)
+	return *o, true
+}
+
+func (t *Tracker) run(op *Operation, fn Func) {
+	if t.slots != nil {
+		t.slots <- struct{}{}
+		defer func() { <-t.slots }()
+	}
+	t.setPhase(op, Running)
+	metrics.OperationsInFlight.WithLabelValues(op.Name).Inc()
+	defer metrics.OperationsInFlight.WithLabelValues(op.Name).Dec()
+
+	var (
+		result Result
+		err    error
+	)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("operation %s panicked: %v", op.Name, r)
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		op.Result = result
+		op.Err = err
+		op.Phase = Done
+	}()
+	result, err = fn()
+}
+
+func (t *Tracker) setPhase(op *Operation, phase Phase) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	op.Phase = phase
+}
+
+// Get returns a snapshot of the last operation of key
+func (t *Tracker) Get(key string) (Operation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	op, ok := t.operations[key]
+	if !ok {
+		return Operation{}, false
+	}
+	return *op, true
+}
+
+// Forget stops tracking the operations of key, a running operation keeps running but its result is dropped
+func (t *Tracker) Forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.operations, key)
+}
+
+// InFlight returns the number of operations not Done yet
+func (t *Tracker) InFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, op := range t.operations {
+		if op.Phase != Done {
+			n++
+		}
+	}
+	return n
+}
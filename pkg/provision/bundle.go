@@ -0,0 +1,169 @@
+package provision
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+)
+
+// Files of an offline bundle. The bundle directory is laid out as:
+//
+//	VERSION                          the version of the bundle, such as 1.23.5-1
+//	SHA256SUMS                       the output of sha256sum for all the files below, with paths relative to the bundle
+//	packages/<provisioner>/<arch>/   the rpm or deb packages installed, including the container runtime and kubeadm
+//	bin/<arch>/                      the binaries which are not packaged, such as cri-dockerd
+//	images/<arch>/                   the image tarballs imported into the container runtime
+//
+// where <provisioner> is the name of a provisioner, such as el7 or debian, and <arch> is the output of uname -m
+const (
+	bundleVersionFile   = "VERSION"
+	bundleChecksumsFile = "SHA256SUMS"
+
+	bundlePackagesDir = "packages"
+	bundleBinDir      = "bin"
+	bundleImagesDir   = "images"
+
+	// bundleRemoteDir is where the bundles are uploaded on the host, /tmp may be too small for the images
+	bundleRemoteDir = "/var/tmp/metalnode-bundle"
+
+	// bundleVerifiedFile is written in the remote directory of the bundle once its checksums are verified
+	bundleVerifiedFile = ".verified"
+)
+
+var bundleVersionRegexp = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._-]*$`)
+
+// Bundle is an offline bundle of the packages, binaries and container images installed on the hosts
+// which can't reach the package repositories and registries
+type Bundle struct {
+	// Dir is the local directory of the bundle
+	Dir string
+
+	// Version is the version of the bundle, read from its VERSION file
+	Version string
+
+	// checksums are the sha256 of the files of the bundle, by their paths relative to Dir
+	checksums map[string]string
+}
+
+// LoadBundle reads the version and the checksums of the bundle in dir
+func LoadBundle(dir string) (*Bundle, error) {
+	version, err := os.ReadFile(filepath.Join(dir, bundleVersionFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read bundle version")
+	}
+	b := &Bundle{
+		Dir:       dir,
+		Version:   strings.TrimSpace(string(version)),
+		checksums: map[string]string{},
+	}
+	if !bundleVersionRegexp.MatchString(b.Version) {
+		return nil, fmt.Errorf("invalid bundle version %q", b.Version)
+	}
+
+	f, err := os.Open(filepath.Join(dir, bundleChecksumsFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read bundle checksums")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 0123...cdef  packages/el7/x86_64/kubeadm-1.23.5-0.x86_64.rpm, the file is prefixed by * in binary mode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		b.checksums[path.Clean(strings.TrimPrefix(fields[1], "*"))] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read bundle checksums")
+	}
+	return b, nil
+}
+
+// Select returns the part of the bundle installed on the hosts of the provisioner and the architecture,
+// the files must be listed in SHA256SUMS
+func (b *Bundle) Select(provisioner *Provisioner, arch string) (*Bundle, error) {
+	if arch == "" {
+		return nil, errors.New("the architecture of the host is unknown")
+	}
+	prefixes := []string{
+		path.Join(bundlePackagesDir, provisioner.Name, arch) + "/",
+		path.Join(bundleBinDir, arch) + "/",
+		path.Join(bundleImagesDir, arch) + "/",
+	}
+	selected := &Bundle{Dir: b.Dir, Version: b.Version, checksums: map[string]string{}}
+	packages := 0
+	for file, sum := range b.checksums {
+		for i, prefix := range prefixes {
+			// the sub directories are not uploaded
+			if !strings.HasPrefix(file, prefix) || strings.Contains(strings.TrimPrefix(file, prefix), "/") {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(b.Dir, filepath.FromSlash(file))); err != nil {
+				return nil, errors.Wrapf(err, "bundle %s is incomplete", b.Version)
+			}
+			selected.checksums[file] = sum
+			if i == 0 {
+				packages++
+			}
+		}
+	}
+	if packages == 0 {
+		return nil, fmt.Errorf("bundle %s has no packages for %s %s", b.Version, provisioner.Name, arch)
+	}
+	return selected, nil
+}
+
+// remoteDir is the directory of the bundle on the host
+func (b *Bundle) remoteDir() string {
+	return path.Join(bundleRemoteDir, b.Version)
+}
+
+// files returns the files of the bundle, sorted
+func (b *Bundle) files() []string {
+	files := make([]string, 0, len(b.checksums))
+	for file := range b.checksums {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// upload uploads the files of the bundle to the packages, bin and images directories of remoteDir
+func (b *Bundle) upload() remote.Command {
+	cmd := remote.Command{}
+	for _, file := range b.files() {
+		cmd.FileUp = append(cmd.FileUp, remote.File{
+			Src: filepath.Join(b.Dir, filepath.FromSlash(file)),
+			Dst: path.Join(b.remoteDir(), strings.SplitN(file, "/", 2)[0]),
+		})
+	}
+	return cmd
+}
+
+// verifyCmd verifies the checksums of the bundle uploaded to dir, it exits with a non-zero status if they don't
+// match and writes bundleVerifiedFile in dir otherwise. The file of an upload which failed before is removed first
+func (b *Bundle) verifyCmd(dir string) string {
+	files := b.files()
+	sums := make([]string, 0, len(files))
+	for _, file := range files {
+		sums = append(sums, shellQuote(b.checksums[file]+"  "+path.Join(strings.SplitN(file, "/", 2)[0], path.Base(file))))
+	}
+	return fmt.Sprintf("cd %s && rm -f %s && printf '%%s\\n' %s | sha256sum -c --quiet && touch %s",
+		dir, bundleVerifiedFile, strings.Join(sums, " "), bundleVerifiedFile)
+}
+
+// guardCmd returns cmd run only if the bundle uploaded to dir was verified by verifyCmd, the exit status
+// of the commands of a remote.Command is not checked
+func guardCmd(dir, cmd string) string {
+	return fmt.Sprintf("if test -f %s; then %s; else echo 'the checksums of the offline bundle do not match' >&2; exit 1; fi",
+		path.Join(dir, bundleVerifiedFile), cmd)
+}
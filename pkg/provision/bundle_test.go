@@ -0,0 +1,174 @@
+package provision
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeBundle writes a bundle with the files in dir, their checksums are listed in SHA256SUMS
+// unless they are overridden by sums
+func writeBundle(t *testing.T, dir string, files map[string]string, sums map[string]string) *Bundle {
+	t.Helper()
+	var lines []string
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(content))
+		checksum := hex.EncodeToString(sum[:])
+		if s, ok := sums[name]; ok {
+			checksum = s
+		}
+		lines = append(lines, checksum+"  "+name)
+	}
+	sort.Strings(lines)
+	if err := os.WriteFile(filepath.Join(dir, bundleVersionFile), []byte("1.23.5-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleChecksumsFile), []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBundle(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBundleSelect(t *testing.T) {
+	files := map[string]string{
+		"packages/el7/x86_64/kubeadm.rpm":     "el7 x86_64",
+		"packages/el7/aarch64/kubeadm.rpm":    "el7 aarch64",
+		"packages/debian/x86_64/kubeadm.deb":  "debian x86_64",
+		"packages/el7/x86_64/extra/other.rpm": "sub directory",
+		"bin/x86_64/cri-dockerd":              "cri-dockerd",
+		"images/x86_64/pause.tar":             "pause",
+		"images/aarch64/pause.tar":            "pause aarch64",
+	}
+	tests := []struct {
+		name        string
+		provisioner string
+		arch        string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name:        "el7 x86_64",
+			provisioner: "el7",
+			arch:        "x86_64",
+			want: []string{
+				"bin/x86_64/cri-dockerd",
+				"images/x86_64/pause.tar",
+				"packages/el7/x86_64/kubeadm.rpm",
+			},
+		},
+		{
+			name:        "el7 aarch64",
+			provisioner: "el7",
+			arch:        "aarch64",
+			want:        []string{"images/aarch64/pause.tar", "packages/el7/aarch64/kubeadm.rpm"},
+		},
+		{name: "no packages for the provisioner", provisioner: "openeuler", arch: "x86_64", wantErr: true},
+		{name: "no packages for the architecture", provisioner: "debian", arch: "aarch64", wantErr: true},
+		{name: "unknown architecture", provisioner: "el7", wantErr: true},
+	}
+	b := writeBundle(t, t.TempDir(), files, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := b.Select(&Provisioner{Name: tt.provisioner}, tt.arch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Select() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := selected.files(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Select() files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBundleSelectIncomplete(t *testing.T) {
+	dir := t.TempDir()
+	b := writeBundle(t, dir, map[string]string{
+		"packages/el7/x86_64/kubeadm.rpm": "kubeadm",
+		"images/x86_64/pause.tar":         "pause",
+	}, nil)
+	if err := os.Remove(filepath.Join(dir, "images", "x86_64", "pause.tar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Select(&Provisioner{Name: "el7"}, "x86_64"); err == nil {
+		t.Error("Select() of a bundle missing a file succeeded")
+	}
+}
+
+// TestBundleVerify runs the verification of the bundle and a command installing it on the files as uploaded
+func TestBundleVerify(t *testing.T) {
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum is not installed")
+	}
+	tests := []struct {
+		name          string
+		sums          map[string]string
+		verified      bool
+		wantInstalled bool
+	}{
+		{name: "checksums match", wantInstalled: true},
+		{
+			name:     "checksum mismatch",
+			sums:     map[string]string{"images/x86_64/pause.tar": strings.Repeat("0", 64)},
+			verified: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := writeBundle(t, t.TempDir(), map[string]string{
+				"packages/el7/x86_64/kubeadm.rpm": "kubeadm",
+				"images/x86_64/pause.tar":         "pause",
+			}, tt.sums)
+
+			// the files are uploaded to the packages, bin and images directories of the remote directory
+			remote := t.TempDir()
+			for _, file := range b.upload().FileUp {
+				content, err := os.ReadFile(file.Src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dst := filepath.Join(remote, filepath.Base(file.Dst), filepath.Base(file.Src))
+				if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(dst, content, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.verified {
+				// left by an earlier upload which was verified
+				if err := os.WriteFile(filepath.Join(remote, bundleVerifiedFile), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := exec.Command("sh", "-c", b.verifyCmd(remote)).Run()
+			if (err == nil) != tt.wantInstalled {
+				t.Errorf("verify error = %v, want checksums matching %v", err, tt.wantInstalled)
+			}
+			installed := filepath.Join(remote, "installed")
+			_ = exec.Command("sh", "-c", guardCmd(remote, "touch "+installed)).Run()
+			if _, err := os.Stat(installed); (err == nil) != tt.wantInstalled {
+				t.Errorf("installed = %v, want %v", err == nil, tt.wantInstalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package provision
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Provisioner initializes the k8s env of the hosts of a distribution family
+type Provisioner struct {
+	// Name is the name of the distribution family, such as el7, el, debian
+	Name string
+
+	// Script is the name of the init script run on the host, see LoadScripts
+	Script string
+
+	// distros are the IDs of /etc/os-release handled, with the major versions supported
+	distros map[string][]int
+}
+
+var provisioners = []*Provisioner{
+	{
+		Name:   "el7",
+		Script: "init_k8s_env.sh",
+		distros: map[string][]int{
+			"centos": {7},
+			"rhel":   {7},
+		},
+	},
+	{
+		Name:   "el",
+		Script: "init_k8s_env_el.sh",
+		distros: map[string][]int{
+			"centos":    {8, 9},
+			"rhel":      {8, 9},
+			"rocky":     {8, 9},
+			"almalinux": {8, 9},
+		},
+	},
+	{
+		Name:   "debian",
+		Script: "init_k8s_env_debian.sh",
+		distros: map[string][]int{
+			"ubuntu": {18, 20, 22},
+			"debian": {10, 11},
+		},
+	},
+	{
+		Name:   "openeuler",
+		Script: "init_k8s_env_openeuler.sh",
+		distros: map[string][]int{
+			"openeuler": {20, 21, 22},
+		},
+	},
+}
+
+// UnsupportedOSError is returned when no provisioner handles the os of the host
+type UnsupportedOSError struct {
+	Distro  string
+	Version string
+}
+
+func (e *UnsupportedOSError) Error() string {
+	if e.Distro == "" {
+		return "unsupported os: the distribution of the host is unknown"
+	}
+	return fmt.Sprintf("unsupported os %s %s", e.Distro, e.Version)
+}
+
+// ForOS returns the provisioner of the distribution with the ID and VERSION_ID of /etc/os-release
+func ForOS(distro, version string) (*Provisioner, error) {
+	id := strings.ToLower(distro)
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return nil, &UnsupportedOSError{Distro: distro, Version: version}
+	}
+	for _, p := range provisioners {
+		for _, supported := range p.distros[id] {
+			if supported == major {
+				return p, nil
+			}
+		}
+	}
+	return nil, &UnsupportedOSError{Distro: distro, Version: version}
+}
+
+// Container runtimes supported by the init scripts
+const (
+	Containerd = "containerd"
+	CRIO       = "cri-o"
+	// Docker is served to kubelet by cri-dockerd
+	Docker = "docker"
+)
+
+// the scripts sourced by the init scripts
+const (
+	// hostSettingsScript applies the repositories, proxies and CA certificates to the host
+	hostSettingsScript = "host_settings.sh"
+	// runtimeScript installs the container runtime
+	runtimeScript = "container_runtime.sh"
+)
+
+// Options are passed to the init script, an empty option takes the default of the script
+type Options struct {
+	// KubernetesVersion is the version of kubelet, kubeadm and kubectl, such as 1.23.5 or v1.23.5,
+	// the latest one is installed if empty
+	KubernetesVersion string
+
+	// ContainerRuntime is the container runtime installed, containerd if empty
+	ContainerRuntime string
+
+	// ContainerRuntimeVersion is the version of the container runtime, such as 1.6.4,
+	// the latest one is installed if empty
+	ContainerRuntimeVersion string
+
+	// SandboxImage is the pause image of the container runtime, registry.k8s.io/pause:3.6 if empty
+	SandboxImage string
+
+	// RegistryMirrors are the mirrors of docker.io, the images are pulled from docker.io if empty
+	RegistryMirrors []string
+
+	// OSRepo is the base url of the mirror of the os repositories, the repositories of the host are kept if empty
+	OSRepo string
+
+	// OSRepoFiles are the urls of repository files added to the package manager of the host,
+	// such as https://mirrors.aliyun.com/repo/epel-7.repo
+	OSRepoFiles []string
+
+	// DockerRepo is the base url of the docker-ce repositories, https://download.docker.com if empty
+	DockerRepo string
+
+	// KubernetesRepo is the base url of the kubernetes repositories, with the yum and apt sub directories,
+	// https://packages.cloud.google.com if empty
+	KubernetesRepo string
+
+	// HTTPProxy, HTTPSProxy and NoProxy are used by the package managers and the container runtime
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+
+	// CACertificates is a PEM bundle of the certificates trusted by the host, such as the one of a private registry
+	CACertificates string
+
+	// Bundle is the offline bundle installed on the host instead of the repositories, nil to install online
+	Bundle *Bundle
+
+	// Hostname is the hostname set by the set-hostname module
+	Hostname string
+}
+
+var versionRegexp = regexp.MustCompile(`^v?[0-9]+(\.[0-9]+){0,2}([-~+][0-9A-Za-z.~+-]*)?$`)
+
+// Validate check the options can be passed to the init script
+func (o Options) Validate() error {
+	for _, version := range []string{o.KubernetesVersion, o.ContainerRuntimeVersion} {
+		if version != "" && !versionRegexp.MatchString(version) {
+			return fmt.Errorf("invalid version %q", version)
+		}
+	}
+	switch o.ContainerRuntime {
+	case "", Containerd, CRIO, Docker:
+	default:
+		return fmt.Errorf("unsupported container runtime %q", o.ContainerRuntime)
+	}
+	for _, mirror := range o.RegistryMirrors {
+		if strings.ContainsAny(mirror, ", ") {
+			return fmt.Errorf("invalid registry mirror %q", mirror)
+		}
+	}
+	if errs := validation.IsDNS1123Subdomain(o.Hostname); o.Hostname != "" && len(errs) != 0 {
+		return fmt.Errorf("invalid hostname %q: %s", o.Hostname, strings.Join(errs, ", "))
+	}
+	for _, file := range o.OSRepoFiles {
+		// the files are downloaded under the last element of their url
+		if strings.ContainsAny(file, ", '\n") || strings.HasSuffix(file, "/") {
+			return fmt.Errorf("invalid repository file %q", file)
+		}
+	}
+	for _, repo := range []string{o.OSRepo, o.DockerRepo, o.KubernetesRepo} {
+		// the repositories are substituted in sed expressions and repo files
+		if strings.ContainsAny(repo, " |#+\n") {
+			return fmt.Errorf("invalid repository %q", repo)
+		}
+	}
+	return nil
+}
+
+// env returns the environment variables passing the options to the init script
+func (o Options) env() string {
+	var env []string
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, name+"="+shellQuote(value))
+		}
+	}
+	add("KUBERNETES_VERSION", strings.TrimPrefix(o.KubernetesVersion, "v"))
+	add("CONTAINER_RUNTIME", o.ContainerRuntime)
+	add("CONTAINER_RUNTIME_VERSION", strings.TrimPrefix(o.ContainerRuntimeVersion, "v"))
+	add("SANDBOX_IMAGE", o.SandboxImage)
+	add("REGISTRY_MIRRORS", strings.Join(o.RegistryMirrors, ","))
+	add("OS_REPO", strings.TrimSuffix(o.OSRepo, "/"))
+	add("OS_REPO_FILES", strings.Join(o.OSRepoFiles, ","))
+	add("DOCKER_REPO", strings.TrimSuffix(o.DockerRepo, "/"))
+	add("KUBERNETES_REPO", strings.TrimSuffix(o.KubernetesRepo, "/"))
+	add("HTTP_PROXY", o.HTTPProxy)
+	add("HTTPS_PROXY", o.HTTPSProxy)
+	add("NO_PROXY", o.NoProxy)
+	if o.CACertificates != "" {
+		add("CA_CERTIFICATES", base64.StdEncoding.EncodeToString([]byte(o.CACertificates)))
+	}
+	if o.Bundle != nil {
+		add("BUNDLE_DIR", o.Bundle.remoteDir())
+	}
+	return strings.Join(env, " ")
+}
+
+// shellQuote quotes s as a single argument of a shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
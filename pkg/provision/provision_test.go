@@ -0,0 +1,92 @@
+package provision
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestForOS(t *testing.T) {
+	tests := []struct {
+		distro  string
+		version string
+		want    string
+	}{
+		{distro: "centos", version: "7", want: "el7"},
+		{distro: "rhel", version: "7.9", want: "el7"},
+		{distro: "CentOS", version: "8", want: "el"},
+		{distro: "rocky", version: "9.1", want: "el"},
+		{distro: "almalinux", version: "8.7", want: "el"},
+		{distro: "ubuntu", version: "22.04", want: "debian"},
+		{distro: "debian", version: "11", want: "debian"},
+		{distro: "openEuler", version: "22.03", want: "openeuler"},
+		{distro: "ubuntu", version: "16.04"},
+		{distro: "centos", version: "6"},
+		{distro: "fedora", version: "37"},
+		{distro: "centos", version: ""},
+		{distro: "", version: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.distro+"-"+tt.version, func(t *testing.T) {
+			p, err := ForOS(tt.distro, tt.version)
+			if tt.want == "" {
+				var unsupported *UnsupportedOSError
+				if !errors.As(err, &unsupported) {
+					t.Fatalf("ForOS() error = %v, want UnsupportedOSError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ForOS() error = %v", err)
+			}
+			if p.Name != tt.want {
+				t.Errorf("ForOS() = %s, want %s", p.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		wantErr bool
+	}{
+		{name: "defaults", options: Options{}},
+		{name: "versions", options: Options{KubernetesVersion: "v1.23.5", ContainerRuntime: Docker, ContainerRuntimeVersion: "20.10.17~3-0"}},
+		{name: "version with deb epoch", options: Options{ContainerRuntimeVersion: "5:20.10.17~3-0~ubuntu-focal"}, wantErr: true},
+		{name: "version with suffix", options: Options{KubernetesVersion: "1.23.5-00", ContainerRuntimeVersion: "1.6.4"}},
+		{name: "major version", options: Options{KubernetesVersion: "1"}},
+		{name: "invalid version", options: Options{KubernetesVersion: "1.23; rm -rf /"}, wantErr: true},
+		{name: "runtimes", options: Options{ContainerRuntime: CRIO}},
+		{name: "unsupported runtime", options: Options{ContainerRuntime: "rkt"}, wantErr: true},
+		{name: "registry mirrors", options: Options{RegistryMirrors: []string{"https://mirror.example.com"}}},
+		{name: "registry mirror with comma", options: Options{RegistryMirrors: []string{"https://a.example.com,https://b.example.com"}}, wantErr: true},
+		{name: "hostname", options: Options{Hostname: "worker-0.example.com"}},
+		{name: "invalid hostname", options: Options{Hostname: "Worker_0"}, wantErr: true},
+		{name: "repositories", options: Options{OSRepo: "https://mirrors.example.com/centos/", KubernetesRepo: "http://10.0.0.1/kubernetes"}},
+		{name: "repository with sed delimiter", options: Options{OSRepo: "https://mirrors.example.com/a|b"}, wantErr: true},
+		{name: "repository with space", options: Options{DockerRepo: "https://example.com/docker ce"}, wantErr: true},
+		{name: "repository files", options: Options{OSRepoFiles: []string{"https://mirrors.example.com/repo/epel-7.repo"}}},
+		{name: "repository file without name", options: Options{OSRepoFiles: []string{"https://mirrors.example.com/repo/"}}, wantErr: true},
+		{name: "repository file with comma", options: Options{OSRepoFiles: []string{"https://example.com/a.repo,b.repo"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetsHostname(t *testing.T) {
+	if !SetsHostname(DefaultSteps()) {
+		t.Errorf("SetsHostname() of the default steps = false, want true")
+	}
+	if SetsHostname([]Step{{Name: "initializationCmd", Commands: []string{"true"}}}) {
+		t.Errorf("SetsHostname() of commands = true, want false")
+	}
+	if !SetsHostname([]Step{{Name: "hostname", Module: "set-hostname"}, {Name: "kernel", Module: "configure-kernel"}}) {
+		t.Errorf("SetsHostname() of a profile setting the hostname = false, want true")
+	}
+}
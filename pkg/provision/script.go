@@ -0,0 +1,48 @@
+package provision
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/git-czy/cluster-api-metalnode/script"
+	"github.com/pkg/errors"
+)
+
+// Scripts are the contents of the init scripts uploaded to the host, by file name
+type Scripts map[string][]byte
+
+// LoadScripts reads the init scripts of the provisioner, the scripts found in overrideDir replace the ones
+// embedded in the binary, e.g. overrideDir is a mounted ConfigMap
+func LoadScripts(provisioner *Provisioner, overrideDir string) (Scripts, error) {
+	scripts := make(Scripts)
+	for _, name := range []string{hostSettingsScript, runtimeScript, provisioner.Script} {
+		if overrideDir != "" {
+			content, err := os.ReadFile(filepath.Join(overrideDir, name))
+			if err == nil {
+				scripts[name] = content
+				continue
+			}
+			if !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "failed to read script %s", name)
+			}
+		}
+		content, err := script.FS.ReadFile(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read embedded script %s", name)
+		}
+		scripts[name] = content
+	}
+	return scripts, nil
+}
+
+// Hashes returns the sha256 of the scripts, by file name
+func (s Scripts) Hashes() map[string]string {
+	hashes := make(map[string]string, len(s))
+	for name, content := range s {
+		sum := sha256.Sum256(content)
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
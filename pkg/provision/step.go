@@ -0,0 +1,183 @@
+package provision
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/git-czy/cluster-api-metalnode/api/v1beta1"
+	"github.com/git-czy/cluster-api-metalnode/pkg/remote"
+	"github.com/pkg/errors"
+)
+
+// stepsRemoteDir is where the scripts and the files of the steps are uploaded on the host
+const stepsRemoteDir = "/tmp/metalnode-steps"
+
+// defaultModules are the built-in modules run by the default steps, in order
+var defaultModules = []string{
+	v1beta1.ModulePrepareHost,
+	v1beta1.ModuleInstallRuntime,
+	v1beta1.ModuleConfigureKernel,
+	v1beta1.ModuleConfigureSystem,
+	v1beta1.ModuleInstallKubeadm,
+	v1beta1.ModuleSetHostname,
+}
+
+// Step is a step of the initialization, one of Module, Script or Commands runs after Files are uploaded
+type Step struct {
+	// Name identifies the step
+	Name string
+
+	// Module is a built-in module
+	Module string
+
+	// Script is the content of a script run with bash as root
+	Script string
+
+	// Commands are run one by one as the ssh user
+	Commands []string
+
+	// Files are uploaded to the host before the step runs
+	Files []File
+}
+
+// File is a file uploaded to the host by a step
+type File struct {
+	// Path is the absolute path of the file on the host
+	Path string
+
+	// Mode is the permission of the file
+	Mode int32
+
+	// Content is the content of the file
+	Content []byte
+}
+
+// DefaultSteps returns the steps running all the built-in modules
+func DefaultSteps() []Step {
+	steps := make([]Step, 0, len(defaultModules))
+	for _, module := range defaultModules {
+		steps = append(steps, Step{Name: module, Module: module})
+	}
+	return steps
+}
+
+// NeedsProvisioner check if one of the steps runs a module of the init script of the distribution
+func NeedsProvisioner(steps []Step) bool {
+	for _, step := range steps {
+		if step.Module != "" && step.Module != v1beta1.ModuleSetHostname {
+			return true
+		}
+	}
+	return false
+}
+
+// SetsHostname check if one of the steps runs the set-hostname module, which needs the Hostname of the options
+func SetsHostname(steps []Step) bool {
+	for _, step := range steps {
+		if step.Module == v1beta1.ModuleSetHostname {
+			return true
+		}
+	}
+	return false
+}
+
+// BundleCommand returns the command uploading the offline bundle of the options to the host and the command verifying
+// its checksums, which exits with a non-zero status if they don't match. They must succeed before the command
+// returned by Command is run, ok is false if the steps don't install the bundle
+func BundleCommand(options Options, steps []Step) (upload remote.Command, verify string, ok bool) {
+	if options.Bundle == nil || !NeedsProvisioner(steps) {
+		return upload, "", false
+	}
+	return options.Bundle.upload(), options.Bundle.verifyCmd(options.Bundle.remoteDir()), true
+}
+
+// Command returns the command running the steps on the host, the init scripts of the provisioner are uploaded if a step
+// runs one of their modules, which don't run if the offline bundle uploaded by BundleCommand was not verified.
+// The init scripts and the scripts and the files of the steps are written to the local directory dir to be uploaded,
+// provisioner and scripts may be nil if no step needs them
+func Command(provisioner *Provisioner, scripts Scripts, options Options, steps []Step, dir string) (remote.Command, error) {
+	cmd := remote.Command{}
+	needsProvisioner := NeedsProvisioner(steps)
+	if needsProvisioner {
+		if provisioner == nil {
+			return cmd, errors.New("the built-in modules do not support the os of the host")
+		}
+		for _, name := range []string{hostSettingsScript, runtimeScript, provisioner.Script} {
+			content, ok := scripts[name]
+			if !ok {
+				return cmd, errors.Errorf("script %s is not loaded", name)
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+				return cmd, errors.Wrapf(err, "failed to write script %s", name)
+			}
+			script := path.Join("/tmp", name)
+			cmd.Cmds = append(cmd.Cmds,
+				"sudo chmod +x "+script,
+				"sudo sed -i 's/\\r//g' "+script,
+			)
+			cmd.FileUp = append(cmd.FileUp, remote.File{Src: filepath.Join(dir, name), Dst: "/tmp"})
+		}
+	}
+
+	sudo := "sudo "
+	if env := options.env(); env != "" {
+		sudo += env + " "
+	}
+	uploaded := false
+	for i, step := range steps {
+		localDir := filepath.Join(dir, strconv.Itoa(i))
+		remoteDir := path.Join(stepsRemoteDir, strconv.Itoa(i))
+		upload := func(name string, content []byte) error {
+			if err := os.MkdirAll(localDir, 0700); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(localDir, name), content, 0600); err != nil {
+				return err
+			}
+			cmd.FileUp = append(cmd.FileUp, remote.File{Src: filepath.Join(localDir, name), Dst: remoteDir})
+			uploaded = true
+			return nil
+		}
+
+		for j, file := range step.Files {
+			name := "file-" + strconv.Itoa(j)
+			if err := upload(name, file.Content); err != nil {
+				return cmd, errors.Wrapf(err, "failed to write the files of step %s", step.Name)
+			}
+			cmd.Cmds = append(cmd.Cmds, fmt.Sprintf("sudo install -D -m %04o %s %s",
+				file.Mode, path.Join(remoteDir, name), shellQuote(file.Path)))
+		}
+
+		switch {
+		case step.Module == v1beta1.ModuleSetHostname:
+			cmd.Cmds = append(cmd.Cmds, "sudo hostnamectl set-hostname "+shellQuote(options.Hostname))
+		case step.Module != "":
+			module := sudo + "MODULE=" + step.Module + " /bin/bash " + path.Join("/tmp", provisioner.Script)
+			if options.Bundle != nil {
+				// the modules install the bundle, they must not run if it is corrupted
+				module = guardCmd(options.Bundle.remoteDir(), module)
+			}
+			cmd.Cmds = append(cmd.Cmds, module)
+		case step.Script != "":
+			if err := upload("script.sh", []byte(strings.ReplaceAll(step.Script, "\r", ""))); err != nil {
+				return cmd, errors.Wrapf(err, "failed to write the script of step %s", step.Name)
+			}
+			cmd.Cmds = append(cmd.Cmds, sudo+"/bin/bash "+path.Join(remoteDir, "script.sh"))
+		default:
+			cmd.Cmds = append(cmd.Cmds, step.Commands...)
+		}
+	}
+
+	if needsProvisioner && options.Bundle != nil {
+		cmd.Cmds = append(cmd.Cmds, "sudo rm -rf "+bundleRemoteDir)
+	}
+	// the files may hold secrets
+	if uploaded {
+		cmd.Cmds = append(cmd.Cmds, "sudo rm -rf "+stepsRemoteDir)
+	}
+	return cmd, nil
+}
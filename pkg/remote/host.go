@@ -3,14 +3,23 @@ package remote
 import (
 	"fmt"
 	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// DefaultPort is the ssh port of the hosts which don't set one
+const DefaultPort = 22
+
 type Host struct {
 	User     string
 	Password string
-	Address  string
-	Port     int
-	SSHKey   string
+	// Address is the IP address or the DNS name of the host
+	Address string
+	// Addresses are the other addresses of the host, tried in order when Address can't be connected
+	Addresses []string
+	Port      int
+	SSHKey    string
 }
 
 func (h *Host) Validate() (*Host, error) {
@@ -24,8 +33,10 @@ func (h *Host) Validate() (*Host, error) {
 	if h.Address == "" {
 		return nil, fmt.Errorf("Host address is required ")
 	}
-	if a := net.ParseIP(h.Address); a == nil {
-		return nil, fmt.Errorf("Host's address not a valid IP address ")
+	for _, address := range append([]string{h.Address}, h.Addresses...) {
+		if !ValidAddress(address) {
+			return nil, fmt.Errorf("Host's address %s is neither an IP address nor a DNS name ", address)
+		}
 	}
 	if h.Port < 0 {
 		return nil, fmt.Errorf("Host's port must be greater than zero ")
@@ -36,3 +47,8 @@ func (h *Host) Validate() (*Host, error) {
 func (h Host) Fields() (string, string, string, int, string) {
 	return h.User, h.Password, h.Address, h.Port, h.SSHKey
 }
+
+// ValidAddress check the address is an IP address or a DNS name, IPv6 addresses are not enclosed in brackets
+func ValidAddress(address string) bool {
+	return net.ParseIP(address) != nil || len(validation.IsDNS1123Subdomain(strings.ToLower(address))) == 0
+}
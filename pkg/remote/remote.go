@@ -54,6 +54,11 @@ func run(h Host, cmd Command, stopChan chan bool, stderrsChan chan map[string][]
 	RemoteClient, err := NewRemoteClient(&h)
 
 	if err != nil || RemoteClient == nil {
+		// report the connection failure as stderr, or the host would look like it ran cmd fine
+		if err != nil {
+			stderrs[h.Address] = append(stderrs[h.Address], (&ConnectionError{Address: h.Address, Err: err}).Error())
+		}
+		stderrsChan <- stderrs
 		stopChan <- true
 		return
 	}
@@ -84,6 +89,87 @@ func run(h Host, cmd Command, stopChan chan bool, stderrsChan chan map[string][]
 
 }
 
+// ConnectionError is returned when the remote host can't be connected
+type ConnectionError struct {
+	Address string
+	Err     error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("failed to connect to %s: %v", e.Address, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// UploadError is returned when a file can't be uploaded to the remote host
+type UploadError struct {
+	File string
+	Err  error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("failed to upload %s: %v", e.File, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// RunOnHost executes cmd on a single remote host like Run, and returns the standard stderr,
+// the error is set when the host can't be connected (ConnectionError), a file can't be uploaded (UploadError)
+// or a command can't be run
+func RunOnHost(h Host, cmd Command) ([]string, error) {
+	c, err := NewRemoteClient(&h)
+	if err != nil {
+		return nil, &ConnectionError{Address: h.Address, Err: err}
+	}
+	defer c.Close()
+
+	for _, file := range cmd.FileUp {
+		if err := c.SFTP.UploadFile(file.Src, file.Dst); err != nil {
+			return nil, &UploadError{File: file.Src, Err: err}
+		}
+	}
+
+	var stderrs []string
+	for _, command := range cmd.List() {
+		stderr, err := c.SSH.Exec(command)
+		stderrs = append(stderrs, stderr...)
+		if err != nil {
+			return stderrs, err
+		}
+	}
+	return stderrs, nil
+}
+
+// Result is the result of a command executed by Exec
+type Result struct {
+	Cmd    string
+	Stdout string
+	Stderr string
+	// Err is set when the command can't be run or exits with a non-zero status
+	Err error
+}
+
+// Exec executes cmds one by one on the remote host through a single connection and returns their results,
+// the error is only set when the host can't be connected (ConnectionError)
+func Exec(h Host, cmds ...string) ([]Result, error) {
+	c, err := NewRemoteClient(&h)
+	if err != nil {
+		return nil, &ConnectionError{Address: h.Address, Err: err}
+	}
+	defer c.Close()
+
+	results := make([]Result, 0, len(cmds))
+	for _, cmd := range cmds {
+		stdout, stderr, err := c.SSH.Output(cmd)
+		results = append(results, Result{Cmd: cmd, Stdout: stdout, Stderr: stderr, Err: err})
+	}
+	return results, nil
+}
+
 // NewRemoteClient 新建远程客户端
 func NewRemoteClient(h *Host) (*Cli, error) {
 	var err error
@@ -111,17 +197,27 @@ func NewRemoteClient(h *Host) (*Cli, error) {
 		log:      l,
 	}
 
-	c.SSH, err = NewSSHClient(c.Fields())
+	// the other addresses are tried when the host can't be reached on its address, such as a down management NIC
+	for _, address := range append([]string{h.Address}, h.Addresses...) {
+		c.Address = address
+		if c.SSH, err = NewSSHClient(c.Fields()); err == nil {
+			break
+		}
+		c.log.WithError(err).With("address", address).Errorf("Failed to create ssh client")
+	}
 	if err != nil {
-		c.log.WithError(err).Errorf("Failed to create ssh client")
 		return nil, err
 	}
 
-	c.log.Info("ssh client connected")
+	c.log.With("address", c.Address).Info("ssh client connected")
 
 	c.SFTP, err = NewSFTPClient(c.SSH.sshClient, c.log)
 	if err != nil {
 		c.log.WithError(err).Errorf("Failed to create sftp client")
+		// the ssh connection is not returned to be closed by the caller
+		if closeErr := c.SSH.sshClient.Close(); closeErr != nil && closeErr != io.EOF {
+			c.log.WithError(closeErr).Infoln("Some errors happened when ssh client closed")
+		}
 		return nil, err
 	}
 
@@ -130,6 +226,16 @@ func NewRemoteClient(h *Host) (*Cli, error) {
 	return c, nil
 }
 
+// Close 关闭sftp和ssh客户端
+func (c *Cli) Close() {
+	if err := c.SFTP.sftpClient.Close(); err != nil && err != io.EOF {
+		c.log.WithError(err).Infoln("Some errors happened when sftp client closed")
+	}
+	if err := c.SSH.sshClient.Close(); err != nil && err != io.EOF {
+		c.log.WithError(err).Infoln("Some errors happened when ssh client closed")
+	}
+}
+
 // CloseRemoteCli 关闭远程客户端
 func (c *Cli) CloseRemoteCli(stopChan chan bool) {
 
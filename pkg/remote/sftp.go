@@ -2,6 +2,7 @@ package remote
 
 import (
 	"fmt"
+	"github.com/git-czy/cluster-api-metalnode/pkg/metrics"
 	"github.com/git-czy/cluster-api-metalnode/utils/log"
 	"io"
 	"os"
@@ -43,6 +44,11 @@ func (s *sftp) UploadFile(localFilePath string, remoteDirPath string) error {
 		return err
 	}
 
+	if err := s.sftpClient.MkdirAll(remoteDirPath); err != nil {
+		s.log.WithError(err).Errorln("Failed to create remote directory")
+		return err
+	}
+
 	// 创建远程文件
 	var remoteFileName = path.Base(localFilePath)
 	remoteFile, err := s.sftpClient.Create(path.Join(remoteDirPath, remoteFileName))
@@ -51,8 +57,14 @@ func (s *sftp) UploadFile(localFilePath string, remoteDirPath string) error {
 		return err
 	}
 	defer remoteFile.Close()
+	// the files are read by the ssh user or root only, they may hold secrets
+	if err := remoteFile.Chmod(0600); err != nil {
+		s.log.WithError(err).Errorln("Failed to chmod remote file")
+		return err
+	}
 
-	buf := make([]byte, 1024)
+	// the bundles upload large image tarballs
+	buf := make([]byte, 32*1024)
 	for {
 		n, err := localFile.Read(buf)
 		if err != nil {
@@ -87,6 +99,7 @@ func (s *sftp) UploadFile(localFilePath string, remoteDirPath string) error {
 		return fmt.Errorf("lost data when Upload File")
 	}
 
+	metrics.UploadedBytes.Add(float64(remoteFileStat.Size()))
 	s.log.Infof("File %s successfully upload to %s", localFilePath, path.Join(remoteDirPath, remoteFileName))
 
 	return nil
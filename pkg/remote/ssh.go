@@ -2,13 +2,16 @@ package remote
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"time"
 
 	gossh "golang.org/x/crypto/ssh"
 
+	"github.com/git-czy/cluster-api-metalnode/pkg/metrics"
 	"github.com/git-czy/cluster-api-metalnode/utils/log"
 )
 
@@ -29,8 +32,8 @@ func NewSSHClient(user string, password string, host string, port int, sshKey st
 			return nil, err
 		}
 		break
-	case sshKey != "":
-		if sshClient, err = NewWithOutPassSSHClient(sshKey); err != nil {
+	case user != "" && sshKey != "" && host != "":
+		if sshClient, err = NewWithOutPassSSHClient(user, sshKey, host, port); err != nil {
 			return nil, err
 		}
 	default:
@@ -52,22 +55,49 @@ func NewNormalSSHClient(user string, password string, host string, port int) (*g
 		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error { return nil },
 	}
 
-	address := fmt.Sprintf("%s:%d", host, port)
+	return dialSSHClient(config, host, port)
+}
+
+// NewWithOutPassSSHClient 使用sshKey创建ssh客户端，sshKey为未加密的PEM格式私钥
+func NewWithOutPassSSHClient(user string, sshKey string, host string, port int) (*gossh.Client, error) {
+	signer, err := gossh.ParsePrivateKey([]byte(sshKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ssh key: %v", err)
+	}
+	config := &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		Timeout:         30 * time.Second,
+		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error { return nil },
+	}
 
+	return dialSSHClient(config, host, port)
+}
+
+// ValidSSHKey 检查sshKey是否为未加密的私钥
+func ValidSSHKey(sshKey string) error {
+	_, err := gossh.ParsePrivateKey([]byte(sshKey))
+	return err
+}
+
+// dialSSHClient 连接host的ssh端口，port为0时使用默认端口
+func dialSSHClient(config *gossh.ClientConfig, host string, port int) (*gossh.Client, error) {
+	if port == 0 {
+		port = DefaultPort
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	start := time.Now()
 	client, err := gossh.Dial("tcp", address, config)
+	metrics.SSHDialDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.SSHDialFailures.WithLabelValues(metrics.DialFailureReason(err)).Inc()
 		return nil, err
 	}
 
 	return client, nil
 }
 
-// NewWithOutPassSSHClient 使用sshKey创建ssh客户端
-func NewWithOutPassSSHClient(sshKey string) (*gossh.Client, error) {
-	// todo
-	return nil, nil
-}
-
 // Exec 执行shell命令
 func (s *ssh) Exec(cmd string) ([]string, error) {
 	var stderrs []string
@@ -98,9 +128,11 @@ func (s *ssh) Exec(cmd string) ([]string, error) {
 	r, _ := session.StdoutPipe()
 	e, _ := session.StderrPipe()
 
+	metrics.CommandsExecuted.Inc()
 	go func() {
 		err := session.Run(cmd)
 		if err != nil {
+			metrics.CommandsFailed.Inc()
 			l.WithError(err).Errorln("run command failed")
 			return
 		}
@@ -130,6 +162,34 @@ func (s *ssh) Exec(cmd string) ([]string, error) {
 	}
 }
 
+// Output 执行shell命令，返回标准输出和标准错误，命令退出码非0时返回error
+func (s *ssh) Output(cmd string) (string, string, error) {
+	if s.sshClient == nil {
+		return "", "", fmt.Errorf("before run, have to new a ssh client")
+	}
+
+	session, err := s.sshClient.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer func(session *gossh.Session) {
+		err := session.Close()
+		if err != nil && err != io.EOF {
+			s.log.With("command", cmd).WithError(err).Infoln("Some errors happened when ssh client session closed")
+		}
+	}(session)
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	metrics.CommandsExecuted.Inc()
+	err = session.Run(cmd)
+	if err != nil {
+		metrics.CommandsFailed.Inc()
+	}
+	return stdout.String(), stderr.String(), err
+}
+
 func readStdoutPipe(reader *bufio.Reader, log log.Logger) error {
 	line, _, err := reader.ReadLine()
 	if err == io.EOF {
@@ -0,0 +1,204 @@
+#!/bin/bash
+# install and configure the container runtime, sourced by the init scripts once they defined
+# __install_containerd, __install_crio and __install_docker for their distribution.
+# CONTAINER_RUNTIME is containerd, cri-o or docker (with cri-dockerd), containerd if unset
+# SANDBOX_IMAGE is the pause image, the upstream one if unset
+# REGISTRY_MIRRORS are the mirrors of docker.io separated by commas, docker.io is pulled from directly if unset
+
+CONTAINER_RUNTIME=${CONTAINER_RUNTIME:-containerd}
+SANDBOX_IMAGE=${SANDBOX_IMAGE:-registry.k8s.io/pause:3.6}
+CRI_DOCKERD_VERSION=${CRI_DOCKERD_VERSION:-0.2.6}
+# cri-o is released along with kubernetes, its minor version follows the kubernetes one
+CRIO_VERSION=$(echo "${CONTAINER_RUNTIME_VERSION:-${KUBERNETES_VERSION:-1.24}}" | cut -d. -f1,2)
+
+# RUNTIME_ENDPOINT is the CRI socket of the container runtime, used by crictl and kubelet
+case "${CONTAINER_RUNTIME}" in
+cri-o) RUNTIME_ENDPOINT=unix:///var/run/crio/crio.sock ;;
+docker) RUNTIME_ENDPOINT=unix:///var/run/cri-dockerd.sock ;;
+*) RUNTIME_ENDPOINT=unix:///run/containerd/containerd.sock ;;
+esac
+
+__configure_containerd() {
+  mkdir -p /etc/containerd
+  containerd config default >/etc/containerd/config.toml
+  sed -i 's/SystemdCgroup = false/SystemdCgroup = true/' /etc/containerd/config.toml
+  sed -i "s#sandbox_image = .*#sandbox_image = \"${SANDBOX_IMAGE}\"#" /etc/containerd/config.toml
+  sed -i 's#config_path = ""#config_path = "/etc/containerd/certs.d"#' /etc/containerd/config.toml
+
+  mkdir -p /etc/containerd/certs.d/docker.io
+  {
+    echo 'server = "https://registry-1.docker.io"'
+    for mirror in ${REGISTRY_MIRRORS//,/ }; do
+      echo ""
+      echo "[host.\"${mirror}\"]"
+      echo '  capabilities = ["pull", "resolve"]'
+    done
+  } >/etc/containerd/certs.d/docker.io/hosts.toml
+
+  systemctl daemon-reload
+  systemctl enable containerd
+  systemctl restart containerd
+}
+
+__configure_crio() {
+  mkdir -p /etc/crio/crio.conf.d /etc/containers/registries.conf.d
+  cat >/etc/crio/crio.conf.d/02-kubernetes.conf <<EOF
+[crio.runtime]
+conmon_cgroup = "pod"
+cgroup_manager = "systemd"
+
+[crio.image]
+pause_image = "${SANDBOX_IMAGE}"
+EOF
+
+  {
+    echo '[[registry]]'
+    echo 'prefix = "docker.io"'
+    echo 'location = "registry-1.docker.io"'
+    for mirror in ${REGISTRY_MIRRORS//,/ }; do
+      echo ""
+      echo '[[registry.mirror]]'
+      echo "location = \"${mirror#*://}\""
+    done
+  } >/etc/containers/registries.conf.d/10-mirrors.conf
+
+  systemctl daemon-reload
+  systemctl enable crio
+  systemctl restart crio
+}
+
+__configure_docker() {
+  usermod -aG docker root
+  mkdir -p /etc/docker
+  mirrors=$(echo "${REGISTRY_MIRRORS}" | sed 's/[^,][^,]*/"&"/g')
+  cat >/etc/docker/daemon.json <<EOF
+{
+    "registry-mirrors": [${mirrors}],
+    "exec-opts": ["native.cgroupdriver=systemd"]
+}
+EOF
+
+  systemctl daemon-reload
+  systemctl enable docker
+  systemctl restart docker
+
+  __install_cri_dockerd
+}
+
+# dockershim was removed from kubelet 1.24, cri-dockerd serves the CRI in front of docker
+__install_cri_dockerd() {
+  case $(uname -m) in
+  aarch64) arch=arm64 ;;
+  *) arch=amd64 ;;
+  esac
+  if [ -n "${BUNDLE_DIR}" ]; then
+    install -m 0755 "${BUNDLE_DIR}/bin/cri-dockerd" /usr/local/bin/cri-dockerd
+  else
+    curl -fsSL -o /tmp/cri-dockerd.tgz \
+      https://github.com/Mirantis/cri-dockerd/releases/download/v${CRI_DOCKERD_VERSION}/cri-dockerd-${CRI_DOCKERD_VERSION}.${arch}.tgz
+    tar -xzf /tmp/cri-dockerd.tgz -C /tmp
+    install -m 0755 /tmp/cri-dockerd/cri-dockerd /usr/local/bin/cri-dockerd
+  fi
+
+  cat >/etc/systemd/system/cri-docker.socket <<EOF
+[Unit]
+Description=CRI Docker Socket for the API
+PartOf=cri-docker.service
+
+[Socket]
+ListenStream=%t/cri-dockerd.sock
+SocketMode=0660
+SocketUser=root
+SocketGroup=docker
+
+[Install]
+WantedBy=sockets.target
+EOF
+
+  cat >/etc/systemd/system/cri-docker.service <<EOF
+[Unit]
+Description=CRI Interface for Docker Application Container Engine
+After=network-online.target firewalld.service docker.service
+Wants=network-online.target
+Requires=cri-docker.socket
+
+[Service]
+Type=notify
+ExecStart=/usr/local/bin/cri-dockerd --container-runtime-endpoint fd:// --pod-infra-container-image=${SANDBOX_IMAGE}
+ExecReload=/bin/kill -s HUP \$MAINPID
+Restart=always
+LimitNOFILE=infinity
+Delegate=yes
+KillMode=process
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+  systemctl daemon-reload
+  systemctl enable --now cri-docker.socket
+  systemctl enable cri-docker.service
+  systemctl restart cri-docker.service
+}
+
+# the packages of the container runtime are installed with the others of the offline bundle
+__install_runtime() {
+  case "${CONTAINER_RUNTIME}" in
+  containerd)
+    [ -n "${BUNDLE_DIR}" ] || __install_containerd
+    __configure_containerd
+    ;;
+  cri-o)
+    [ -n "${BUNDLE_DIR}" ] || __install_crio
+    __configure_crio
+    ;;
+  docker)
+    [ -n "${BUNDLE_DIR}" ] || __install_docker
+    __configure_docker
+    ;;
+  *)
+    echo "unsupported container runtime ${CONTAINER_RUNTIME}" >&2
+    exit 1
+    ;;
+  esac
+  if [ -n "${BUNDLE_DIR}" ]; then
+    __import_images
+  fi
+}
+
+# __import_images imports the image tarballs of the offline bundle into the container runtime,
+# cri-o shares the image store of podman
+__import_images() {
+  for image in "${BUNDLE_DIR}"/images/*.tar; do
+    [ -e "${image}" ] || continue
+    case "${CONTAINER_RUNTIME}" in
+    containerd) ctr -n k8s.io images import "${image}" ;;
+    cri-o) podman load -i "${image}" ;;
+    docker) docker load -i "${image}" ;;
+    esac
+    if [ $? -ne 0 ]; then
+      echo "failed to import image ${image}" >&2
+      exit 1
+    fi
+  done
+}
+
+# __configure_crictl points crictl to the container runtime, it is used to check the runtime
+__configure_crictl() {
+  cat >/etc/crictl.yaml <<EOF
+runtime-endpoint: ${RUNTIME_ENDPOINT}
+image-endpoint: ${RUNTIME_ENDPOINT}
+EOF
+}
+
+# __configure_kubelet writes the CRI endpoint of kubelet in its environment file $1,
+# such as /etc/sysconfig/kubelet or /etc/default/kubelet
+__configure_kubelet() {
+  args="--container-runtime-endpoint=${RUNTIME_ENDPOINT}"
+  # before 1.24 kubelet uses dockershim unless the runtime is remote
+  minor=$(kubelet --version | sed -E 's/.*v[0-9]+\.([0-9]+).*/\1/')
+  if [ "${minor}" -lt 24 ]; then
+    args="--container-runtime=remote ${args}"
+  fi
+  echo "KUBELET_EXTRA_ARGS=\"${args}\"" >"$1"
+}
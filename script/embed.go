@@ -0,0 +1,10 @@
+// Package script embeds the init scripts uploaded to the hosts, so the controller does not depend on
+// the directory it runs from
+package script
+
+import "embed"
+
+// FS holds the init scripts
+//
+//go:embed *.sh
+var FS embed.FS
@@ -0,0 +1,66 @@
+#!/bin/bash
+# apply the provisioning settings of the cluster to the host, sourced by the init scripts first.
+# OS_REPO is the base url of the mirror of the os repositories, the repositories of the host are kept if unset
+# OS_REPO_FILES are the urls of repository files added to the package manager, separated by commas
+# DOCKER_REPO and KUBERNETES_REPO are the base urls of the docker-ce and kubernetes repositories, the upstream ones if unset
+# HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used by the package managers and the container runtime
+# CA_CERTIFICATES is a base64 encoded PEM bundle trusted by the host
+# MODULE is the step of the init script run: prepare-host, install-runtime, configure-kernel, configure-system
+# or install-kubeadm, all of them are run in this order if unset
+# BUNDLE_DIR is the offline bundle uploaded by the controller, the packages, binaries and images are installed
+# from it instead of the repositories and registries when set
+
+DOCKER_REPO=${DOCKER_REPO:-https://download.docker.com}
+KUBERNETES_REPO=${KUBERNETES_REPO:-https://packages.cloud.google.com}
+
+# __module check if the step $1 of the init script is run
+__module() {
+  [ -z "${MODULE}" ] || [ "${MODULE}" = "$1" ]
+}
+
+# __add_repo_files downloads the repository files of OS_REPO_FILES into the directory $1, named after their url
+__add_repo_files() {
+  for url in ${OS_REPO_FILES//,/ }; do
+    if ! curl -fsSL -o "$1/${url##*/}" "${url}"; then
+      echo "failed to download repository file ${url}" >&2
+      exit 1
+    fi
+  done
+}
+
+__set_proxy() {
+  if [ -z "${HTTP_PROXY}${HTTPS_PROXY}" ]; then
+    for service in containerd crio docker; do
+      rm -f /etc/systemd/system/${service}.service.d/http-proxy.conf
+    done
+    return
+  fi
+  export HTTP_PROXY HTTPS_PROXY NO_PROXY
+  export http_proxy=${HTTP_PROXY} https_proxy=${HTTPS_PROXY} no_proxy=${NO_PROXY}
+
+  # the container runtime pulls the images through the proxy
+  for service in containerd crio docker; do
+    mkdir -p /etc/systemd/system/${service}.service.d
+    cat >/etc/systemd/system/${service}.service.d/http-proxy.conf <<EOF
+[Service]
+Environment="HTTP_PROXY=${HTTP_PROXY}"
+Environment="HTTPS_PROXY=${HTTPS_PROXY}"
+Environment="NO_PROXY=${NO_PROXY}"
+EOF
+  done
+  systemctl daemon-reload
+}
+
+__set_ca_certificates() {
+  if [ -z "${CA_CERTIFICATES}" ]; then
+    return
+  fi
+  if command -v update-ca-trust >/dev/null 2>&1; then
+    echo "${CA_CERTIFICATES}" | base64 -d >/etc/pki/ca-trust/source/anchors/metalnode-ca.crt
+    update-ca-trust extract
+  else
+    mkdir -p /usr/local/share/ca-certificates
+    echo "${CA_CERTIFICATES}" | base64 -d >/usr/local/share/ca-certificates/metalnode-ca.crt
+    update-ca-certificates
+  fi
+}
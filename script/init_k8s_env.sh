@@ -1,60 +1,106 @@
 #!/bin/bash
+# KUBERNETES_VERSION and CONTAINER_RUNTIME_VERSION pin the versions installed, the latest ones are installed if unset
+# CONTAINER_RUNTIME, SANDBOX_IMAGE and REGISTRY_MIRRORS configure the container runtime, see container_runtime.sh
+# the repositories, proxies and CA certificates are set by host_settings.sh
+
+# __yum_install installs the packages, or downgrades them when newer versions are installed
+__yum_install() {
+  yum install -y "$@" || yum downgrade -y "$@"
+}
+
+. "$(dirname "$0")/host_settings.sh"
+__set_proxy
+__set_ca_certificates
+
+# __install_bundle installs all the packages of the offline bundle, without the repositories
+__install_bundle() {
+  yum localinstall -y --disablerepo='*' "${BUNDLE_DIR}"/packages/*.rpm
+}
 
 __set_mirrors() {
-  curl -o /etc/yum.repos.d/epel.repo http://mirrors.aliyun.com/repo/epel-7.repo
-  curl -o /etc/yum.repos.d/CentOS-Base.repo https://mirrors.aliyun.com/repo/Centos-7.repo
-  sed -i -e '/mirrors.cloud.aliyuncs.com/d' -e '/mirrors.aliyuncs.com/d' /etc/yum.repos.d/CentOS-Base.repo
+  if [ -n "${BUNDLE_DIR}" ]; then
+    __install_bundle
+    return
+  fi
+  if [ -n "${OS_REPO}" ]; then
+    sed -i -e 's|^mirrorlist=|#mirrorlist=|' -e "s|^#\?baseurl=http://mirror.centos.org/centos|baseurl=${OS_REPO}|" /etc/yum.repos.d/CentOS-*.repo
+  fi
+  __add_repo_files /etc/yum.repos.d
 
   yum clean all
   yum makecache fast
   yum install -y sudo
 
 }
-__set_mirrors
+__module prepare-host && __set_mirrors
 
 
-__install_docker() {
+__add_docker_repo() {
   yum install -y yum-utils device-mapper-persistent-data lvm2
-  yum-config-manager --add-repo https://mirrors.aliyun.com/docker-ce/linux/centos/docker-ce.repo
-  sed -i 's+download.docker.com+mirrors.aliyun.com/docker-ce+' /etc/yum.repos.d/docker-ce.repo
+  yum-config-manager --add-repo ${DOCKER_REPO}/linux/centos/docker-ce.repo
+  sed -i "s+https://download.docker.com+${DOCKER_REPO}+" /etc/yum.repos.d/docker-ce.repo
   yum makecache fast
-  yum -y install docker-ce
-
-  usermod -aG docker root
-  mkdir -p /etc/docker
-  cat >/etc/docker/daemon.json <<EOF
-{
-    "registry-mirrors": [
-        "https://mirror.ccs.tencentyun.com",
-        "https://docker.mirrors.ustc.edu.cn"
-    ],
-    "exec-opts": ["native.cgroupdriver=systemd"]
 }
-EOF
 
-  systemctl daemon-reload
-  systemctl enable docker
-  systemctl restart docker
+__install_containerd() {
+  __add_docker_repo
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    __yum_install containerd.io-${CONTAINER_RUNTIME_VERSION}
+  else
+    yum -y install containerd.io
+  fi
+}
+
+__install_crio() {
+  curl -fsSL -o /etc/yum.repos.d/devel:kubic:libcontainers:stable.repo \
+    https://download.opensuse.org/repositories/devel:/kubic:/libcontainers:/stable/CentOS_7/devel:kubic:libcontainers:stable.repo
+  curl -fsSL -o /etc/yum.repos.d/devel:kubic:libcontainers:stable:cri-o:${CRIO_VERSION}.repo \
+    https://download.opensuse.org/repositories/devel:kubic:libcontainers:stable:cri-o:${CRIO_VERSION}/CentOS_7/devel:kubic:libcontainers:stable:cri-o:${CRIO_VERSION}.repo
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    __yum_install cri-o-${CONTAINER_RUNTIME_VERSION}
+  else
+    yum -y install cri-o
+  fi
+}
+
+__install_docker() {
+  __add_docker_repo
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    __yum_install docker-ce-${CONTAINER_RUNTIME_VERSION} docker-ce-cli-${CONTAINER_RUNTIME_VERSION}
+  else
+    yum -y install docker-ce
+  fi
 }
 
-__install_docker
+. "$(dirname "$0")/container_runtime.sh"
+__module install-runtime && __install_runtime
 
 
 # 参考 https://kubernetes.io/zh/docs/setup/production-environment/tools/kubeadm/install-kubeadm/
 __set_iptables() {
   cat <<EOF | sudo tee /etc/modules-load.d/k8s.conf
+overlay
 br_netfilter
 EOF
+  sudo modprobe overlay
+  sudo modprobe br_netfilter
 
   cat <<EOF | sudo tee /etc/sysctl.d/k8s.conf
 net.bridge.bridge-nf-call-ip6tables = 1
 net.bridge.bridge-nf-call-iptables = 1
+net.ipv4.ip_forward = 1
 EOF
 
   sudo sysctl --system
 }
 
-__set_iptables
+__module configure-kernel && __set_iptables
+
+__disable_swap() {
+  swapoff -a
+  sed -i '/\sswap\s/ s/^#*/#/' /etc/fstab
+}
+__module configure-kernel && __disable_swap
 
 __set_config() {
   timedatectl set-timezone Asia/Shanghai
@@ -65,27 +111,36 @@ __set_config() {
   setenforce 0
   sed -i 's,^SELINUX=.*$,SELINUX=disabled,' /etc/selinux/config
 }
-__set_config
+__module configure-system && __set_config
 
 
 
 __install_kubeadm() {
+  if [ -n "${BUNDLE_DIR}" ]; then
+    # installed from the offline bundle
+    systemctl enable kubelet
+    return
+  fi
   cat <<EOF > /etc/yum.repos.d/kubernetes.repo
 [kubernetes]
 name=Kubernetes
-baseurl=http://mirrors.aliyun.com/kubernetes/yum/repos/kubernetes-el7-x86_64
+baseurl=${KUBERNETES_REPO}/yum/repos/kubernetes-el7-x86_64
 enabled=1
 gpgcheck=0
 repo_gpgcheck=0
-gpgkey=http://mirrors.aliyun.com/kubernetes/yum/doc/yum-key.gpg
-       http://mirrors.aliyun.com/kubernetes/yum/doc/rpm-package-key.gpg
+gpgkey=${KUBERNETES_REPO}/yum/doc/yum-key.gpg
+       ${KUBERNETES_REPO}/yum/doc/rpm-package-key.gpg
 EOF
 
-  yum install -y kubelet kubeadm kubectl --disableexcludes=kubernetes
+  if [ -n "${KUBERNETES_VERSION}" ]; then
+    __yum_install kubelet-${KUBERNETES_VERSION} kubeadm-${KUBERNETES_VERSION} kubectl-${KUBERNETES_VERSION} --disableexcludes=kubernetes
+  else
+    yum install -y kubelet kubeadm kubectl --disableexcludes=kubernetes
+  fi
   systemctl enable kubelet
 }
 
-__install_kubeadm
-
-
+__module install-kubeadm && __install_kubeadm
 
+__module install-kubeadm && __configure_crictl
+__module install-kubeadm && __configure_kubelet /etc/sysconfig/kubelet
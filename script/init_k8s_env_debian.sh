@@ -0,0 +1,160 @@
+#!/bin/bash
+# init the k8s env of Ubuntu and Debian
+# KUBERNETES_VERSION and CONTAINER_RUNTIME_VERSION pin the versions installed, the latest ones are installed if unset
+# CONTAINER_RUNTIME, SANDBOX_IMAGE and REGISTRY_MIRRORS configure the container runtime, see container_runtime.sh
+# the repositories, proxies and CA certificates are set by host_settings.sh
+
+export DEBIAN_FRONTEND=noninteractive
+
+. /etc/os-release
+
+# __apt_version returns the full version of the package matching the version, such as 5:20.10.14~3-0~ubuntu-focal
+__apt_version() {
+  apt-cache madison "$1" | awk '{print $3}' | grep -E "^([0-9]+:)?$2([-~.]|$)" | head -1
+}
+
+. "$(dirname "$0")/host_settings.sh"
+__set_proxy
+__set_ca_certificates
+
+# __install_bundle installs all the packages of the offline bundle, without the repositories
+__install_bundle() {
+  apt-get install -y --allow-downgrades --no-download "${BUNDLE_DIR}"/packages/*.deb
+}
+
+__set_mirrors() {
+  if [ -n "${BUNDLE_DIR}" ]; then
+    __install_bundle
+    return
+  fi
+  if [ -n "${OS_REPO}" ]; then
+    sed -i -E "s#https?://(archive|security)\.ubuntu\.com/ubuntu([ /])#${OS_REPO}\2#; s#https?://deb\.debian\.org/debian([ /])#${OS_REPO}\1#" \
+      /etc/apt/sources.list
+  fi
+  __add_repo_files /etc/apt/sources.list.d
+  apt-get update
+  apt-get install -y sudo curl gnupg apt-transport-https ca-certificates lsb-release
+}
+__module prepare-host && __set_mirrors
+
+
+__add_docker_repo() {
+  mkdir -p /usr/share/keyrings
+  curl -fsSL ${DOCKER_REPO}/linux/${ID}/gpg | gpg --batch --yes --dearmor -o /usr/share/keyrings/docker-archive-keyring.gpg
+  echo "deb [arch=$(dpkg --print-architecture) signed-by=/usr/share/keyrings/docker-archive-keyring.gpg] ${DOCKER_REPO}/linux/${ID} $(lsb_release -cs) stable" \
+    >/etc/apt/sources.list.d/docker.list
+  apt-get update
+}
+
+__install_containerd() {
+  __add_docker_repo
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    apt-get install -y --allow-downgrades containerd.io=$(__apt_version containerd.io "${CONTAINER_RUNTIME_VERSION}")
+  else
+    apt-get install -y containerd.io
+  fi
+}
+
+__install_crio() {
+  if [ "${ID}" = "ubuntu" ]; then
+    os=xUbuntu_${VERSION_ID}
+  else
+    os=Debian_${VERSION_ID}
+  fi
+  curl -fsSL https://download.opensuse.org/repositories/devel:/kubic:/libcontainers:/stable/${os}/Release.key |
+    gpg --batch --yes --dearmor -o /usr/share/keyrings/libcontainers-archive-keyring.gpg
+  curl -fsSL https://download.opensuse.org/repositories/devel:/kubic:/libcontainers:/stable:/cri-o:/${CRIO_VERSION}/${os}/Release.key |
+    gpg --batch --yes --dearmor -o /usr/share/keyrings/libcontainers-crio-archive-keyring.gpg
+  echo "deb [signed-by=/usr/share/keyrings/libcontainers-archive-keyring.gpg] https://download.opensuse.org/repositories/devel:/kubic:/libcontainers:/stable/${os}/ /" \
+    >/etc/apt/sources.list.d/devel:kubic:libcontainers:stable.list
+  echo "deb [signed-by=/usr/share/keyrings/libcontainers-crio-archive-keyring.gpg] https://download.opensuse.org/repositories/devel:/kubic:/libcontainers:/stable:/cri-o:/${CRIO_VERSION}/${os}/ /" \
+    >/etc/apt/sources.list.d/devel:kubic:libcontainers:stable:cri-o:${CRIO_VERSION}.list
+  apt-get update
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    apt-get install -y --allow-downgrades cri-o=$(__apt_version cri-o "${CONTAINER_RUNTIME_VERSION}") cri-o-runc
+  else
+    apt-get install -y cri-o cri-o-runc
+  fi
+}
+
+__install_docker() {
+  __add_docker_repo
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    version=$(__apt_version docker-ce "${CONTAINER_RUNTIME_VERSION}")
+    apt-get install -y --allow-downgrades docker-ce=${version} docker-ce-cli=${version}
+  else
+    apt-get install -y docker-ce
+  fi
+}
+
+. "$(dirname "$0")/container_runtime.sh"
+__module install-runtime && __install_runtime
+
+
+# 参考 https://kubernetes.io/zh/docs/setup/production-environment/tools/kubeadm/install-kubeadm/
+__set_iptables() {
+  cat <<EOF | sudo tee /etc/modules-load.d/k8s.conf
+overlay
+br_netfilter
+EOF
+  sudo modprobe overlay
+  sudo modprobe br_netfilter
+
+  cat <<EOF | sudo tee /etc/sysctl.d/k8s.conf
+net.bridge.bridge-nf-call-ip6tables = 1
+net.bridge.bridge-nf-call-iptables = 1
+net.ipv4.ip_forward = 1
+EOF
+
+  sudo sysctl --system
+}
+
+__module configure-kernel && __set_iptables
+
+__disable_swap() {
+  swapoff -a
+  sed -i '/\sswap\s/ s/^#*/#/' /etc/fstab
+}
+__module configure-kernel && __disable_swap
+
+__set_config() {
+  timedatectl set-timezone Asia/Shanghai
+  timedatectl set-local-rtc 0
+  if command -v ufw >/dev/null 2>&1; then
+    ufw disable
+  fi
+  # AppArmor is supported by kubelet and kept enabled,
+  # but the container runtime can't load its profiles without apparmor_parser
+  if [ -d /sys/kernel/security/apparmor ]; then
+    apt-get install -y apparmor
+  fi
+}
+__module configure-system && __set_config
+
+
+
+__install_kubeadm() {
+  if [ -n "${BUNDLE_DIR}" ]; then
+    # installed from the offline bundle
+    apt-mark hold kubelet kubeadm kubectl
+    systemctl enable kubelet
+    return
+  fi
+  curl -fsSL ${KUBERNETES_REPO}/apt/doc/apt-key.gpg | gpg --batch --yes --dearmor -o /usr/share/keyrings/kubernetes-archive-keyring.gpg
+  echo "deb [signed-by=/usr/share/keyrings/kubernetes-archive-keyring.gpg] ${KUBERNETES_REPO}/apt/ kubernetes-xenial main" \
+    >/etc/apt/sources.list.d/kubernetes.list
+  apt-get update
+  apt-mark unhold kubelet kubeadm kubectl
+  if [ -n "${KUBERNETES_VERSION}" ]; then
+    apt-get install -y --allow-downgrades kubelet=${KUBERNETES_VERSION}-00 kubeadm=${KUBERNETES_VERSION}-00 kubectl=${KUBERNETES_VERSION}-00
+  else
+    apt-get install -y kubelet kubeadm kubectl
+  fi
+  apt-mark hold kubelet kubeadm kubectl
+  systemctl enable kubelet
+}
+
+__module install-kubeadm && __install_kubeadm
+
+__module install-kubeadm && __configure_crictl
+__module install-kubeadm && __configure_kubelet /etc/default/kubelet
@@ -0,0 +1,134 @@
+#!/bin/bash
+# init the k8s env of openEuler
+# KUBERNETES_VERSION and CONTAINER_RUNTIME_VERSION pin the versions installed, the latest ones are installed if unset
+# CONTAINER_RUNTIME, SANDBOX_IMAGE and REGISTRY_MIRRORS configure the container runtime, see container_runtime.sh
+# the repositories, proxies and CA certificates are set by host_settings.sh
+
+# __dnf_install installs the packages, or downgrades them when newer versions are installed
+__dnf_install() {
+  dnf install -y "$@" || dnf downgrade -y "$@"
+}
+
+. "$(dirname "$0")/host_settings.sh"
+__set_proxy
+__set_ca_certificates
+
+# __install_bundle installs all the packages of the offline bundle, without the repositories
+__install_bundle() {
+  dnf install -y --disablerepo='*' --allowerasing "${BUNDLE_DIR}"/packages/*.rpm
+}
+
+__set_mirrors() {
+  if [ -n "${BUNDLE_DIR}" ]; then
+    __install_bundle
+    return
+  fi
+  if [ -n "${OS_REPO}" ]; then
+    sed -i "s|^baseurl=http://repo.openeuler.org|baseurl=${OS_REPO}|" /etc/yum.repos.d/openEuler.repo
+  fi
+  __add_repo_files /etc/yum.repos.d
+  dnf makecache
+  dnf install -y sudo curl tar
+}
+__module prepare-host && __set_mirrors
+
+
+# the container runtimes are shipped by the everything and EPOL repos of openEuler
+__install_containerd() {
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    __dnf_install containerd-${CONTAINER_RUNTIME_VERSION}
+  else
+    dnf -y install containerd
+  fi
+}
+
+__install_crio() {
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    __dnf_install cri-o-${CONTAINER_RUNTIME_VERSION}
+  else
+    dnf -y install cri-o
+  fi
+}
+
+__install_docker() {
+  if [ -n "${CONTAINER_RUNTIME_VERSION}" ]; then
+    __dnf_install docker-${CONTAINER_RUNTIME_VERSION}
+  else
+    dnf -y install docker
+  fi
+}
+
+. "$(dirname "$0")/container_runtime.sh"
+__module install-runtime && __install_runtime
+
+
+# 参考 https://kubernetes.io/zh/docs/setup/production-environment/tools/kubeadm/install-kubeadm/
+__set_iptables() {
+  cat <<EOF | sudo tee /etc/modules-load.d/k8s.conf
+overlay
+br_netfilter
+EOF
+  sudo modprobe overlay
+  sudo modprobe br_netfilter
+
+  cat <<EOF | sudo tee /etc/sysctl.d/k8s.conf
+net.bridge.bridge-nf-call-ip6tables = 1
+net.bridge.bridge-nf-call-iptables = 1
+net.ipv4.ip_forward = 1
+EOF
+
+  sudo sysctl --system
+}
+
+__module configure-kernel && __set_iptables
+
+__disable_swap() {
+  swapoff -a
+  sed -i '/\sswap\s/ s/^#*/#/' /etc/fstab
+}
+__module configure-kernel && __disable_swap
+
+__set_config() {
+  timedatectl set-timezone Asia/Shanghai
+  timedatectl set-local-rtc 0
+  if systemctl list-unit-files firewalld.service >/dev/null 2>&1; then
+    systemctl stop firewalld.service
+    systemctl disable firewalld.service
+  fi
+  # kubeadm does not support SELinux yet, keep it permissive
+  setenforce 0
+  sed -i 's,^SELINUX=.*$,SELINUX=permissive,' /etc/selinux/config
+}
+__module configure-system && __set_config
+
+
+
+__install_kubeadm() {
+  if [ -n "${BUNDLE_DIR}" ]; then
+    # installed from the offline bundle
+    systemctl enable kubelet
+    return
+  fi
+  cat <<EOF > /etc/yum.repos.d/kubernetes.repo
+[kubernetes]
+name=Kubernetes
+baseurl=${KUBERNETES_REPO}/yum/repos/kubernetes-el7-\$basearch
+enabled=1
+gpgcheck=0
+repo_gpgcheck=0
+gpgkey=${KUBERNETES_REPO}/yum/doc/yum-key.gpg
+       ${KUBERNETES_REPO}/yum/doc/rpm-package-key.gpg
+EOF
+
+  if [ -n "${KUBERNETES_VERSION}" ]; then
+    __dnf_install kubelet-${KUBERNETES_VERSION} kubeadm-${KUBERNETES_VERSION} kubectl-${KUBERNETES_VERSION} --disableexcludes=kubernetes
+  else
+    dnf install -y kubelet kubeadm kubectl --disableexcludes=kubernetes
+  fi
+  systemctl enable kubelet
+}
+
+__module install-kubeadm && __install_kubeadm
+
+__module install-kubeadm && __configure_crictl
+__module install-kubeadm && __configure_kubelet /etc/sysconfig/kubelet